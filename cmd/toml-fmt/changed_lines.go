@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The line-scoped check (--check-only-changed-lines) only fails for formatting
+// problems on lines the developer touched. The rules are:
+//
+//   - Changed lines are the lines of the working-tree file that are added or
+//     modified compared to HEAD, staged or not (git diff HEAD). A file that git
+//     does not track yet counts as changed in full.
+//   - A line is misformatted when formatting would rewrite or remove it. When
+//     formatting would insert lines (such as a missing blank line before a
+//     header), the insertion is blamed on the input line that follows it, or on
+//     the last line when it happens at the end of the file.
+//   - The check fails only if a misformatted line is also a changed line.
+
+// hunkHeader matches a unified diff hunk header and captures the new-file range.
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// changedLines returns the 1-based line numbers of filename that differ from HEAD.
+//
+// Parameters:
+//   - filename: Path of the file to inspect, inside a git work tree
+//
+// Returns:
+//   - map[int]bool: Changed line numbers (nil when the whole file counts as changed)
+//   - bool: Whether the whole file counts as changed (it is untracked)
+//   - error: If git fails, e.g. because the file is not in a git repository
+func changedLines(filename string) (map[int]bool, bool, error) {
+	dir, base := filepath.Split(filepath.Clean(filename))
+	if dir == "" {
+		dir = "." // git runs next to the file so any repository it belongs to is found
+	}
+
+	// Untracked files have no history, so every line is new
+	lsFiles := exec.Command("git", "ls-files", "--error-unmatch", "--", base)
+	lsFiles.Dir = dir
+	if err := lsFiles.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, false, fmt.Errorf("running git: %w", err)
+		}
+		if err := exec.Command("git", "-C", dir, "rev-parse", "--git-dir").Run(); err != nil {
+			return nil, false, fmt.Errorf("'%s' is not inside a git repository", filename)
+		}
+		return nil, true, nil
+	}
+
+	var stderr bytes.Buffer
+	diff := exec.Command("git", "diff", "--no-color", "--no-ext-diff", "--unified=0", "HEAD", "--", base)
+	diff.Dir = dir
+	diff.Stderr = &stderr
+	out, err := diff.Output()
+	if err != nil {
+		return nil, false, fmt.Errorf("running git diff for '%s': %w: %s", filename, err, strings.TrimSpace(stderr.String()))
+	}
+	lines, err := parseHunkRanges(out)
+	return lines, false, err
+}
+
+// parseHunkRanges collects the new-file line numbers covered by the hunks of a
+// unified diff. Hunks that only delete lines cover no new lines.
+func parseHunkRanges(diff []byte) (map[int]bool, error) {
+	lines := map[int]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(diff))
+	for scanner.Scan() {
+		m := hunkHeader.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		start, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing hunk header %q: %w", scanner.Text(), err)
+		}
+		count := 1 // An omitted count means a single line
+		if m[2] != "" {
+			if count, err = strconv.Atoi(m[2]); err != nil {
+				return nil, fmt.Errorf("parsing hunk header %q: %w", scanner.Text(), err)
+			}
+		}
+		for n := start; n < start+count; n++ {
+			lines[n] = true
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// misformattedLines compares a document with its formatted form line by line and
+// returns the 1-based numbers of the input lines that formatting would change,
+// in ascending order, following the rules described above.
+func misformattedLines(input, formatted []byte) []int {
+	in := splitLines(input)
+	out := splitLines(formatted)
+
+	bad := map[int]bool{}
+	for _, e := range lineEdits(in, out) {
+		switch e.op {
+		case editDelete:
+			bad[e.a+1] = true // Rewritten or removed by formatting
+		case editInsert:
+			bad[min(e.a+1, max(len(in), 1))] = true // Inserted before in[e.a], or after the last line
+		}
+	}
+
+	result := make([]int, 0, len(bad))
+	for n := 1; n <= max(len(in), 1); n++ {
+		if bad[n] {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// splitLines splits a document into lines without their line endings.
+func splitLines(b []byte) []string {
+	text := strings.TrimSuffix(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// checkChangedLines reports the changed lines of filename that formatting would
+// alter. Each offending line is printed to stderr as "file:line: not formatted".
+//
+// Parameters:
+//   - filename: The file being checked
+//   - input: The file's content (without a BOM)
+//   - formatted: The formatted content
+//
+// Returns:
+//   - error: If a changed line is misformatted or git cannot be queried, or nil
+func checkChangedLines(filename string, input, formatted []byte) error {
+	changed, allChanged, err := changedLines(filename)
+	if err != nil {
+		return err
+	}
+	var offending []int
+	for _, n := range misformattedLines(input, formatted) {
+		if allChanged || changed[n] {
+			offending = append(offending, n)
+		}
+	}
+	for _, n := range offending {
+		fmt.Fprintf(os.Stderr, "%s:%d: not formatted\n", filename, n)
+	}
+	if len(offending) > 0 {
+		return fmt.Errorf("file '%s': %d changed line(s) %w", filename, len(offending), errNotFormatted)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Color policies accepted by --color.
+const (
+	colorAuto   = "auto"   // Color output that goes to a terminal
+	colorAlways = "always" // Color output even when it is piped or redirected
+	colorNever  = "never"  // Never color output
+)
+
+// ANSI escape sequences used for colored output.
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiCyan    = "\x1b[36m"
+	ansiBoldRed = "\x1b[1;31m"
+)
+
+// errorPosition matches the position of a parse error within an error message.
+var errorPosition = regexp.MustCompile(`line \d+(, column \d+)?`)
+
+// useColor decides whether output written to f is colored under a --color policy.
+// In auto mode only a terminal gets color, and setting NO_COLOR or TERM=dumb
+// turns it off (see https://no-color.org).
+//
+// Parameters:
+//   - mode: One of the color* policies
+//   - f: The file output is written to
+//
+// Returns:
+//   - bool: Whether to write ANSI color sequences to f
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// isTerminal reports whether f is a terminal (a character device) rather than a
+// file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize wraps text in an ANSI color sequence.
+func colorize(color, text string) string {
+	return color + text + ansiReset
+}
+
+// colorizeDiff colors a unified or context diff as written by writeDiff: file
+// headers bold, hunk headers cyan, removed lines red, added lines green, and
+// changed lines of a context diff yellow. A name-only diff is returned as is.
+//
+// Parameters:
+//   - format: The --diff-format style the diff was written in
+//   - diff: The diff text
+//
+// Returns:
+//   - string: The diff with ANSI color sequences
+func colorizeDiff(format, diff string) string {
+	if format == diffFormatNameOnly || diff == "" {
+		return diff
+	}
+	lines := strings.SplitAfter(diff, "\n")
+	var b strings.Builder
+	for i, line := range lines {
+		text := strings.TrimSuffix(line, "\n")
+		color := ""
+		switch {
+		case text == "":
+		case i < 2: // The "--- a/name" and "+++ b/name" (or "*** a/name") file headers
+			color = ansiBold
+		case format == diffFormatUnified && strings.HasPrefix(text, "@@"):
+			color = ansiCyan
+		case format == diffFormatContext && (strings.HasPrefix(text, "***") || strings.HasPrefix(text, "--- ")):
+			color = ansiCyan // The hunk separator and the range lines of each side
+		case strings.HasPrefix(text, "-"):
+			color = ansiRed
+		case strings.HasPrefix(text, "+"):
+			color = ansiGreen
+		case strings.HasPrefix(text, "!"):
+			color = ansiYellow
+		}
+		if color == "" {
+			b.WriteString(line)
+			continue
+		}
+		b.WriteString(colorize(color, text))
+		b.WriteString(line[len(text):]) // The newline stays outside the color sequence
+	}
+	return b.String()
+}
+
+// printError reports an error on w the way toml-fmt does, optionally with the
+// "Error:" label and the position of a parse error in red.
+//
+// Parameters:
+//   - w: Writer that receives the message, usually os.Stderr
+//   - err: The error to report
+//   - color: Whether to write ANSI color sequences
+func printError(w io.Writer, err error, color bool) {
+	if !color {
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return
+	}
+	msg := errorPosition.ReplaceAllStringFunc(err.Error(), func(pos string) string {
+		return colorize(ansiBoldRed, pos)
+	})
+	fmt.Fprintf(w, "%s %s\n", colorize(ansiBoldRed, "Error:"), msg)
+}
@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// configFileNames are the names of the configuration file, in order of preference
+// when a directory holds more than one.
+var configFileNames = []string{".tomlfmt.toml", ".tomlfmt"}
+
+// fileConfig holds the options a configuration file may set. Its keys are the
+// long names of the matching command-line flags; a field stays nil when the file
+// does not set it. trailing-comma has no flag of its own.
+type fileConfig struct {
+	Indent                     *bool   `toml:"indent"`
+	IndentStyle                *string `toml:"indent-style"`
+	IndentSize                 *int    `toml:"indent-size"`
+	IndentMode                 *string `toml:"indent-mode"`
+	Sort                       *string `toml:"sort"`
+	BOM                        *string `toml:"bom"`
+	LineEnding                 *string `toml:"line-ending"`
+	NoNewlineKeysToArrayTables *bool   `toml:"no-newline-between-array-tables-and-keys"`
+	BlankLinesArrayTables      *int    `toml:"blank-lines-between-array-tables"`
+	SortArrayTables            *bool   `toml:"sort-array-tables"`
+	SortArrayTablesBy          *string `toml:"sort-array-tables-by"`
+	MultilineStrings           *string `toml:"multiline-strings"`
+	InlineTablesMaxKeys        *int    `toml:"inline-tables-max-keys"`
+	GroupKeysByValueType       *bool   `toml:"group-keys-by-value-type"`
+	FloatFormat                *string `toml:"float-format"`
+	PreserveKeyQuotes          *bool   `toml:"preserve-key-quotes"`
+	PreserveBlankLines         *bool   `toml:"preserve-blank-lines"`
+	CollapseTableChains        *bool   `toml:"collapse-table-chains"`
+	StringStyle                *string `toml:"string-style"`
+	BasicStrings               *bool   `toml:"basic-strings"`
+	NoAlign                    *bool   `toml:"no-align"`
+	MaxLineWidth               *int    `toml:"max-line-width"`
+	TrailingComma              *bool   `toml:"trailing-comma"`
+}
+
+// envVarPrefix starts the name of every environment variable that sets an option.
+const envVarPrefix = "TOMLFMT_"
+
+// envVarName returns the environment variable that sets the default of a flag,
+// such as TOMLFMT_MAX_LINE_WIDTH for --max-line-width.
+func envVarName(flag string) string {
+	return envVarPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// envVarAliases maps the name of an environment variable to another name it is
+// also read from, when it is not set itself.
+var envVarAliases = map[string]string{
+	envVarName("max-line-width"): envVarPrefix + "MAX_WIDTH",
+}
+
+// envVarFor returns the environment variable a flag takes its default from: the
+// one envVarName gives, or its alias when only the alias is set.
+func envVarFor(flag string) string {
+	name := envVarName(flag)
+	if alias, ok := envVarAliases[name]; ok && os.Getenv(name) == "" && os.Getenv(alias) != "" {
+		return alias
+	}
+	return name
+}
+
+// configKeys returns the keys a configuration file may set, which are also the
+// long names of their flags, in the order fileConfig declares them.
+func configKeys() []string {
+	t := reflect.TypeFor[fileConfig]()
+	keys := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		keys = append(keys, t.Field(i).Tag.Get("toml"))
+	}
+	return keys
+}
+
+// findConfigFile looks for a configuration file in dir and then in each of its
+// parent directories, returning the first one found.
+//
+// Parameters:
+//   - dir: Directory to start from
+//
+// Returns:
+//   - string: Path of the configuration file, or "" if there is none
+//   - error: If a directory cannot be resolved or a candidate cannot be checked
+func findConfigFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolving directory '%s': %w", dir, err)
+	}
+	for {
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			info, err := os.Stat(path)
+			if err == nil && !info.IsDir() {
+				return path, nil
+			}
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("checking for config file '%s': %w", path, err)
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil // Reached the root without finding one
+		}
+		dir = parent
+	}
+}
+
+// loadConfigFile reads and validates a configuration file. Unknown keys are an
+// error, so that a misspelled option is not silently ignored.
+//
+// Parameters:
+//   - path: Path of the configuration file
+//
+// Returns:
+//   - fileConfig: The options the file sets
+//   - error: If the file cannot be read, is not valid TOML, or holds an unknown key or invalid value
+func loadConfigFile(path string) (fileConfig, error) {
+	var cfg fileConfig
+	content, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return cfg, fmt.Errorf("reading config file: %w", err)
+	}
+	decoder := toml.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		var strictErr *toml.StrictMissingError
+		if errors.As(err, &strictErr) {
+			// Name the offending keys rather than the decoder's generic message
+			unknown := make([]string, 0, len(strictErr.Errors))
+			for _, keyErr := range strictErr.Errors {
+				unknown = append(unknown, strings.Join(keyErr.Key(), "."))
+			}
+			return cfg, fmt.Errorf("config file '%s': unknown key(s): %s", path, strings.Join(unknown, ", "))
+		}
+		return cfg, fmt.Errorf("config file '%s': %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, fmt.Errorf("config file '%s': %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the values that the command line restricts to a fixed set.
+func (c fileConfig) validate() error {
+	enums := []struct {
+		key     string
+		value   *string
+		allowed []string
+	}{
+		{"indent-style", c.IndentStyle, []string{"space", "tab"}},
+		{"indent-mode", c.IndentMode, []string{"nested", "tables-only", "entries-only"}},
+		{"sort", c.Sort, []string{"asc", "none", "group-only"}},
+		{"bom", c.BOM, []string{"preserve", "always", "never"}},
+		{"line-ending", c.LineEnding, []string{lineEndingAuto, lineEndingLF, lineEndingCRLF}},
+		{"multiline-strings", c.MultilineStrings, []string{"never", "newlines"}},
+		{"float-format", c.FloatFormat, []string{"shortest", "decimal", "exponent"}},
+		{"string-style", c.StringStyle, []string{"auto", "basic", "literal", "preserve"}},
+	}
+	for _, e := range enums {
+		if e.value != nil && !slices.Contains(e.allowed, *e.value) {
+			return fmt.Errorf("%s must be one of %q, got %q", e.key, e.allowed, *e.value)
+		}
+	}
+	return nil
+}
+
+// applySetting copies a configured value into dst unless the flag of the same
+// name was given on the command line, which always takes precedence.
+func applySetting[T any](dst *T, value *T, flag string, setFlags map[string]bool) {
+	if value != nil && !setFlags[flag] {
+		*dst = *value
+	}
+}
+
+// applyTo returns opts with the configured options filled in, keeping every
+// option whose flag was given on the command line.
+func (c fileConfig) applyTo(opts cliOptions) cliOptions {
+	set := opts.setFlags
+	if !opts.canonical { // --canonical keeps the layout of the output standard
+		applySetting(&opts.indentEnable, c.Indent, "indent", set)
+		applySetting(&opts.indentStyle, c.IndentStyle, "indent-style", set)
+		applySetting(&opts.indentSize, c.IndentSize, "indent-size", set)
+		if !set["indent-tables-only"] { // --indent-tables-only is a way of giving --indent-mode on the command line
+			applySetting(&opts.indentMode, c.IndentMode, "indent-mode", set)
+		}
+		applySetting(&opts.noNewlineKeysToArrayTables, c.NoNewlineKeysToArrayTables, "no-newline-between-array-tables-and-keys", set)
+		applySetting(&opts.blankLinesArrayTables, c.BlankLinesArrayTables, "blank-lines-between-array-tables", set)
+	}
+	applySetting(&opts.sortMode, c.Sort, "sort", set)
+	if !set["emit-bom"] { // --emit-bom is a way of giving --bom on the command line
+		applySetting(&opts.bomMode, c.BOM, "bom", set)
+	}
+	applySetting(&opts.lineEnding, c.LineEnding, "line-ending", set)
+	if !set["keep-array-table-order"] { // Keeping the order on the command line overrides sorting in the file
+		applySetting(&opts.sortArrayTables, c.SortArrayTables, "sort-array-tables", set)
+		applySetting(&opts.sortArrayTablesBy, c.SortArrayTablesBy, "sort-array-tables-by", set)
+	}
+	applySetting(&opts.multilineStrings, c.MultilineStrings, "multiline-strings", set)
+	applySetting(&opts.inlineTablesMaxKeys, c.InlineTablesMaxKeys, "inline-tables-max-keys", set)
+	applySetting(&opts.groupKeysByValueType, c.GroupKeysByValueType, "group-keys-by-value-type", set)
+	applySetting(&opts.floatFormat, c.FloatFormat, "float-format", set)
+	applySetting(&opts.preserveKeyQuotes, c.PreserveKeyQuotes, "preserve-key-quotes", set)
+	applySetting(&opts.preserveBlankLines, c.PreserveBlankLines, "preserve-blank-lines", set)
+	applySetting(&opts.collapseTableChains, c.CollapseTableChains, "collapse-table-chains", set)
+	if !set["basic-strings"] { // --basic-strings is a way of giving --string-style on the command line
+		applySetting(&opts.stringStyle, c.StringStyle, "string-style", set)
+		if c.BasicStrings != nil && *c.BasicStrings && !set["string-style"] {
+			opts.stringStyle = "basic"
+		}
+	}
+	applySetting(&opts.noAlign, c.NoAlign, "no-align", set)
+	applySetting(&opts.maxLineWidth, c.MaxLineWidth, "max-line-width", set)
+	applySetting(&opts.trailingComma, c.TrailingComma, "trailing-comma", set)
+	return opts
+}
+
+// withConfig merges the configuration file that applies to a document into the
+// options. The file is looked up from the document's directory (the current
+// directory for stdin without --stdin-filename). With --config none the options
+// are returned unchanged.
+//
+// Parameters:
+//   - opts: Options from the command line
+//   - filename: The document's path ("" for stdin)
+//
+// Returns:
+//   - cliOptions: The options to format the document with
+//   - error: If the configuration file cannot be found or loaded
+func withConfig(opts cliOptions, filename string) (cliOptions, error) {
+	if opts.configMode == configNone {
+		return opts, nil
+	}
+	if filename == "" {
+		filename = opts.stdinFilename
+	}
+	dir := "."
+	if filename != "" {
+		dir = filepath.Dir(filename)
+	}
+	path, err := findConfigFile(dir)
+	if err != nil || path == "" {
+		return opts, err
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return opts, err
+	}
+	return cfg.applyTo(opts), nil
+}
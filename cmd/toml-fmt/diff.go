@@ -0,0 +1,386 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Diff output styles accepted by --diff-format.
+const (
+	diffFormatUnified  = "unified"   // diff -u style hunks
+	diffFormatContext  = "context"   // diff -c style hunks
+	diffFormatNameOnly = "name-only" // Only the name of a file that would change
+)
+
+// diffContextLines is the number of unchanged lines shown around each change.
+const diffContextLines = 3
+
+// editOp is the kind of a single step in a line edit script.
+type editOp int
+
+const (
+	editEqual  editOp = iota // Line present in both versions
+	editDelete               // Line only in the original
+	editInsert               // Line only in the new version
+)
+
+// lineEdit is one step of an edit script turning lines a into lines b.
+type lineEdit struct {
+	op   editOp
+	a, b int // Index of the line in a and in b (the position it would take for inserts and deletes)
+}
+
+// lineEdits computes a shortest edit script from a to b using their longest
+// common subsequence. Between two common lines the insertions come before the
+// deletions, so a rewritten line is reported next to itself.
+func lineEdits(a, b []string) []lineEdit {
+	edits := make([]lineEdit, 0, len(a)+len(b))
+	i, j := 0, 0
+	// gapTo emits the lines before a[ai] and b[bj] that are not common
+	gapTo := func(ai, bj int) {
+		for ; j < bj; j++ {
+			edits = append(edits, lineEdit{editInsert, i, j})
+		}
+		for ; i < ai; i++ {
+			edits = append(edits, lineEdit{editDelete, i, j})
+		}
+	}
+	for _, m := range commonLines(a, b, 0, 0, nil) {
+		gapTo(m[0], m[1])
+		edits = append(edits, lineEdit{editEqual, i, j})
+		i++
+		j++
+	}
+	gapTo(len(a), len(b))
+	return edits
+}
+
+// commonLines appends the index pairs of a longest common subsequence of a and b,
+// offset by aOff and bOff, to matches. It follows Hirschberg's algorithm, which
+// needs space linear in the length of b rather than a table of len(a)*len(b).
+func commonLines(a, b []string, aOff, bOff int, matches [][2]int) [][2]int {
+	// Lines shared at both ends are always part of a longest common subsequence
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matches = append(matches, [2]int{aOff + prefix, bOff + prefix})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	aOff, bOff = aOff+prefix, bOff+prefix
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0 || len(b) == 0:
+		// Nothing left in common
+	case len(a) == 1:
+		for k := range b {
+			if b[k] == a[0] {
+				matches = append(matches, [2]int{aOff, bOff + k})
+				break
+			}
+		}
+	default:
+		// Split a in half and b where the two halves share the most lines
+		mid := len(a) / 2
+		front := lcsLengths(a[:mid], b, false)
+		back := lcsLengths(a[mid:], b, true)
+		split := 0
+		for k := range front {
+			if front[k]+back[k] > front[split]+back[split] {
+				split = k
+			}
+		}
+		matches = commonLines(a[:mid], b[:split], aOff, bOff, matches)
+		matches = commonLines(a[mid:], b[split:], aOff+mid, bOff+split, matches)
+	}
+
+	for k := suffix; k > 0; k-- {
+		matches = append(matches, [2]int{aOff + len(a) + suffix - k, bOff + len(b) + suffix - k})
+	}
+	return matches
+}
+
+// lcsLengths returns, for each k, the length of the longest common subsequence
+// of a and b[:k], or of a and b[k:] when fromEnd is set, keeping only two rows.
+func lcsLengths(a, b []string, fromEnd bool) []int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for x := range a {
+		line := a[x]
+		if fromEnd {
+			line = a[len(a)-1-x]
+		}
+		for k := 1; k <= len(b); k++ {
+			other := b[k-1]
+			if fromEnd {
+				other = b[len(b)-k]
+			}
+			if line == other {
+				cur[k] = prev[k-1] + 1
+			} else {
+				cur[k] = max(prev[k], cur[k-1])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	if fromEnd {
+		// prev[k] covers the last k lines of b; index it by where they start instead
+		for l, r := 0, len(prev)-1; l < r; l, r = l+1, r-1 {
+			prev[l], prev[r] = prev[r], prev[l]
+		}
+	}
+	return prev
+}
+
+// splitLinesKeepEnds splits text into lines that keep their line endings, so a
+// missing final newline or a CRLF ending counts as a difference.
+func splitLinesKeepEnds(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1] // SplitAfter leaves an empty string after a final newline
+	}
+	return lines
+}
+
+// diffHunk is a run of edits, with surrounding context, shown as one hunk.
+type diffHunk struct {
+	edits []lineEdit
+}
+
+// groupHunks splits an edit script into hunks with diffContextLines lines of
+// context, merging changes whose context would overlap or touch.
+func groupHunks(edits []lineEdit) []diffHunk {
+	var hunks []diffHunk
+	start, end := -1, -1 // Current hunk as a range of edits
+	for k, e := range edits {
+		if e.op == editEqual {
+			continue
+		}
+		from := max(k-diffContextLines, 0)
+		if start >= 0 && from <= end {
+			end = min(k+diffContextLines+1, len(edits)) // Extend the current hunk
+			continue
+		}
+		if start >= 0 {
+			hunks = append(hunks, diffHunk{edits[start:end]})
+		}
+		start, end = from, min(k+diffContextLines+1, len(edits))
+	}
+	if start >= 0 {
+		hunks = append(hunks, diffHunk{edits[start:end]})
+	}
+	return hunks
+}
+
+// span returns the 0-based start and the number of lines a hunk covers in the
+// original (side a) or the new version (side b).
+func (h diffHunk) span(sideA bool) (int, int) {
+	start, count := -1, 0
+	for _, e := range h.edits {
+		if sideA && e.op == editInsert || !sideA && e.op == editDelete {
+			continue
+		}
+		pos := e.b
+		if sideA {
+			pos = e.a
+		}
+		if start < 0 {
+			start = pos
+		}
+		count++
+	}
+	if start < 0 { // Nothing on this side: report the position the lines would go
+		first := h.edits[0]
+		start = first.b
+		if sideA {
+			start = first.a
+		}
+	}
+	return start, count
+}
+
+// unifiedRange formats a hunk range like diff -u: "start,count", with ",count"
+// omitted for a single line and the start moved to the previous line when empty.
+func unifiedRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// contextRange formats a hunk range like diff -c: "first,last", or a single line number.
+func contextRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, start+count)
+}
+
+// writeDiffLine writes one line of a hunk with its prefix, marking a line that
+// does not end in a newline the way diff does.
+func writeDiffLine(w *bytes.Buffer, prefix, line string) {
+	w.WriteString(prefix)
+	w.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		w.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// writeDiff writes the difference between original and formatted content of a
+// document in the requested --diff-format style. Nothing is written when the
+// content is unchanged.
+//
+// Parameters:
+//   - output: Writer that receives the diff
+//   - format: One of the diffFormat* styles
+//   - name: Name of the document, used in headers (and alone for name-only)
+//   - original: The content before formatting
+//   - formatted: The content after formatting
+//
+// Returns:
+//   - error: Any error encountered writing the diff, or nil on success
+func writeDiff(output io.Writer, format, name string, original, formatted []byte) error {
+	if bytes.Equal(original, formatted) {
+		return nil
+	}
+	if format == diffFormatNameOnly {
+		_, err := fmt.Fprintln(output, name)
+		return err
+	}
+
+	a, b := splitLinesKeepEnds(original), splitLinesKeepEnds(formatted)
+	hunks := groupHunks(lineEdits(a, b))
+	var buf bytes.Buffer
+	switch format {
+	case diffFormatUnified:
+		fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", name, name)
+		for _, h := range hunks {
+			aStart, aCount := h.span(true)
+			bStart, bCount := h.span(false)
+			fmt.Fprintf(&buf, "@@ -%s +%s @@\n", unifiedRange(aStart, aCount), unifiedRange(bStart, bCount))
+			writeUnifiedHunk(&buf, h, a, b)
+		}
+	case diffFormatContext:
+		fmt.Fprintf(&buf, "*** a/%s\n--- b/%s\n", name, name)
+		for _, h := range hunks {
+			writeContextHunk(&buf, h, a, b)
+		}
+	default:
+		return fmt.Errorf("unknown diff format %q", format)
+	}
+	_, err := buf.WriteTo(output)
+	return err
+}
+
+// writeUnifiedHunk writes the lines of a unified diff hunk. Within each block of
+// changes, removed lines are listed before added lines.
+func writeUnifiedHunk(w *bytes.Buffer, h diffHunk, a, b []string) {
+	for k := 0; k < len(h.edits); {
+		if h.edits[k].op == editEqual {
+			writeDiffLine(w, " ", a[h.edits[k].a])
+			k++
+			continue
+		}
+		end := k
+		for end < len(h.edits) && h.edits[end].op != editEqual {
+			end++
+		}
+		for _, e := range h.edits[k:end] {
+			if e.op == editDelete {
+				writeDiffLine(w, "-", a[e.a])
+			}
+		}
+		for _, e := range h.edits[k:end] {
+			if e.op == editInsert {
+				writeDiffLine(w, "+", b[e.b])
+			}
+		}
+		k = end
+	}
+}
+
+// writeContextHunk writes a context diff hunk: the original lines, then the new
+// lines. Lines of a block that both removes and adds lines are marked "!", lines
+// of a block that only removes or only adds are marked "-" or "+". A side without
+// any changes is shown by its range alone.
+func writeContextHunk(w *bytes.Buffer, h diffHunk, a, b []string) {
+	// Classify each block of changes as a pure deletion, pure insertion, or change
+	marks := make([]string, len(h.edits))
+	for k := 0; k < len(h.edits); {
+		if h.edits[k].op == editEqual {
+			marks[k] = "  "
+			k++
+			continue
+		}
+		end := k
+		hasDelete, hasInsert := false, false
+		for end < len(h.edits) && h.edits[end].op != editEqual {
+			hasDelete = hasDelete || h.edits[end].op == editDelete
+			hasInsert = hasInsert || h.edits[end].op == editInsert
+			end++
+		}
+		for m := k; m < end; m++ {
+			switch {
+			case hasDelete && hasInsert:
+				marks[m] = "! "
+			case h.edits[m].op == editDelete:
+				marks[m] = "- "
+			default:
+				marks[m] = "+ "
+			}
+		}
+		k = end
+	}
+
+	w.WriteString("***************\n")
+	for _, sideA := range []bool{true, false} {
+		start, count := h.span(sideA)
+		if sideA {
+			fmt.Fprintf(w, "*** %s ****\n", contextRange(start, count))
+		} else {
+			fmt.Fprintf(w, "--- %s ----\n", contextRange(start, count))
+		}
+		skipped := sideA && editOnly(h, editInsert) || !sideA && editOnly(h, editDelete)
+		if skipped {
+			continue // This side has no changes of its own
+		}
+		for k, e := range h.edits {
+			switch {
+			case e.op == editEqual && sideA:
+				writeDiffLine(w, marks[k], a[e.a])
+			case e.op == editEqual:
+				writeDiffLine(w, marks[k], b[e.b])
+			case e.op == editDelete && sideA:
+				writeDiffLine(w, marks[k], a[e.a])
+			case e.op == editInsert && !sideA:
+				writeDiffLine(w, marks[k], b[e.b])
+			}
+		}
+	}
+}
+
+// editOnly reports whether every change in the hunk is of the given kind.
+func editOnly(h diffHunk, op editOp) bool {
+	for _, e := range h.edits {
+		if e.op != editEqual && e.op != op {
+			return false
+		}
+	}
+	return true
+}
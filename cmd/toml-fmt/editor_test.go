@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rogpeppe/go-internal/testscript"
+)
+
+// TestEditorScripts runs the scenarios in testdata/editor, which drive the binary
+// the way editor format-on-save integrations do: the buffer is piped on stdin,
+// its logical filename is passed as a flag, and the formatted buffer is read back
+// from stdout. The scripts can snapshot the work directory and assert that a run
+// left every file on disk untouched.
+func TestEditorScripts(t *testing.T) {
+	testscript.Run(t, testscript.Params{
+		Dir: "testdata/editor",
+		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+			"snapshot":  cmdSnapshot,
+			"unchanged": cmdUnchanged,
+		},
+	})
+}
+
+// snapshotEnv is the environment variable in which snapshot stores the listing.
+const snapshotEnv = "WORK_SNAPSHOT"
+
+// cmdSnapshot records the name and content hash of every file in the work directory.
+func cmdSnapshot(ts *testscript.TestScript, neg bool, args []string) {
+	if neg || len(args) != 0 {
+		ts.Fatalf("usage: snapshot")
+	}
+	ts.Setenv(snapshotEnv, workListing(ts))
+}
+
+// cmdUnchanged fails if any file was created, removed, or modified since the last snapshot.
+func cmdUnchanged(ts *testscript.TestScript, neg bool, args []string) {
+	if neg || len(args) != 0 {
+		ts.Fatalf("usage: unchanged")
+	}
+	before := ts.Getenv(snapshotEnv)
+	if before == "" {
+		ts.Fatalf("unchanged: no snapshot taken")
+	}
+	if after := workListing(ts); after != before {
+		ts.Fatalf("files changed on disk:\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+}
+
+// workListing lists the files of the work directory, one "path hash" line each, in path order.
+func workListing(ts *testscript.TestScript) string {
+	root := ts.MkAbs(".")
+	var lines []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path) // #nosec G304 -- paths come from walking the test's work directory
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		lines = append(lines, fmt.Sprintf("%s %x", filepath.ToSlash(rel), sha256.Sum256(content)))
+		return nil
+	})
+	ts.Check(err)
+	return strings.Join(lines, "\n") // WalkDir visits files in lexical order
+}
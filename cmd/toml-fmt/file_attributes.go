@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// copyFileAttributes gives the file at dst the permissions of the file at src,
+// and its owner and group where the platform and privileges allow. Ownership is
+// best effort: an unprivileged user cannot give a file away, and the written
+// file then stays owned by them.
+//
+// Parameters:
+//   - src: The original file (nothing is copied if it does not exist)
+//   - dst: The file that will replace it
+//
+// Returns:
+//   - error: If src cannot be stat'ed or the mode of dst cannot be set
+func copyFileAttributes(src, dst string) error {
+	info, err := os.Stat(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // Nothing to copy from; the new file keeps its defaults
+	}
+	if err != nil {
+		return fmt.Errorf("reading permissions of '%s': %w", src, err)
+	}
+	copyOwner(dst, info) // Before chmod, since changing the owner can clear setuid/setgid bits
+	err = os.Chmod(dst, info.Mode())
+	if err != nil {
+		return fmt.Errorf("setting permissions of temporary file '%s': %w", dst, err)
+	}
+	return nil
+}
+
+// newFileMode is the permissions of an output file that has nothing to take them from.
+const newFileMode fs.FileMode = 0o644
+
+// setNewFileMode gives a newly created file the mode of modeFrom, or newFileMode
+// when there is no such file. Unlike copyFileAttributes it never changes the owner.
+//
+// Parameters:
+//   - dst: The new file
+//   - modeFrom: File to take the mode from (may be empty)
+//
+// Returns:
+//   - error: If modeFrom cannot be stat'ed or the mode of dst cannot be set
+func setNewFileMode(dst, modeFrom string) error {
+	mode := newFileMode
+	if modeFrom != "" {
+		info, err := os.Stat(modeFrom)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("reading permissions of '%s': %w", modeFrom, err)
+		}
+		if err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	err := os.Chmod(dst, mode)
+	if err != nil {
+		return fmt.Errorf("setting permissions of temporary file '%s': %w", dst, err)
+	}
+	return nil
+}
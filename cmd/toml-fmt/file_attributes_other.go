@@ -0,0 +1,10 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// copyOwner does nothing on platforms without Unix file ownership.
+func copyOwner(string, os.FileInfo) {}
@@ -0,0 +1,20 @@
+// SPDX-License-Identifier: MIT
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner gives the file at dst the uid and gid recorded in info, ignoring
+// failures such as an unprivileged user trying to give the file away.
+func copyOwner(dst string, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	_ = os.Chown(dst, int(stat.Uid), int(stat.Gid)) // Best effort; the owner is kept where allowed
+}
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filesFromStdin is the --files-from value that reads the list from stdin.
+const filesFromStdin = "-"
+
+// loadFileList reads the paths listed in a --files-from source.
+//
+// Parameters:
+//   - source: Path of the list file, or "-" for stdin
+//
+// Returns:
+//   - []string: The listed paths, in order
+//   - error: If the list cannot be opened or read
+func loadFileList(source string) ([]string, error) {
+	if source == filesFromStdin {
+		return readFileList(os.Stdin, "stdin")
+	}
+	file, err := os.Open(filepath.Clean(source))
+	if err != nil {
+		return nil, fmt.Errorf("opening file list '%s': %w", source, err)
+	}
+	defer func() { _ = file.Close() }()
+	return readFileList(file, fmt.Sprintf("file list '%s'", source))
+}
+
+// readFileList reads newline-separated paths, such as the output of
+// git diff --name-only. Surrounding whitespace (including a CR from CRLF lines)
+// is trimmed, and blank lines and lines starting with # are skipped.
+//
+// Parameters:
+//   - r: Reader holding the list
+//   - sourceName: Description of the list for error messages
+//
+// Returns:
+//   - []string: The listed paths, in order
+//   - error: If the list cannot be read
+func readFileList(r io.Reader, sourceName string) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", sourceName, err)
+	}
+	return paths, nil
+}
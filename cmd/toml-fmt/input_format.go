@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Supported input formats for --from.
+const (
+	inputFormatAuto = "auto" // Infer the format from a filename extension
+	inputFormatTOML = "toml" // Parse the input as TOML
+	inputFormatJSON = "json" // Parse the input as a JSON object
+)
+
+// Supported output formats for --to.
+const (
+	outputFormatTOML = "toml" // Write formatted TOML
+	outputFormatJSON = "json" // Print the document's data as JSON, like --to-json
+)
+
+// resolveInputFormat decides how the input should be parsed. An explicit --from value
+// always wins. Otherwise the extension of --assume-filename is used, then the extension
+// of the input filename, and finally TOML. The output format never follows an
+// extension: it is TOML unless --to json (or --to-json) asks for JSON.
+//
+// Parameters:
+//   - from: Value of the --from flag ("auto", "toml", or "json")
+//   - assumeFilename: Value of --assume-filename (empty if not given)
+//   - filename: Input filename (empty for stdin)
+//
+// Returns:
+//   - string: The resolved input format ("toml" or "json")
+func resolveInputFormat(from, assumeFilename, filename string) string {
+	if from != "" && from != inputFormatAuto {
+		return from // Explicit format takes precedence over any extension
+	}
+	for _, name := range []string{assumeFilename, filename} {
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(filepath.Ext(name), ".json") {
+			return inputFormatJSON
+		}
+		return inputFormatTOML // The first name given decides, even if its extension is not .json
+	}
+	return inputFormatTOML
+}
+
+// parseInput decodes the input in the given format into a generic map.
+//
+// Parameters:
+//   - inputBytes: Raw input content (without a BOM)
+//   - format: Input format as returned by resolveInputFormat
+//   - sourceName: Description of the source for error messages
+//
+// Returns:
+//   - map[string]any: The decoded document (nil for empty input)
+//   - error: Any parse error with context, or nil on success
+func parseInput(inputBytes []byte, format, sourceName string) (map[string]any, error) {
+	if format == inputFormatJSON {
+		return parseJSON(inputBytes, sourceName)
+	}
+	return parseTOML(inputBytes, sourceName)
+}
+
+// parseJSON decodes a JSON object into a generic map suitable for the TOML formatter.
+// Numbers are decoded as int64 when they are integral and float64 otherwise, so that
+// integers are not rendered as floats.
+//
+// Parameters:
+//   - inputBytes: Raw JSON content
+//   - sourceName: Description of the source for error messages
+//
+// Returns:
+//   - map[string]any: The decoded document (nil for empty input)
+//   - error: Any parse error with context, or nil on success
+func parseJSON(inputBytes []byte, sourceName string) (map[string]any, error) {
+	if len(bytes.TrimSpace(inputBytes)) == 0 {
+		return nil, nil // Treat empty input like an empty TOML document
+	}
+	decoder := json.NewDecoder(bytes.NewReader(inputBytes))
+	decoder.UseNumber() // Keep numbers as text so integers and floats can be told apart
+	var data map[string]any
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("parsing JSON from %s: %w", sourceName, err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing JSON from %s: unexpected data after top-level object", sourceName)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("parsing JSON from %s: top-level value must be an object", sourceName)
+	}
+	converted, err := convertJSONNumbers(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JSON from %s: %w", sourceName, err)
+	}
+	return converted.(map[string]any), nil
+}
+
+// convertJSONNumbers replaces json.Number values with int64 or float64, recursing into
+// objects and arrays.
+func convertJSONNumbers(v any) (any, error) {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := val.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s: %w", val, err)
+		}
+		return f, nil
+	case map[string]any:
+		for k, item := range val {
+			converted, err := convertJSONNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = converted
+		}
+		return val, nil
+	case []any:
+		for i, item := range val {
+			converted, err := convertJSONNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = converted
+		}
+		return val, nil
+	default:
+		return v, nil
+	}
+}
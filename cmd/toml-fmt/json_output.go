@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	toml "github.com/pelletier/go-toml/v2"
+
+	"github.com/esacteksab/go-pretty-toml/internal/schema"
+)
+
+// formatJSONOutput parses a document and writes its data as pretty-printed JSON,
+// for --to-json. Comments and formatting are not part of the data, so they are lost.
+//
+// Parameters:
+//   - inputBytes: Raw input (without a BOM)
+//   - inputFormat: Format of the input: toml or json
+//   - inputSourceName: Description of the source for error messages
+//   - docSchema: Schema to validate the document against (nil to skip validation)
+//
+// Returns:
+//   - *bytes.Buffer: The document as JSON, ending in a newline
+//   - []schema.Diagnostic: Schema mismatches, reported by the caller after output is written
+//   - error: If the input cannot be parsed or holds a value JSON cannot represent
+func formatJSONOutput(
+	inputBytes []byte,
+	inputFormat string,
+	inputSourceName string,
+	docSchema schema.Schema,
+) (*bytes.Buffer, []schema.Diagnostic, error) {
+	data, err := parseInput(inputBytes, inputFormat, inputSourceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var diagnostics []schema.Diagnostic
+	if docSchema != nil {
+		diagnostics = docSchema.Validate(data)
+	}
+
+	if data == nil {
+		data = map[string]any{} // An empty document is an empty object
+	}
+	converted, err := jsonValue(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("converting %s to JSON: %w", inputSourceName, err)
+	}
+	out, err := json.MarshalIndent(converted, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("converting %s to JSON: %w", inputSourceName, err)
+	}
+	out = append(out, '\n')
+	return bytes.NewBuffer(out), diagnostics, nil
+}
+
+// jsonValue converts a decoded TOML value into one encoding/json writes as
+// intended: offset datetimes become RFC 3339 strings, local dates and times
+// keep their TOML text, and tables and arrays are converted recursively.
+//
+// Parameters:
+//   - v: A value from the decoded document
+//
+// Returns:
+//   - any: The value to marshal
+//   - error: If the value is an infinite or NaN float, which JSON cannot represent
+func jsonValue(v any) (any, error) {
+	switch val := v.(type) {
+	case map[string]any:
+		converted := make(map[string]any, len(val))
+		for k, item := range val {
+			c, err := jsonValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			converted[k] = c
+		}
+		return converted, nil
+	case []any:
+		converted := make([]any, len(val))
+		for i, item := range val {
+			c, err := jsonValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			converted[i] = c
+		}
+		return converted, nil
+	case time.Time:
+		return val.Format(time.RFC3339Nano), nil
+	case toml.LocalDate, toml.LocalTime, toml.LocalDateTime:
+		return fmt.Sprint(val), nil
+	case float64:
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			return nil, fmt.Errorf("JSON cannot represent the float %v", val)
+		}
+		return val, nil
+	default:
+		return v, nil
+	}
+}
@@ -8,16 +8,178 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	toml "github.com/pelletier/go-toml/v2"
 
 	"github.com/esacteksab/go-pretty-toml/internal/formatter"
+	"github.com/esacteksab/go-pretty-toml/internal/schema"
 	"github.com/esacteksab/go-pretty-toml/internal/version"
 )
 
+// Values accepted by --config.
+const (
+	configAuto = "auto" // Use discovered configuration in addition to flags
+	configNone = "none" // Ignore all configuration; use only flags and built-in defaults
+)
+
+// Exit statuses, so that CI can tell a file that needs formatting from a real failure.
+const (
+	exitOK           = 0 // Everything was formatted (or already was)
+	exitNotFormatted = 1 // --check, --check-only-changed-lines, or a diff found input that formatting would change
+	exitError        = 2 // Bad usage, unreadable or unparsable input, schema mismatches, or failed writes
+)
+
+// errNotFormatted marks an error that only reports that formatting would change
+// the input, which exits with exitNotFormatted instead of exitError.
+var errNotFormatted = errors.New("not formatted")
+
+// exitCode maps the result of a run to the process exit status.
+//
+// Parameters:
+//   - err: The error returned by runFormattingLogic (nil on success)
+//
+// Returns:
+//   - int: exitOK, exitNotFormatted, or exitError
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errNotFormatted):
+		return exitNotFormatted
+	default:
+		return exitError
+	}
+}
+
+// cliOptions holds the parsed command-line flags that control a formatting run.
+type cliOptions struct {
+	indentEnable               bool            // Indent table contents using two spaces
+	indentStyle                string          // Indentation character: space or tab (empty when not given)
+	indentSize                 int             // Characters per indentation level (0 when not given)
+	indentMode                 string          // Which lines to indent: nested, tables-only, or entries-only (empty when not given)
+	writeToFile                bool            // Write results back to the source file instead of stdout
+	outputPath                 string          // File to write the result to instead of stdout (empty for stdout)
+	filenameArgs               []string        // Input filenames from command line (empty for stdin)
+	filesFrom                  string          // File listing more input paths, one per line ("-" for stdin, empty for none)
+	maxDepth                   int             // Levels of subdirectories searched under a directory argument (negative for no limit)
+	noRecursive                bool            // Only format the TOML files directly inside a directory argument
+	followSymlinks             bool            // Follow symlinks while searching directory arguments
+	schemaPath                 string          // Schema file to validate the document against (empty to skip validation)
+	bomMode                    string          // Byte order mark policy for output: preserve, always, or never
+	emitBOM                    bool            // Shorthand for the "always" BOM policy
+	zipPath                    string          // Zip archive whose TOML entries should be formatted (empty for normal mode)
+	from                       string          // Input format: auto, toml, or json
+	assumeFilename             string          // Filename used only to infer the input format from its extension
+	stdinFilename              string          // Logical filename of stdin, used in messages and to infer the input format
+	sortMode                   string          // Key order: asc (alphabetical), none (source order), or group-only (source order per group)
+	configMode                 string          // Where options come from besides flags: auto (discovered config) or none (flags and defaults only)
+	noNewlineKeysToArrayTables bool            // Omit the blank line between simple keys and a following [[array.table]]
+	blankLinesArrayTables      int             // Blank lines between consecutive [[array.table]] entries: 0 or 1
+	keepArrayTableOrder        bool            // Explicitly keep [[array.table]] entries in source order (the default)
+	sortArrayTables            bool            // Sort [[array.table]] entries
+	sortArrayTablesBy          string          // Key whose value orders [[array.table]] entries (implies sortArrayTables)
+	multilineStrings           string          // When to write strings as """...""" blocks: never or newlines
+	check                      bool            // Only report whether the input is formatted, without writing anything
+	checkOnlyChangedLines      bool            // Only check formatting, failing just for lines changed since HEAD
+	diffFormat                 string          // Print a diff in this style instead of the document (empty for none)
+	inlineTablesMaxKeys        int             // Write tables with at most this many keys inline (0 to only keep source inline tables)
+	groupKeysByValueType       bool            // Emit scalars, then arrays, then inline tables within each table
+	floatFormat                string          // Float notation: shortest, decimal, or exponent
+	preserveKeyQuotes          bool            // Keep keys quoted (or bare) as they were written in the source
+	preserveBlankLines         bool            // Keep the groups of keys that blank lines separate in the source
+	collapseTableChains        bool            // Write chains of single-key tables as dotted keys (a.b.c = 1)
+	stringStyle                string          // Quoting of single-line strings: auto, basic, literal, or preserve
+	noAlign                    bool            // Write "key = value" without padding keys to line up the "=" signs
+	fixNewlinesOnly            bool            // Only normalize line endings and the final newline, leaving all else byte-identical
+	toJSON                     bool            // Print the document's data as JSON instead of formatted TOML
+	to                         string          // Output format: toml, or json (same as toJSON)
+	validate                   bool            // Only parse each document, stopping at the first that is not valid
+	list                       bool            // Only print the names of files formatting would change, exiting 0
+	dryRun                     bool            // With -w, print the files that would be rewritten and a count instead of writing
+	canonical                  bool            // Flush-left output with standard blank lines, ignoring layout settings of a config file
+	fragment                   bool            // Treat the input as an embedded snippet: keep its shared indentation and missing final newline
+	only                       string          // Dotted path of the table to format, leaving the rest of the document as written (empty for all)
+	colorStdout                bool            // Color diffs written to stdout
+	colorStderr                bool            // Color errors written to stderr
+	lineEnding                 string          // Line endings of the output: auto (keep the input's dominant one), lf, or crlf
+	maxLineWidth               int             // Wrap arrays and expand inline tables whose line is longer than this many characters (0 for no limit)
+	trailingComma              bool            // End wrapped arrays with a comma after the last element (config file only)
+	setFlags                   map[string]bool // Long names of the flags given on the command line, which override a config file
+}
+
+// utf8BOM is the byte order mark some (mostly Windows) tools place at the start of UTF-8 files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// stripBOM removes a leading UTF-8 byte order mark from the input.
+//
+// Parameters:
+//   - input: Raw input bytes
+//
+// Returns:
+//   - []byte: The input without a leading BOM
+//   - bool: Whether a BOM was present
+func stripBOM(input []byte) ([]byte, bool) {
+	if bytes.HasPrefix(input, utf8BOM) {
+		return input[len(utf8BOM):], true
+	}
+	return input, false
+}
+
+// applyBOMPolicy prepends a UTF-8 byte order mark to the formatted output when the
+// policy asks for one. The BOM is added to the buffer itself so that both stdout and
+// the atomic temp-file write emit it ahead of the formatted bytes.
+//
+// Parameters:
+//   - bomMode: "preserve" (emit only if the input had one), "always", or "never"
+//   - inputHadBOM: Whether the input started with a BOM
+//   - outputBuf: Buffer containing the formatted TOML content
+//
+// Returns:
+//   - *bytes.Buffer: Buffer holding the final output, with a BOM if required
+func applyBOMPolicy(bomMode string, inputHadBOM bool, outputBuf *bytes.Buffer) *bytes.Buffer {
+	emit := bomMode == "always" || (bomMode == "preserve" && inputHadBOM)
+	if !emit {
+		return outputBuf
+	}
+	withBOM := bytes.NewBuffer(make([]byte, 0, len(utf8BOM)+outputBuf.Len())) // Allocate room for BOM and content
+	withBOM.Write(utf8BOM)                                                    // BOM goes first
+	withBOM.Write(outputBuf.Bytes())                                          // Followed by the formatted bytes
+	return withBOM
+}
+
+// checkFormatted reports whether formatting would leave a document unchanged.
+// Like gofmt -l, the name of a document that is not formatted is printed to stdout.
+//
+// Parameters:
+//   - name: Name of the document (file path, --stdin-filename, or "<stdin>")
+//   - original: The document exactly as read, including any BOM
+//   - formatted: The bytes formatting would write
+//
+// Returns:
+//   - error: If the document is not formatted, or nil if it is
+func checkFormatted(name string, original, formatted []byte) error {
+	if bytes.Equal(original, formatted) {
+		return nil
+	}
+	fmt.Fprintln(os.Stdout, name) // List the file so CI logs show what to fix
+	return fmt.Errorf("'%s' is %w", name, errNotFormatted)
+}
+
+// printDryRunSummary ends the --dry-run output with the number of files -w would rewrite.
+func printDryRunSummary(count int) {
+	noun := "files"
+	if count == 1 {
+		noun = "file"
+	}
+	fmt.Fprintf(os.Stdout, "would write %d %s\n", count, noun)
+}
+
 // writeOutput writes the formatted TOML content either to stdout or back to the original file.
-// When writing to a file, it uses a safe approach with a temporary file and atomic rename.
+// When writing to a file, it uses a safe approach with a temporary file and atomic rename,
+// and a file that already holds the content is not written at all, so its modification
+// time does not change and file watchers are not triggered.
 //
 // Parameters:
 //   - writeToFile: Whether to write to the source file (true) or stdout (false)
@@ -33,50 +195,111 @@ func writeOutput(writeToFile bool, inputFilename string, outputBuf *bytes.Buffer
 		if err != nil {
 			return fmt.Errorf("writing to stdout: %w", err) // Wrap the error with context
 		}
-	} else {
-		// Sanity check: filename should be non-empty when writing to file
-		if inputFilename == "" {
-			return errors.New("internal error: writeToFile is true but inputFilename is empty") // Return an error if the filename is empty when writing to file
-		}
+		return nil
+	}
+	// Sanity check: filename should be non-empty when writing to file
+	if inputFilename == "" {
+		return errors.New("internal error: writeToFile is true but inputFilename is empty") // Return an error if the filename is empty when writing to file
+	}
+	return writeFileAtomic(inputFilename, "", outputBuf)
+}
 
-		// Create a temporary file in the same directory as the input file
-		tempFile, err := os.CreateTemp(filepath.Dir(inputFilename), filepath.Base(inputFilename)+".tmp") // Create a temporary file in the same directory with a ".tmp" extension
-		if err != nil {
-			return fmt.Errorf("creating temporary file: %w", err) // Wrap the error with context
-		}
-		tempFilename := tempFile.Name() // Get the name of the temporary file
+// writeFileAtomic replaces (or creates) targetFilename with the buffer's content
+// through a temporary file in the same directory and an atomic rename, so a
+// reader never sees a half-written file. A file that already holds the content
+// is not written at all. A symlink is resolved first, so the file it points to
+// is replaced and the link itself is kept.
+//
+// The new file keeps the owner and mode of the file it replaces. When the target
+// does not exist yet it takes the mode of modeFrom, or newFileMode if modeFrom
+// is empty or missing too.
+//
+// Parameters:
+//   - targetFilename: The file to write
+//   - modeFrom: File whose mode a newly created target gets (may be empty)
+//   - outputBuf: Buffer containing the content to write
+//
+// Returns:
+//   - error: Any error encountered during the write operation, or nil on success
+func writeFileAtomic(targetFilename, modeFrom string, outputBuf *bytes.Buffer) error {
+	// Write through a symlink to the file it points to, rather than replacing the link with a copy
+	if resolved, err := filepath.EvalSymlinks(targetFilename); err == nil {
+		targetFilename = resolved
+	}
 
-		// Track if rename succeeded to clean up temp file if needed
-		renameSucceeded := false // Initialize the renameSucceeded flag
-		defer func() {
-			if !renameSucceeded {
-				_ = os.Remove(tempFilename) // Remove the temporary file if the rename operation failed
-			}
-		}()
+	// Skip the write when nothing would change; an unreadable file is simply rewritten
+	current, err := os.ReadFile(filepath.Clean(targetFilename))
+	if err == nil && bytes.Equal(current, outputBuf.Bytes()) {
+		return nil
+	}
+	_, statErr := os.Stat(targetFilename)
+	targetExists := statErr == nil
 
-		// Write formatted content to temp file
-		_, err = outputBuf.WriteTo(tempFile) // Write the formatted TOML content to the temporary file
-		if err != nil {
-			if closeErr := tempFile.Close(); closeErr != nil { // Try to close the temp file
-				fmt.Fprintf(os.Stderr, "Warning: error closing temp file after write error: %v\n", closeErr) // Print a warning to stderr if closing fails
-			}
-			return fmt.Errorf("writing to temporary file '%s': %w", tempFilename, err) // Wrap the error with context
-		}
+	// Create a temporary file in the same directory as the target file
+	tempFile, err := os.CreateTemp(filepath.Dir(targetFilename), filepath.Base(targetFilename)+".tmp") // Create a temporary file in the same directory with a ".tmp" extension
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err) // Wrap the error with context
+	}
+	tempFilename := tempFile.Name() // Get the name of the temporary file
 
-		// Close temp file before rename
-		err = tempFile.Close() // Close the temporary file before renaming it
-		if err != nil {
-			return fmt.Errorf("closing temporary file '%s': %w", tempFilename, err) // Wrap the error with context
+	// Track if rename succeeded to clean up temp file if needed
+	renameSucceeded := false // Initialize the renameSucceeded flag
+	defer func() {
+		if !renameSucceeded {
+			_ = os.Remove(tempFilename) // Remove the temporary file if the rename operation failed
 		}
+	}()
 
-		// Atomically replace the original file with the temp file
-		err = os.Rename(tempFilename, inputFilename) // Atomically rename the temporary file to the original filename, replacing the original
-		if err != nil {
-			return fmt.Errorf("renaming temporary file '%s' to '%s': %w", tempFilename, inputFilename, err) // Wrap the error with context
+	// Write formatted content to temp file
+	_, err = outputBuf.WriteTo(tempFile) // Write the formatted TOML content to the temporary file
+	if err != nil {
+		if closeErr := tempFile.Close(); closeErr != nil { // Try to close the temp file
+			fmt.Fprintf(os.Stderr, "Warning: error closing temp file after write error: %v\n", closeErr) // Print a warning to stderr if closing fails
 		}
-		renameSucceeded = true // Set renameSucceeded to true if the rename was successful
+		return fmt.Errorf("writing to temporary file '%s': %w", tempFilename, err) // Wrap the error with context
+	}
+
+	// Close temp file before rename
+	err = tempFile.Close() // Close the temporary file before renaming it
+	if err != nil {
+		return fmt.Errorf("closing temporary file '%s': %w", tempFilename, err) // Wrap the error with context
+	}
+
+	if targetExists {
+		// Give the temp file the original's owner and mode, so formatting never loosens permissions
+		err = copyFileAttributes(targetFilename, tempFilename)
+	} else {
+		// A new file gets ordinary permissions rather than the private ones of a temp file
+		err = setNewFileMode(tempFilename, modeFrom)
 	}
-	return nil // Return nil if the write operation was successful
+	if err != nil {
+		return err
+	}
+
+	// Atomically replace the original file with the temp file
+	err = replaceFile(tempFilename, targetFilename) // Rename the temporary file over the original, retrying briefly if it is held open
+	if err != nil {
+		return err
+	}
+	renameSucceeded = true // Set renameSucceeded to true if the rename was successful
+	return nil             // Return nil if the write operation was successful
+}
+
+// isSameFile reports whether two paths name the same existing file, following
+// symlinks and hard links. An empty path (stdin) is never the same as a file.
+func isSameFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
 }
 
 // getInput determines the input source (stdin or file) based on arguments.
@@ -85,6 +308,7 @@ func writeOutput(writeToFile bool, inputFilename string, outputBuf *bytes.Buffer
 // Parameters:
 //   - filenameArg: The filename argument from command line (empty for stdin)
 //   - writeToFile: Whether output should be written back to the source file
+//   - stdinFilename: Name that stands for stdin in messages (empty for "stdin")
 //
 // Returns:
 //   - inputReader: Reader for the input source (file or stdin)
@@ -94,6 +318,7 @@ func writeOutput(writeToFile bool, inputFilename string, outputBuf *bytes.Buffer
 func getInput(
 	filenameArg string,
 	writeToFile bool,
+	stdinFilename string,
 ) (inputReader io.ReadCloser, filename, sourceName string, err error) {
 	if filenameArg == "" {
 		// Reading from stdin
@@ -103,7 +328,10 @@ func getInput(
 			) // Return an error if the -w flag is used with stdin
 			return inputReader, filename, sourceName, err
 		}
-		sourceName = "stdin"   // Set the source name to stdin
+		sourceName = "stdin" // Set the source name to stdin
+		if stdinFilename != "" {
+			sourceName = fmt.Sprintf("file '%s'", stdinFilename) // Messages name the file the caller is editing
+		}
 		inputReader = os.Stdin // os.Stdin is an *os.File, which is an io.ReadCloser. Assign standard input to the input reader.
 	} else {
 		// Reading from file
@@ -120,30 +348,691 @@ func getInput(
 	return inputReader, filename, sourceName, err // Return the determined reader, names, and nil error
 }
 
+// loadSchema reads and parses the schema file used to validate the document.
+//
+// Parameters:
+//   - schemaPath: Path to the schema TOML file
+//
+// Returns:
+//   - schema.Schema: The parsed schema
+//   - error: Any error encountered reading or parsing the schema, or nil on success
+func loadSchema(schemaPath string) (schema.Schema, error) {
+	schemaBytes, err := os.ReadFile(filepath.Clean(schemaPath)) // Read the whole schema file
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %w", err) // Wrap the error with context
+	}
+	s, err := schema.Load(schemaBytes) // Flatten the schema into key paths and types
+	if err != nil {
+		return nil, fmt.Errorf("loading schema '%s': %w", schemaPath, err) // Wrap the error with context
+	}
+	return s, nil
+}
+
+// parseTOML decodes TOML input into a generic map, adding the source name and,
+// when available, the line and column of a syntax error to the returned error.
+// Keys defined more than once are reported with the lines of both definitions.
+//
+// Parameters:
+//   - inputBytes: Raw TOML content (without a BOM)
+//   - sourceName: Description of the source for error messages
+//
+// Returns:
+//   - map[string]any: The decoded document (nil for empty input)
+//   - error: Any parse error with context, or nil on success
+func parseTOML(inputBytes []byte, sourceName string) (map[string]any, error) {
+	// The decoder rejects duplicate keys too, but without saying where they are
+	var dupErr *formatter.DuplicateKeyError
+	if err := formatter.CheckDuplicateKeys(inputBytes); errors.As(err, &dupErr) {
+		return nil, fmt.Errorf("parsing TOML from %s: %w", sourceName, dupErr)
+	}
+	var data map[string]any                  // Declare a variable to hold the parsed TOML data
+	err := toml.Unmarshal(inputBytes, &data) // Parse the TOML data from the input bytes
+	if err != nil {
+		// Provide detailed parsing error if possible
+		var parseErr *formatter.ParseError
+		if errors.As(formatter.NewParseError(err), &parseErr) { // Check if the error has a position
+			return nil, fmt.Errorf("parsing TOML from %s at %w",
+				sourceName, parseErr) // Wrap the error with detailed context
+		}
+		return nil, fmt.Errorf(
+			"parsing TOML from %s: %w",
+			sourceName,
+			err,
+		) // Wrap the error with context
+	}
+	return data, nil
+}
+
+// indentUnitFor builds the string used for each level of indentation. Giving
+// --indent-style, --indent-size, or --indent-mode turns indentation on just like
+// -i does; the defaults are two spaces per level, or one tab.
+//
+// Parameters:
+//   - enable: Whether -i was given
+//   - style: "space", "tab", or empty when not given
+//   - size: Characters per level, or 0 when not given
+//   - mode: Which lines to indent, or empty when not given
+//
+// Returns:
+//   - string: The indentation unit ("" when indentation is off)
+//   - error: If size is negative
+func indentUnitFor(enable bool, style string, size int, mode string) (string, error) {
+	if size < 0 {
+		return "", fmt.Errorf("--indent-size must not be negative, got %d", size)
+	}
+	if !enable && style == "" && size == 0 && mode == "" {
+		return "", nil // No indentation unless asked for
+	}
+	char := " "
+	if style == "tab" {
+		char = "\t"
+	}
+	if size == 0 {
+		size = 2 // Two spaces per level
+		if style == "tab" {
+			size = 1 // One tab per level
+		}
+	}
+	return strings.Repeat(char, size), nil
+}
+
+// layoutFlag names the first option that moves output away from the canonical
+// layout: flush-left lines and the standard blank lines between sections.
+//
+// Parameters:
+//   - opts: Options to check
+//
+// Returns:
+//   - string: The flag of that option, or "" when the layout is canonical
+func layoutFlag(opts cliOptions) string {
+	switch {
+	case opts.indentEnable:
+		return "-i"
+	case opts.indentStyle != "":
+		return "--indent-style"
+	case opts.indentSize != 0:
+		return "--indent-size"
+	case opts.indentMode != "":
+		return "--indent-mode"
+	case opts.noNewlineKeysToArrayTables:
+		return "--no-newline-between-array-tables-and-keys"
+	case opts.blankLinesArrayTables != 1:
+		return "--blank-lines-between-array-tables"
+	}
+	return ""
+}
+
+// configNoneGiven reports whether the command line gives --config none. It is
+// checked before parsing, since the environment variables are registered then.
+func configNoneGiven(app *kingpin.Application, args []string) bool {
+	parseCtx, err := app.ParseContext(args)
+	if err != nil {
+		return false // Parsing fails again, and is reported, in app.Parse
+	}
+	mode := ""
+	for _, element := range parseCtx.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok && flag.Model().Name == "config" && element.Value != nil {
+			mode = *element.Value // The last --config wins, as in parsing
+		}
+	}
+	return mode == configNone
+}
+
 // runFormattingLogic contains the core program logic after flag parsing.
-// It handles input acquisition, TOML parsing, formatting, and output.
+// It validates the flags and formats stdin or each file argument in turn; with
+// several files, an error in one is reported and the others are still formatted,
+// except that --validate stops at the first invalid file.
 //
 // Parameters:
-//   - indentEnable: Whether to enable indentation in the formatted output
-//   - writeToFile: Whether to write results back to source file (vs stdout)
-//   - filenameArg: Input filename from command line (empty for stdin)
+//   - opts: Parsed command-line options (indentation, write mode, input, schema, BOM policy)
 //
 // Returns:
 //   - error: Any error encountered during processing, or nil on success
-func runFormattingLogic(indentEnable, writeToFile bool, filenameArg string) error {
-	// Set indentation based on flag
-	indentUnit := "" // Initialize the indent unit to an empty string
-	if indentEnable {
-		indentUnit = "  " // Set the indent unit to two spaces if indentation is enabled
+func runFormattingLogic(opts cliOptions) error {
+	writeToFile := opts.writeToFile // Whether to write results back to source file (vs stdout)
+
+	// Options come from flags, a discovered .tomlfmt.toml file, and built-in
+	// defaults; --config none skips the file for reproducible runs.
+	if opts.configMode != configAuto && opts.configMode != configNone {
+		return fmt.Errorf("--config must be %q or %q, got %q", configAuto, configNone, opts.configMode)
+	}
+
+	// --emit-bom is shorthand for the "always" BOM policy, which a --bom given as well must not contradict
+	if opts.emitBOM {
+		if opts.setFlags["bom"] && opts.bomMode != "always" {
+			return fmt.Errorf("cannot use --emit-bom together with --bom=%s", opts.bomMode)
+		}
+		opts.bomMode = "always"
+	}
+
+	// --to-json is shorthand for --to json; toJSONFlag names the one given, for the errors below
+	toJSONFlag := "--to-json"
+	if opts.to == outputFormatJSON {
+		toJSONFlag = "--to json"
+		opts.toJSON = true
+	} else if opts.toJSON && opts.setFlags["to"] {
+		return fmt.Errorf("cannot use --to-json together with --to %s", opts.to)
+	}
+
+	// Check the flags on their own so a bad combination fails before any config file is read
+	_, _, err := documentSettings(opts)
+	if err != nil {
+		return err
+	}
+	if opts.canonical {
+		if flag := layoutFlag(opts); flag != "" {
+			return fmt.Errorf("cannot use --canonical together with %s", flag)
+		}
+	}
+
+	// Fixing newlines never parses the document, so there is nothing to validate
+	if opts.fixNewlinesOnly && opts.schemaPath != "" {
+		return errors.New("cannot use --schema together with --fix-newlines-only")
+	}
+
+	// Load the schema up front so a bad schema fails before any output is written
+	var docSchema schema.Schema
+	if opts.schemaPath != "" {
+		docSchema, err = loadSchema(opts.schemaPath)
+		if err != nil {
+			return err
+		}
 	}
 
+	// Zip mode formats the TOML entries of an archive instead of a single document
+	if opts.zipPath != "" {
+		if len(opts.filenameArgs) > 0 {
+			return errors.New("cannot use --zip together with a filename argument")
+		}
+		if opts.check {
+			return errors.New("cannot use --zip together with --check")
+		}
+		if opts.checkOnlyChangedLines {
+			return errors.New("cannot use --zip together with --check-only-changed-lines")
+		}
+		if opts.diffFormat != "" {
+			return errors.New("cannot use --zip together with --diff-format")
+		}
+		if opts.fixNewlinesOnly {
+			return errors.New("cannot use --zip together with --fix-newlines-only")
+		}
+		if opts.toJSON {
+			return fmt.Errorf("cannot use --zip together with %s", toJSONFlag)
+		}
+		if opts.lineEnding != lineEndingAuto {
+			return errors.New("cannot use --zip together with --line-ending")
+		}
+		if opts.list {
+			return errors.New("cannot use --zip together with --list")
+		}
+		if opts.filesFrom != "" {
+			return errors.New("cannot use --zip together with --files-from")
+		}
+		if opts.dryRun {
+			return errors.New("cannot use --zip together with --dry-run")
+		}
+		if opts.validate {
+			return errors.New("cannot use --zip together with --validate")
+		}
+		if opts.outputPath != "" {
+			return errors.New("cannot use --zip together with --output")
+		}
+		if opts.only != "" {
+			return errors.New("cannot use --zip together with --only")
+		}
+		if opts.fragment {
+			return errors.New("cannot use --zip together with --fragment")
+		}
+		if opts.from == inputFormatJSON {
+			return errors.New("cannot use --zip together with --from=json") // Only *.toml entries are formatted
+		}
+		if opts.assumeFilename != "" {
+			return errors.New("cannot use --zip together with --assume-filename")
+		}
+		if opts.stdinFilename != "" {
+			return errors.New("cannot use --zip together with --stdin-filename")
+		}
+		zipOpts, err := withConfig(opts, opts.zipPath) // The archive's directory decides the config file
+		if err != nil {
+			return err
+		}
+		return formatZipArchive(zipOpts, docSchema)
+	}
+
+	// A dry run previews -w, so it only makes sense together with it
+	if opts.dryRun && !writeToFile {
+		return errors.New("--dry-run requires -w")
+	}
+
+	// The output file takes the place of stdout, so it excludes the modes that print something else
+	if opts.outputPath != "" {
+		if writeToFile {
+			return errors.New("cannot use -w flag with --output")
+		}
+		if opts.check || opts.checkOnlyChangedLines {
+			return errors.New("cannot use --output together with --check")
+		}
+		if opts.diffFormat != "" {
+			return errors.New("cannot use --output together with --diff-format")
+		}
+		if opts.list {
+			return errors.New("cannot use --output together with --list")
+		}
+		if opts.validate {
+			return errors.New("cannot use --output together with --validate")
+		}
+	}
+
+	// The check reports instead of writing, so it excludes the other output modes
+	if opts.check {
+		if writeToFile {
+			return errors.New("cannot use -w flag with --check")
+		}
+		if opts.checkOnlyChangedLines {
+			return errors.New("cannot use --check together with --check-only-changed-lines")
+		}
+		if opts.diffFormat != "" {
+			return errors.New("cannot use --check together with --diff-format")
+		}
+	}
+
+	// The line-scoped check needs a file git knows about and never writes output
+	if opts.checkOnlyChangedLines {
+		if len(opts.filenameArgs) == 0 && opts.filesFrom == "" {
+			return errors.New("--check-only-changed-lines requires a filename argument")
+		}
+		if writeToFile {
+			return errors.New("cannot use -w flag with --check-only-changed-lines")
+		}
+	}
+
+	// A diff replaces the formatted document on stdout
+	if opts.diffFormat != "" {
+		if writeToFile {
+			return errors.New("cannot use -w flag with --diff-format")
+		}
+		if opts.checkOnlyChangedLines {
+			return errors.New("cannot use --diff-format together with --check-only-changed-lines")
+		}
+	}
+
+	// The list names files instead of writing or checking them
+	if opts.list {
+		if writeToFile {
+			return errors.New("cannot use -w flag with --list")
+		}
+		if opts.check || opts.checkOnlyChangedLines {
+			return errors.New("cannot use --list together with --check")
+		}
+		if opts.diffFormat != "" {
+			return errors.New("cannot use --list together with --diff-format")
+		}
+		if opts.toJSON {
+			return fmt.Errorf("cannot use --list together with %s", toJSONFlag)
+		}
+	}
+
+	// JSON output goes to stdout and is never compared with the TOML input
+	if opts.toJSON {
+		if writeToFile {
+			return fmt.Errorf("cannot use -w flag with %s", toJSONFlag)
+		}
+		if opts.check || opts.checkOnlyChangedLines {
+			return fmt.Errorf("cannot use %s together with --check", toJSONFlag)
+		}
+		if opts.diffFormat != "" {
+			return fmt.Errorf("cannot use %s together with --diff-format", toJSONFlag)
+		}
+		if opts.fixNewlinesOnly {
+			return fmt.Errorf("cannot use %s together with --fix-newlines-only", toJSONFlag)
+		}
+		if opts.fragment {
+			return fmt.Errorf("cannot use %s together with --fragment", toJSONFlag)
+		}
+	}
+
+	// Validation only parses, so it excludes every mode that writes or compares output
+	if opts.validate {
+		if writeToFile {
+			return errors.New("cannot use -w flag with --validate")
+		}
+		if opts.check || opts.checkOnlyChangedLines {
+			return errors.New("cannot use --validate together with --check")
+		}
+		if opts.diffFormat != "" {
+			return errors.New("cannot use --validate together with --diff-format")
+		}
+		if opts.list {
+			return errors.New("cannot use --validate together with --list")
+		}
+		if opts.toJSON {
+			return fmt.Errorf("cannot use --validate together with %s", toJSONFlag)
+		}
+		if opts.fixNewlinesOnly {
+			return errors.New("cannot use --validate together with --fix-newlines-only")
+		}
+	}
+
+	// Formatting part of a document keeps the rest of its TOML text, so the modes that replace it are excluded
+	if opts.only != "" {
+		if _, err := formatter.ParseKeyPath(opts.only); err != nil {
+			return fmt.Errorf("--only: %w", err)
+		}
+		if opts.toJSON {
+			return fmt.Errorf("cannot use --only together with %s", toJSONFlag)
+		}
+		if opts.fixNewlinesOnly {
+			return errors.New("cannot use --only together with --fix-newlines-only")
+		}
+		if opts.fragment {
+			return errors.New("cannot use --only together with --fragment")
+		}
+	}
+
+	// Paths from --files-from are handled like filename arguments; an empty list formats nothing
+	fileArgs := opts.filenameArgs
+	if opts.filesFrom != "" {
+		if opts.filesFrom == filesFromStdin && opts.stdinFilename != "" {
+			return errors.New("cannot use --stdin-filename together with --files-from=-")
+		}
+		listed, err := loadFileList(opts.filesFrom)
+		if err != nil {
+			return err
+		}
+		if len(fileArgs) == 0 && len(listed) == 0 {
+			return nil
+		}
+		fileArgs = append(append([]string{}, fileArgs...), listed...)
+	}
+
+	// A directory argument stands for the TOML files found under it
+	maxDepth := opts.maxDepth
+	if opts.noRecursive {
+		maxDepth = 0
+	}
+	filenames, err := expandFileArgs(fileArgs, opts.followSymlinks, maxDepth)
+	if err != nil {
+		return err
+	}
+	if len(fileArgs) > 0 && len(filenames) == 0 {
+		return nil // Only directories without TOML files were given
+	}
+
+	// Without filename arguments a single document is read from stdin
+	if opts.stdinFilename != "" && len(fileArgs) > 0 {
+		return errors.New("cannot use --stdin-filename together with a filename argument")
+	}
+	if len(filenames) == 0 {
+		filenames = []string{""}
+	}
+	if opts.outputPath != "" {
+		if len(filenames) > 1 {
+			return errors.New("cannot use --output with more than one input file")
+		}
+		if isSameFile(filenames[0], opts.outputPath) {
+			return fmt.Errorf("--output '%s' is the input file; use -w to rewrite it in place", opts.outputPath)
+		}
+	}
+	if len(filenames) == 1 {
+		rewritten, err := formatDocument(opts, filenames[0], docSchema)
+		if err == nil && opts.dryRun {
+			count := 0
+			if rewritten {
+				count = 1
+			}
+			printDryRunSummary(count)
+		}
+		return err
+	}
+
+	// Each file is handled on its own: a failure is reported and the remaining files still run
+	failed, notFormatted, rewritten := 0, 0, 0
+	for _, filename := range filenames {
+		changed, err := formatDocument(opts, filename, docSchema)
+		if changed {
+			rewritten++
+		}
+		if err != nil && opts.validate {
+			return err // Validation stops at the first invalid file
+		}
+		if err != nil {
+			printError(os.Stderr, err, opts.colorStderr) // Report this file's error like main does for a single file
+			failed++
+			if errors.Is(err, errNotFormatted) {
+				notFormatted++
+			}
+		}
+	}
+	if opts.dryRun {
+		printDryRunSummary(rewritten)
+	}
+	if failed > 0 && failed == notFormatted {
+		// Only formatting differences, so the run keeps the "not formatted" exit status
+		return fmt.Errorf("%d of %d files failed: %w", failed, len(filenames), errNotFormatted)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(filenames))
+	}
+	return nil
+}
+
+// formatterOptions builds the formatter options for a document from the flags
+// (merged with any config file). The caller adds the document's Source.
+//
+// Parameters:
+//   - opts: Options for the document
+//   - indentUnit: String used for each level of indentation
+//   - sortArrayTables: Whether [[array.table]] entries are sorted
+//
+// Returns:
+//   - formatter.Options: The options to format the document with
+func formatterOptions(opts cliOptions, indentUnit string, sortArrayTables bool) formatter.Options {
+	formatOpts := formatter.DefaultOptions()
+	formatOpts.IndentUnit = indentUnit
+	formatOpts.IndentMode = formatter.IndentMode(opts.indentMode)
+	formatOpts.SortKeys = formatter.SortMode(opts.sortMode)
+	if opts.noNewlineKeysToArrayTables {
+		formatOpts.Separators.KeysToArrayTable = 0
+	}
+	formatOpts.Separators.ArrayTableToArrayTable = opts.blankLinesArrayTables
+	formatOpts.SortArrayTables = sortArrayTables
+	formatOpts.MultilineStrings = formatter.MultilineMode(opts.multilineStrings)
+	formatOpts.ArrayTableSortField = opts.sortArrayTablesBy
+	formatOpts.InlineTableMaxKeys = opts.inlineTablesMaxKeys
+	formatOpts.GroupKeysByValueType = opts.groupKeysByValueType
+	formatOpts.FloatFormat = formatter.FloatFormat(opts.floatFormat)
+	formatOpts.PreserveKeyQuotes = opts.preserveKeyQuotes
+	formatOpts.PreserveBlankLines = opts.preserveBlankLines
+	formatOpts.AlignValues = !opts.noAlign
+	formatOpts.StringStyle = formatter.StringStyle(opts.stringStyle)
+	formatOpts.CollapseTableChains = opts.collapseTableChains
+	formatOpts.MaxLineWidth = opts.maxLineWidth
+	formatOpts.TrailingComma = opts.trailingComma
+	return formatOpts
+}
+
+// formatInput parses a document and formats it according to the options.
+//
+// Parameters:
+//   - opts: Parsed command-line options
+//   - inputBytes: Raw input (without a BOM)
+//   - inputFormat: Format of the input: toml or json
+//   - inputSourceName: Description of the source for error messages
+//   - indentUnit: String used for each level of indentation
+//   - sortArrayTables: Whether [[array.table]] entries are sorted
+//   - docSchema: Schema to validate the document against (nil to skip validation)
+//
+// Returns:
+//   - *bytes.Buffer: The formatted document
+//   - []schema.Diagnostic: Schema mismatches, reported by the caller after output is written
+//   - error: If the input cannot be parsed or formatted
+func formatInput(
+	opts cliOptions,
+	inputBytes []byte,
+	inputFormat string,
+	inputSourceName string,
+	indentUnit string,
+	sortArrayTables bool,
+	docSchema schema.Schema,
+) (*bytes.Buffer, []schema.Diagnostic, error) {
+	data, err := parseInput(inputBytes, inputFormat, inputSourceName) // Parse the data from the input bytes
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Validate against the schema; diagnostics are reported after output is written
+	var diagnostics []schema.Diagnostic
+	if docSchema != nil {
+		diagnostics = docSchema.Validate(data)
+	}
+
+	// Build formatter options from the flags
+	formatOpts := formatterOptions(opts, indentUnit, sortArrayTables)
+	if inputFormat == inputFormatTOML {
+		// Comments and key order are not kept by the decoded map, so record them from the raw input
+		formatOpts.Source, err = formatter.ParseSourceInfo(inputBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading comments and key order from %s: %w", inputSourceName, err)
+		}
+	}
+
+	// Handle empty input case gracefully; a document holding only comments still keeps them
+	if data == nil && formatOpts.Source == nil {
+		return &bytes.Buffer{}, diagnostics, nil // Empty output, written like any other result
+	}
+
+	// Format TOML Data
+	var outputBuf bytes.Buffer // Declare a buffer to hold the formatted TOML data
+	err = formatter.FormatWithOptions(
+		data,
+		formatOpts,
+		&outputBuf,
+	) // Format the TOML data using the formatter package
+	if err != nil {
+		return nil, nil, fmt.Errorf("formatting TOML data: %w", err) // Wrap the error with context
+	}
+	return &outputBuf, diagnostics, nil
+
+}
+
+// formatOnlyTable formats the table that --only names, and the tables under it,
+// passing the rest of the TOML document through unchanged. The whole document is
+// still parsed and validated against the schema.
+//
+// Parameters:
+//   - opts: Options for the document, including the table path
+//   - inputBytes: Raw TOML input (without a BOM)
+//   - inputSourceName: Description of the source for error messages
+//   - indentUnit: String used for each level of indentation
+//   - sortArrayTables: Whether [[array.table]] entries are sorted
+//   - docSchema: Schema to validate the document against (nil to skip validation)
+//
+// Returns:
+//   - *bytes.Buffer: The document with the table formatted
+//   - []schema.Diagnostic: Schema mismatches found in the document
+//   - error: If the document is not valid TOML or the table cannot be formatted on its own
+func formatOnlyTable(
+	opts cliOptions,
+	inputBytes []byte,
+	inputSourceName string,
+	indentUnit string,
+	sortArrayTables bool,
+	docSchema schema.Schema,
+) (*bytes.Buffer, []schema.Diagnostic, error) {
+	data, err := parseInput(inputBytes, inputFormatTOML, inputSourceName) // The rest of the document must be valid too
+	if err != nil {
+		return nil, nil, err
+	}
+	var diagnostics []schema.Diagnostic
+	if docSchema != nil {
+		diagnostics = docSchema.Validate(data)
+	}
+
+	path, err := formatter.ParseKeyPath(opts.only)
+	if err != nil {
+		return nil, nil, fmt.Errorf("--only: %w", err)
+	}
+	output, err := formatter.FormatSections(inputBytes, path, func(section []byte) ([]byte, error) {
+		formatted, _, err := formatInput(opts, section, inputFormatTOML, inputSourceName, indentUnit, sortArrayTables, nil)
+		if err != nil {
+			return nil, err
+		}
+		return formatted.Bytes(), nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("formatting %s: %w", inputSourceName, err)
+	}
+	return bytes.NewBuffer(output), diagnostics, nil
+}
+
+// documentSettings derives the indentation unit and the array table order from
+// the options, rejecting combinations that contradict each other.
+//
+// Parameters:
+//   - opts: Options for the document (flags merged with any config file)
+//
+// Returns:
+//   - string: String used for each level of indentation
+//   - bool: Whether [[array.table]] entries are sorted
+//   - error: If the indentation or line width settings are invalid or the array table order flags conflict
+func documentSettings(opts cliOptions) (string, bool, error) {
+	indentUnit, err := indentUnitFor(opts.indentEnable, opts.indentStyle, opts.indentSize, opts.indentMode)
+	if err != nil {
+		return "", false, err
+	}
+	if opts.maxLineWidth < 0 {
+		return "", false, fmt.Errorf("--max-line-width must not be negative, got %d", opts.maxLineWidth)
+	}
+	if opts.blankLinesArrayTables != 0 && opts.blankLinesArrayTables != 1 {
+		return "", false, fmt.Errorf("--blank-lines-between-array-tables must be 0 or 1, got %d", opts.blankLinesArrayTables)
+	}
+
+	// The array table order flags are two sides of one choice
+	sortArrayTables := opts.sortArrayTables || opts.sortArrayTablesBy != ""
+	if opts.keepArrayTableOrder && sortArrayTables {
+		return "", false, errors.New("cannot use --keep-array-table-order together with --sort-array-tables")
+	}
+	return indentUnit, sortArrayTables, nil
+}
+
+// formatDocument formats a single document (a file, or stdin) according to the
+// options and writes, checks, or diffs the result. Options from the config file
+// that applies to the document are merged in first. With --fix-newlines-only the
+// document is not parsed and only its line endings are normalized.
+//
+// Parameters:
+//   - opts: Parsed command-line options
+//   - filenameArg: The file to format (empty for stdin)
+//   - docSchema: Schema to validate the document against (nil to skip validation)
+//
+// Returns:
+//   - bool: Whether the file was rewritten with -w, or would be with --dry-run
+//   - error: Any error encountered processing this document, or nil on success
+func formatDocument(
+	opts cliOptions,
+	filenameArg string,
+	docSchema schema.Schema,
+) (bool, error) {
+	// Each document may sit under a different config file
+	opts, err := withConfig(opts, filenameArg)
+	if err != nil {
+		return false, err
+	}
+	indentUnit, sortArrayTables, err := documentSettings(opts)
+	if err != nil {
+		return false, err
+	}
+
+	writeToFile := opts.writeToFile // Whether to write results back to source file (vs stdout)
+
 	// Get input source (stdin or file)
 	inputReader, inputFilename, inputSourceName, err := getInput(
 		filenameArg,
 		writeToFile,
+		opts.stdinFilename,
 	) // Get the input reader, filename, and source name based on the command-line arguments
 	if err != nil {
-		return err // Return error from getInput (e.g., -w with stdin, file open error)
+		return false, err // Return error from getInput (e.g., -w with stdin, file open error)
 	}
 
 	// Ensure the input reader is closed eventually (important for files)
@@ -155,7 +1044,7 @@ func runFormattingLogic(indentEnable, writeToFile bool, filenameArg string) erro
 	// Read All Input
 	inputBytes, err := io.ReadAll(inputReader) // Read all the input from the input reader
 	if err != nil {
-		return fmt.Errorf(
+		return false, fmt.Errorf(
 			"reading from %s: %w",
 			inputSourceName,
 			err,
@@ -171,60 +1060,176 @@ func runFormattingLogic(indentEnable, writeToFile bool, filenameArg string) erro
 		}
 	}
 
+	// Strip a leading BOM before parsing; the output policy decides whether to restore it
+	originalBytes := inputBytes // The exact input, which --check compares against
+	inputBytes, inputHadBOM := stripBOM(inputBytes)
+
 	// Parse TOML
-	var data map[string]any                 // Declare a variable to hold the parsed TOML data
-	err = toml.Unmarshal(inputBytes, &data) // Parse the TOML data from the input bytes
-	if err != nil {
-		// Provide detailed parsing error if possible
-		if docErr, ok := err.(*toml.DecodeError); ok { // Check if the error is a TOML decode error
-			line, col := docErr.Position() // Get the line and column number of the error
-			return fmt.Errorf("parsing TOML from %s at line %d, column %d: %w",
-				inputSourceName, line, col, docErr) // Wrap the error with detailed context
+	// The name reported by --check and diffs, and used to infer the input format
+	displayName := inputFilename
+	if displayName == "" {
+		displayName = opts.stdinFilename
+	}
+	inputFormat := resolveInputFormat(opts.from, opts.assumeFilename, displayName) // Decide between TOML and JSON input
+	if displayName == "" {
+		displayName = "<stdin>"
+	}
+	if writeToFile && inputFormat != inputFormatTOML {
+		// Writing TOML back over a JSON file would change its format
+		return false, fmt.Errorf("cannot use -w flag with %s input", inputFormat)
+	}
+	if opts.check && inputFormat != inputFormatTOML {
+		// Converted JSON never matches its source, so there is nothing to check
+		return false, fmt.Errorf("cannot use --check with %s input", inputFormat)
+	}
+	if opts.list && inputFormat != inputFormatTOML {
+		return false, fmt.Errorf("cannot use --list with %s input", inputFormat)
+	}
+	if opts.fragment && inputFormat != inputFormatTOML {
+		return false, fmt.Errorf("cannot use --fragment with %s input", inputFormat)
+	}
+	if opts.only != "" && inputFormat != inputFormatTOML {
+		return false, fmt.Errorf("cannot use --only with %s input", inputFormat)
+	}
+	if opts.validate {
+		// Only parse the document, and check it against the schema; nothing is formatted or written
+		data, err := parseInput(inputBytes, inputFormat, inputSourceName)
+		if err != nil {
+			return false, err
 		}
-		return fmt.Errorf(
-			"parsing TOML from %s: %w",
-			inputSourceName,
-			err,
-		) // Wrap the error with context
+		if docSchema != nil {
+			return false, reportDiagnostics(inputSourceName, docSchema.Validate(data))
+		}
+		return false, nil
 	}
-
-	// Handle empty input case gracefully
-	if data == nil {
-		emptyBuf := &bytes.Buffer{} // create an empty buffer
-		// Pass inputFilename obtained from getInput
-		err = writeOutput(
-			writeToFile,
-			inputFilename,
-			emptyBuf,
-		) // write the empty buffer to the output
+	var outputBuf *bytes.Buffer
+	var diagnostics []schema.Diagnostic
+	if opts.fixNewlinesOnly {
+		// Only line endings change, so the document is never parsed
+		if inputFormat != inputFormatTOML {
+			return false, fmt.Errorf("cannot use --fix-newlines-only with %s input", inputFormat)
+		}
+		outputBuf = bytes.NewBuffer(fixNewlines(inputBytes))
+	} else if opts.toJSON {
+		// The data is printed as JSON; comments and layout do not survive
+		outputBuf, diagnostics, err = formatJSONOutput(inputBytes, inputFormat, inputSourceName, docSchema)
+		if err != nil {
+			return false, err
+		}
+		inputHadBOM = false // A BOM belongs to the TOML input, not to the JSON
+	} else if opts.only != "" {
+		// Only the named table is formatted; everything else is kept as written
+		outputBuf, diagnostics, err = formatOnlyTable(opts, inputBytes, inputSourceName, indentUnit, sortArrayTables, docSchema)
 		if err != nil {
-			return fmt.Errorf("writing empty output: %w", err) // Wrap the error with context
+			return false, err
+		}
+	} else {
+		outputBuf, diagnostics, err = formatInput(opts, inputBytes, inputFormat, inputSourceName, indentUnit, sortArrayTables, docSchema)
+		if err != nil {
+			return false, err
 		}
-		return nil // Successful empty processing
 	}
 
-	// Format TOML Data
-	var outputBuf bytes.Buffer // Declare a buffer to hold the formatted TOML data
-	err = formatter.Format(
-		data,
-		indentUnit,
-		&outputBuf,
-	) // Format the TOML data using the formatter package
-	if err != nil {
-		return fmt.Errorf("formatting TOML data: %w", err) // Wrap the error with context
+	// Keep or change the line endings; fixing newlines means LF unless CRLF is asked for
+	lineEnding := opts.lineEnding
+	if opts.fixNewlinesOnly && lineEnding == lineEndingAuto {
+		lineEnding = lineEndingLF
+	}
+	if !opts.toJSON {
+		outputBuf = applyLineEnding(lineEnding, inputBytes, outputBuf)
+	}
+	if opts.fragment {
+		// A snippet keeps fitting the text around it
+		reindented, err := formatter.ReindentFragment(inputBytes, outputBuf.Bytes())
+		if err != nil {
+			return false, fmt.Errorf("formatting fragment %s: %w", inputSourceName, err)
+		}
+		outputBuf = bytes.NewBuffer(reindented)
 	}
 
-	// Write Output
-	err = writeOutput(
-		writeToFile,
-		inputFilename,
-		&outputBuf,
-	) // Write the formatted TOML data to the output
-	if err != nil {
-		return fmt.Errorf("writing output: %w", err) // Wrap the error with context
+	rewritten := false // Whether -w replaced (or with --dry-run would replace) the file
+	if opts.check {
+		// Check mode compares the bytes that would be written with the input, leaving it untouched
+		err = checkFormatted(displayName, originalBytes, applyBOMPolicy(opts.bomMode, inputHadBOM, outputBuf).Bytes())
+		if err != nil {
+			return false, err
+		}
+	} else if opts.list {
+		// Like --check, but a file that needs formatting is only named, not a failure
+		if !bytes.Equal(originalBytes, applyBOMPolicy(opts.bomMode, inputHadBOM, outputBuf).Bytes()) {
+			fmt.Fprintln(os.Stdout, displayName)
+		}
+	} else if opts.checkOnlyChangedLines {
+		// Check mode compares instead of writing; only lines changed since HEAD count
+		err = checkChangedLines(inputFilename, inputBytes, outputBuf.Bytes())
+		if err != nil {
+			return false, err
+		}
+	} else if opts.diffFormat != "" {
+		// Show what formatting would change instead of the formatted document. Like
+		// --check, compare the exact input with the bytes -w would write, BOM included
+		finalBytes := applyBOMPolicy(opts.bomMode, inputHadBOM, outputBuf).Bytes()
+		var diffBuf bytes.Buffer
+		err = writeDiff(&diffBuf, opts.diffFormat, displayName, originalBytes, finalBytes)
+		if err == nil {
+			diffText := diffBuf.String()
+			if opts.colorStdout {
+				diffText = colorizeDiff(opts.diffFormat, diffText)
+			}
+			_, err = io.WriteString(os.Stdout, diffText)
+		}
+		if err != nil {
+			return false, fmt.Errorf("writing diff: %w", err)
+		}
+		if !bytes.Equal(originalBytes, finalBytes) {
+			// Like --check, a pending change fails the run so scripts can act on it
+			return false, fmt.Errorf("'%s' is %w", displayName, errNotFormatted)
+		}
+	} else if opts.dryRun {
+		// Name the file -w would rewrite, leaving it untouched
+		rewritten = !bytes.Equal(originalBytes, applyBOMPolicy(opts.bomMode, inputHadBOM, outputBuf).Bytes())
+		if rewritten {
+			fmt.Fprintf(os.Stdout, "would write %s\n", displayName)
+		}
+	} else {
+		// Write Output
+		finalBuf := applyBOMPolicy(opts.bomMode, inputHadBOM, outputBuf)
+		rewritten = writeToFile && !bytes.Equal(originalBytes, finalBuf.Bytes())
+		if opts.outputPath != "" {
+			// A new output file takes the input's permissions
+			err = writeFileAtomic(opts.outputPath, inputFilename, finalBuf)
+		} else {
+			err = writeOutput(
+				writeToFile,
+				inputFilename,
+				finalBuf,
+			) // Write the formatted TOML data to the output
+		}
+		if err != nil {
+			return false, fmt.Errorf("writing output: %w", err) // Wrap the error with context
+		}
 	}
 
-	return nil // Success
+	// Report schema mismatches without affecting the formatted output
+	return rewritten, reportDiagnostics(inputSourceName, diagnostics)
+}
+
+// reportDiagnostics prints schema mismatches to stderr.
+//
+// Parameters:
+//   - inputSourceName: Description of the source for messages
+//   - diagnostics: Schema mismatches found in the document
+//
+// Returns:
+//   - error: If there were any mismatches, or nil
+func reportDiagnostics(inputSourceName string, diagnostics []schema.Diagnostic) error {
+	if len(diagnostics) == 0 {
+		return nil // Success
+	}
+	for _, d := range diagnostics {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", inputSourceName, d) // Print each diagnostic to stderr
+	}
+	return fmt.Errorf("%s does not match schema: %d problem(s)", inputSourceName, len(diagnostics))
 }
 
 // main is the entry point for the toml-fmt tool.
@@ -244,6 +1249,14 @@ func main() {
 	app.VersionFlag.Short(
 		'v',
 	) // Set the short flag for the version flag
+	app.Flag("version-short", "Show only the version number, on a single line.").
+		PreAction(func(*kingpin.ParseContext) error {
+			fmt.Println(version.GetVersion()) // Just the version, without build details
+			os.Exit(0)
+			return nil
+		}).
+		Bool()
+		// Define the --version-short flag; like --version it skips all other processing
 
 	// Define flags and arguments
 	writeToFile := app.Flag("write", "Write result back to the source file instead of stdout.").
@@ -252,30 +1265,322 @@ func main() {
 		// Set the short flag
 		Bool()
 		// Set the type to boolean
-	indentEnable := app.Flag("indent", "Indent output using two spaces.").
+	outputPath := app.Flag("output", "Write the result to FILE instead of stdout, replacing it atomically; the input is left untouched.").
+		Short('o').
+		PlaceHolder("FILE").
+		String()
+		// Define the -o/--output flag
+	indentEnable := app.Flag("indent", "Indent output using two spaces (a stylistic choice: canonical TOML is flush-left, see --canonical).").
 		Short('i').
 		Bool()
 		// Define the -i/--indent flag
-	filenameArg := app.Arg("filename", "Input TOML file (optional, reads from stdin if omitted)").
-		// Define the filename argument
+	indentStyle := app.Flag("indent-style", "Indent output using spaces or tabs (implies -i).").
+		Enum("space", "tab")
+		// Define the --indent-style flag
+	indentSize := app.Flag("indent-size", "Number of spaces or tabs per indentation level (implies -i; default 2 spaces or 1 tab).").
+		Default("0").
+		PlaceHolder("N").
+		Int()
+		// Define the --indent-size flag
+	indentMode := app.Flag("indent-mode", "Which lines to indent (implies -i): nested indents tables and their keys, tables-only indents nested table headers and keeps keys flush with their header, entries-only indents keys under flush-left headers.").
+		Enum(string(formatter.IndentNested), string(formatter.IndentTablesOnly), string(formatter.IndentEntriesOnly))
+		// Define the --indent-mode flag
+	indentTablesOnly := app.Flag("indent-tables-only", "Indent nested table headers but keep keys flush with their header (same as --indent-mode=tables-only).").
+		Bool()
+		// Define the --indent-tables-only flag
+	schemaPath := app.Flag("schema", "Validate the document against a schema file of key paths and expected types.").
 		String()
-		// Set the type to string
+		// Define the --schema flag
+	bomMode := app.Flag("bom", "Byte order mark policy for output: preserve the input's BOM, always emit one, or never emit one.").
+		Default("preserve").
+		Enum("preserve", "always", "never")
+		// Define the --bom flag
+	lineEnding := app.Flag("line-ending", "Line endings of the output: auto keeps the input's dominant line ending, lf or crlf always use that one.").
+		Default(lineEndingAuto).
+		Enum(lineEndingAuto, lineEndingLF, lineEndingCRLF)
+		// Define the --line-ending flag
+	emitBOM := app.Flag("emit-bom", "Always prepend a UTF-8 BOM to the output (shorthand for --bom=always).").
+		Bool()
+		// Define the --emit-bom flag
+	zipPath := app.Flag("zip", "Format every *.toml entry inside the given zip archive (use -w to rewrite the archive).").
+		String()
+		// Define the --zip flag
+	from := app.Flag("from", "Input format: auto (infer from the filename extension), toml, or json.").
+		Default("auto").
+		Enum("auto", "toml", "json")
+		// Define the --from flag
+	stdinFilename := app.Flag("stdin-filename", "Name of the file being read from stdin, used in messages and to detect the input format (e.g. for editor integrations).").
+		PlaceHolder("NAME").
+		String()
+		// Define the --stdin-filename flag
+	assumeFilename := app.Flag("assume-filename", "Filename whose extension is used to detect the input format (e.g. config.json) when --from=auto.").
+		String()
+		// Define the --assume-filename flag
+	sortMode := app.Flag("sort", "Key order: asc sorts keys alphabetically, none keeps the order of the source document, group-only keeps it within simple keys, array tables, and tables.").
+		Default("asc").
+		Enum("asc", "none", "group-only")
+		// Define the --sort flag
+	noNewlineKeysToArrayTables := app.Flag("no-newline-between-array-tables-and-keys", "Do not insert a blank line between simple keys and a following [[array.table]].").
+		Bool()
+		// Define the --no-newline-between-array-tables-and-keys flag
+	blankLinesArrayTables := app.Flag("blank-lines-between-array-tables", "Blank lines between consecutive [[array.table]] entries: 1, or 0 for compact lists of small tables.").
+		Default("1").
+		PlaceHolder("N").
+		Int()
+		// Define the --blank-lines-between-array-tables flag
+	keepArrayTableOrder := app.Flag("keep-array-table-order", "Keep [[array.table]] entries in source order (the default).").
+		Bool()
+		// Define the --keep-array-table-order flag
+	sortArrayTables := app.Flag("sort-array-tables", "Sort [[array.table]] entries by their content (key/value pairs in key order).").
+		Bool()
+		// Define the --sort-array-tables flag
+	sortArrayTablesBy := app.Flag("sort-array-tables-by", "Sort [[array.table]] entries by the value of the given key (implies --sort-array-tables).").
+		PlaceHolder("KEY").
+		String()
+		// Define the --sort-array-tables-by flag
+	multilineStrings := app.Flag("multiline-strings", "When to write string values as multi-line \"\"\" strings: never, or when they contain newlines.").
+		Default("never").
+		Enum("never", "newlines")
+		// Define the --multiline-strings flag
+	configMode := app.Flag("config", "Configuration to apply besides flags: auto to use the nearest .tomlfmt.toml file and TOMLFMT_* environment variables, or none to use only flags and built-in defaults.").
+		Default(configAuto).
+		String()
+		// Define the --config flag
+	check := app.Flag("check", "Report whether the input is formatted without writing anything; exit 1 and print its name if not.").
+		Short('c').
+		Bool()
+		// Define the -c/--check flag
+	list := app.Flag("list", "Print the names of files whose formatting would change, one per line, without writing anything; exit 0 unless an error occurs.").
+		Short('l').
+		Bool()
+		// Define the -l/--list flag
+	checkOnlyChangedLines := app.Flag("check-only-changed-lines", "Check formatting without writing output, failing only for lines changed since git HEAD.").
+		Bool()
+		// Define the --check-only-changed-lines flag
+	diff := app.Flag("diff", "Print a unified diff of the changes formatting would make instead of the document (same as --diff-format=unified).").
+		Short('d').
+		Bool()
+		// Define the -d/--diff flag
+	diffFormat := app.Flag("diff-format", "Print a diff of the changes formatting would make instead of the document: unified, context, or name-only.").
+		Enum(diffFormatUnified, diffFormatContext, diffFormatNameOnly)
+		// Define the --diff-format flag
+	inlineTablesMaxKeys := app.Flag("inline-tables-max-keys", "Write tables with at most N keys and no nested tables as inline tables (0 keeps only the source's inline tables).").
+		Default("0").
+		PlaceHolder("N").
+		Int()
+		// Define the --inline-tables-max-keys flag
+	groupKeysByValueType := app.Flag("group-keys-by-value-type", "Within each table, write scalar values first, then arrays, then inline tables.").
+		Bool()
+		// Define the --group-keys-by-value-type flag
+	floatFormat := app.Flag("float-format", "Notation for floats: shortest, decimal (never an exponent), or exponent (always an exponent).").
+		Default("shortest").
+		Enum("shortest", "decimal", "exponent")
+		// Define the --float-format flag
+	preserveKeyQuotes := app.Flag("preserve-key-quotes", "Keep keys quoted as in the source, even when they would be valid bare keys.").
+		Bool()
+		// Define the --preserve-key-quotes flag
+	preserveBlankLines := app.Flag("preserve-blank-lines", "Keep keys separated by blank lines in the source in separate groups, sorted within each group, with one blank line between groups.").
+		Bool()
+		// Define the --preserve-blank-lines flag
+	maxDepth := app.Flag("max-depth", "How many levels of subdirectories to search under a directory argument (-1 for no limit).").
+		Default("-1").
+		PlaceHolder("N").
+		Int()
+		// Define the --max-depth flag
+	noRecursive := app.Flag("no-recursive", "Only format the TOML files directly inside a directory argument (same as --max-depth=0).").
+		Bool()
+		// Define the --no-recursive flag
+	followSymlinks := app.Flag("follow-symlinks", "Follow symbolic links while searching directory arguments; each directory is visited at most once.").
+		Bool()
+		// Define the --follow-symlinks flag
+	collapseTableChains := app.Flag("collapse-table-chains", "Write chains of tables that each hold a single key as one dotted key (a.b.c = 1) instead of a header per level.").
+		Bool()
+		// Define the --collapse-table-chains flag
+	stringStyle := app.Flag("string-style", "Quoting of strings: auto (literal '...' strings for strings with backslashes), basic (always \"...\"), literal (wherever possible), or preserve (as in the source).").
+		Default(string(formatter.StringAuto)).
+		Enum(string(formatter.StringAuto), string(formatter.StringBasic), string(formatter.StringLiteral), string(formatter.StringPreserve))
+		// Define the --string-style flag
+	basicStrings := app.Flag("basic-strings", "Always write basic \"...\" strings (same as --string-style=basic).").
+		Bool()
+		// Define the --basic-strings flag
+	noAlign := app.Flag("no-align", "Do not pad keys to line up values; write each pair as key = value.").
+		Bool()
+		// Define the --no-align flag
+	fixNewlinesOnly := app.Flag("fix-newlines-only", "Only convert CRLF line endings to LF and end the file with exactly one newline; nothing else is changed.").
+		Bool()
+		// Define the --fix-newlines-only flag
+	validate := app.Flag("validate", "Only check that each document parses, reporting the first invalid one with its line and column; nothing is formatted or written.").
+		Bool()
+		// Define the --validate flag
+	toJSON := app.Flag("to-json", "Print the document's data as pretty-printed JSON instead of formatted TOML (comments are lost).").
+		Bool()
+		// Define the --to-json flag
+	to := app.Flag("to", "Output format: toml, or json to print the document's data as JSON (same as --to-json).").
+		Default(outputFormatTOML).
+		Enum(outputFormatTOML, outputFormatJSON)
+		// Define the --to flag
+	canonical := app.Flag("canonical", "Write canonical, flush-left TOML with the standard blank lines, ignoring indentation and blank-line settings of a config file.").
+		Bool()
+		// Define the --canonical flag
+	maxLineWidth := app.Flag("max-line-width", "Wrap arrays one element per line, and write inline tables under their own [header], when their line is longer than N characters (0 for no limit).").
+		Default("80").
+		PlaceHolder("N").
+		Int()
+		// Define the --max-line-width flag
+	fragment := app.Flag("fragment", "Format a TOML snippet embedded in another file: keep the indentation its lines share, and add no final newline if it had none.").
+		Bool()
+		// Define the --fragment flag
+	only := app.Flag("only", "Format only the table at PATH (a dotted key such as servers.eu) and the tables under it, leaving the rest of the document byte for byte as written.").
+		PlaceHolder("PATH").
+		String()
+		// Define the --only flag
+	dryRun := app.Flag("dry-run", "With -w, print the files that would be rewritten and how many, without writing anything.").
+		Bool()
+		// Define the --dry-run flag
+	filesFrom := app.Flag("files-from", "Also format the paths listed in FILE, one per line (- reads the list from stdin); blank lines and lines starting with # are ignored.").
+		PlaceHolder("FILE").
+		String()
+		// Define the --files-from flag
+	color := app.Flag("color", "Color diffs and errors: auto colors output that goes to a terminal (unless NO_COLOR is set), always, or never.").
+		Default(colorAuto).
+		Enum(colorAuto, colorAlways, colorNever)
+		// Define the --color flag
+	cpuProfile := app.Flag("cpuprofile", "Write a CPU profile to this file, for go tool pprof.").
+		Hidden().
+		PlaceHolder("FILE").
+		String()
+		// Define the hidden --cpuprofile flag
+	memProfile := app.Flag("memprofile", "Write a memory allocation profile to this file on exit, for go tool pprof.").
+		Hidden().
+		PlaceHolder("FILE").
+		String()
+		// Define the hidden --memprofile flag
+	filenameArgs := app.Arg("filenames", "Input TOML files or directories to search for *.toml files (optional, reads from stdin if omitted)").
+		// Define the filenames argument
+		Strings()
+		// Accept any number of files
+
+	// Every option a config file can set also takes its default from the environment,
+	// unless --config none asks for flags and built-in defaults only
+	if !configNoneGiven(app, os.Args[1:]) {
+		for _, key := range configKeys() {
+			if flag := app.GetFlag(key); flag != nil {
+				flag.Envar(envVarFor(key))
+			}
+		}
+	}
 
 	// Parse arguments - kingpin handles errors/help/version automatically and exits
-	kingpin.MustParse(app.Parse(os.Args[1:])) // Parse the command-line arguments
+	app.Terminate(func(status int) {
+		if status != exitOK {
+			status = exitError // A usage error is an operational error, not a formatting difference
+		}
+		os.Exit(status)
+	})
+	_, err := app.Parse(os.Args[1:]) // Parse the command-line arguments
+	if err != nil {
+		app.Fatalf("%s, try --help", err)
+	}
+
+	// Record which flags were given, so that they win over a config file
+	parseCtx, err := app.ParseContext(os.Args[1:])
+	app.FatalIfError(err, "")
+	setFlags := map[string]bool{}
+	for _, element := range parseCtx.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			setFlags[flag.Model().Name] = true
+		}
+	}
+	// A value from the environment also wins over a config file, but not over a flag
+	for _, flag := range app.Model().Flags {
+		if flag.Envar != "" && os.Getenv(flag.Envar) != "" {
+			setFlags[flag.Name] = true
+		}
+	}
+
+	// --indent-tables-only is shorthand for the "tables-only" indentation mode
+	if *indentTablesOnly {
+		*indentMode = string(formatter.IndentTablesOnly)
+	}
+
+	// --basic-strings is shorthand for the "basic" string style
+	if *basicStrings {
+		*stringStyle = string(formatter.StringBasic)
+	}
+
+	// --diff is shorthand for a unified diff; an explicit --diff-format picks another style
+	if *diff && *diffFormat == "" {
+		*diffFormat = diffFormatUnified
+	}
+
+	// Profiles cover the formatting work only, not flag parsing
+	stopProfiling, err := startProfiling(*cpuProfile, *memProfile)
+	if err != nil {
+		printError(os.Stderr, err, useColor(*color, os.Stderr))
+		os.Exit(exitCode(err))
+	}
 
 	// Run the core formatting logic with parsed arguments
-	err := runFormattingLogic(
-		*indentEnable,
-		*writeToFile,
-		*filenameArg,
-	) // Run the core formatting logic with the parsed arguments
+	err = runFormattingLogic(cliOptions{
+		indentEnable:   *indentEnable,
+		indentStyle:    *indentStyle,
+		indentSize:     *indentSize,
+		indentMode:     *indentMode,
+		writeToFile:    *writeToFile,
+		outputPath:     *outputPath,
+		filenameArgs:   *filenameArgs,
+		filesFrom:      *filesFrom,
+		maxDepth:       *maxDepth,
+		noRecursive:    *noRecursive,
+		followSymlinks: *followSymlinks,
+		schemaPath:     *schemaPath,
+		bomMode:        *bomMode,
+		emitBOM:        *emitBOM,
+		zipPath:        *zipPath,
+		from:           *from,
+		assumeFilename: *assumeFilename,
+		stdinFilename:  *stdinFilename,
+		sortMode:       *sortMode,
+		configMode:     *configMode,
+
+		noNewlineKeysToArrayTables: *noNewlineKeysToArrayTables,
+		blankLinesArrayTables:      *blankLinesArrayTables,
+		keepArrayTableOrder:        *keepArrayTableOrder,
+		sortArrayTables:            *sortArrayTables,
+		sortArrayTablesBy:          *sortArrayTablesBy,
+		multilineStrings:           *multilineStrings,
+		check:                      *check,
+		checkOnlyChangedLines:      *checkOnlyChangedLines,
+		diffFormat:                 *diffFormat,
+		inlineTablesMaxKeys:        *inlineTablesMaxKeys,
+		groupKeysByValueType:       *groupKeysByValueType,
+		floatFormat:                *floatFormat,
+		preserveKeyQuotes:          *preserveKeyQuotes,
+		preserveBlankLines:         *preserveBlankLines,
+		collapseTableChains:        *collapseTableChains,
+		stringStyle:                *stringStyle,
+		noAlign:                    *noAlign,
+		fixNewlinesOnly:            *fixNewlinesOnly,
+		toJSON:                     *toJSON,
+		to:                         *to,
+		validate:                   *validate,
+		lineEnding:                 *lineEnding,
+		list:                       *list,
+		dryRun:                     *dryRun,
+		canonical:                  *canonical,
+		maxLineWidth:               *maxLineWidth,
+		fragment:                   *fragment,
+		only:                       *only,
+		colorStdout:                useColor(*color, os.Stdout),
+		colorStderr:                useColor(*color, os.Stderr),
+		setFlags:                   setFlags,
+	}) // Run the core formatting logic with the parsed arguments
+	if stopErr := stopProfiling(); stopErr != nil && err == nil {
+		err = stopErr // A failed profile is only reported when formatting itself succeeded
+	}
 	// Handle any errors
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err) // Print the error message to stderr
-		os.Exit(1)                                 // Exit with a non-zero exit code
+		printError(os.Stderr, err, useColor(*color, os.Stderr)) // Print the error message to stderr
 	}
-
-	// Exit cleanly if successful
-	os.Exit(0) // Exit with a zero exit code
+	os.Exit(exitCode(err)) // 0 on success, 1 when formatting would change the input, 2 for any other error
 }
@@ -2,11 +2,18 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rogpeppe/go-internal/testscript"
 )
@@ -23,9 +30,72 @@ func TestMain(m *testing.M) {
 func TestScripts(t *testing.T) {
 	testscript.Run(t, testscript.Params{
 		Dir: "testdata",
+		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
+			"zip":   cmdZip,
+			"unzip": cmdUnzip,
+		},
 	})
 }
 
+// cmdZip implements the "zip archive file..." script command, which packs the
+// files into a new archive under their relative names.
+func cmdZip(ts *testscript.TestScript, neg bool, args []string) {
+	if neg || len(args) < 2 {
+		ts.Fatalf("usage: zip archive file...")
+	}
+	var archiveBuf bytes.Buffer
+	zw := zip.NewWriter(&archiveBuf)
+	for _, name := range args[1:] {
+		w, err := zw.Create(filepath.ToSlash(name))
+		ts.Check(err)
+		_, err = w.Write([]byte(ts.ReadFile(name)))
+		ts.Check(err)
+	}
+	ts.Check(zw.Close())
+	ts.Check(os.WriteFile(ts.MkAbs(args[0]), archiveBuf.Bytes(), 0o644))
+}
+
+// cmdUnzip implements the "unzip archive dir" script command, which extracts
+// the files of an archive under dir.
+func cmdUnzip(ts *testscript.TestScript, neg bool, args []string) {
+	if neg || len(args) != 2 {
+		ts.Fatalf("usage: unzip archive dir")
+	}
+	zr, err := zip.OpenReader(ts.MkAbs(args[0]))
+	ts.Check(err)
+	defer zr.Close()
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		ts.Check(err)
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		ts.Check(err)
+		target := filepath.Join(ts.MkAbs(args[1]), filepath.FromSlash(f.Name))
+		ts.Check(os.MkdirAll(filepath.Dir(target), 0o755))
+		ts.Check(os.WriteFile(target, content, 0o644))
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, exitOK},
+		{"not_formatted", fmt.Errorf("'a.toml' is %w", errNotFormatted), exitNotFormatted},
+		{"other_error", errors.New("reading from file 'a.toml': permission denied"), exitError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
 func TestWriteOutput(t *testing.T) {
 	content := "formatted = true\n"
 	contentBytes := []byte(content)
@@ -93,4 +163,998 @@ func TestWriteOutput(t *testing.T) {
 			t.Errorf("File content should be empty, got %d bytes", len(fileBytes))
 		}
 	})
+
+	t.Run("write_to_file_unchanged_keeps_mtime", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		targetFilePath := filepath.Join(tmpDir, "unchanged.toml")
+		if err := os.WriteFile(targetFilePath, contentBytes, 0o644); err != nil {
+			t.Fatalf("Failed to create initial file: %v", err)
+		}
+		oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(targetFilePath, oldTime, oldTime); err != nil {
+			t.Fatalf("Failed to set initial mtime: %v", err)
+		}
+
+		if err := writeOutput(true, targetFilePath, bytes.NewBuffer(contentBytes)); err != nil {
+			t.Fatalf("writeOutput to file returned error: %v", err)
+		}
+		info, err := os.Stat(targetFilePath)
+		if err != nil {
+			t.Fatalf("Failed to stat target file: %v", err)
+		}
+		if !info.ModTime().Equal(oldTime) {
+			t.Errorf("mtime after identical write = %v, want it unchanged at %v", info.ModTime(), oldTime)
+		}
+
+		// Different content is still written
+		if err := writeOutput(true, targetFilePath, bytes.NewBufferString("changed = true\n")); err != nil {
+			t.Fatalf("writeOutput to file returned error: %v", err)
+		}
+		info, err = os.Stat(targetFilePath)
+		if err != nil {
+			t.Fatalf("Failed to stat target file: %v", err)
+		}
+		if info.ModTime().Equal(oldTime) {
+			t.Errorf("mtime after changed write = %v, want it updated", info.ModTime())
+		}
+	})
+
+	t.Run("write_to_file_keeps_mode", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("Windows does not have Unix permission bits")
+		}
+		tmpDir := t.TempDir()
+		for _, mode := range []os.FileMode{0o600, 0o640, 0o755} {
+			targetFilePath := filepath.Join(tmpDir, fmt.Sprintf("mode_%o.toml", mode))
+			if err := os.WriteFile(targetFilePath, []byte("initial content"), mode); err != nil {
+				t.Fatalf("Failed to create initial file: %v", err)
+			}
+			if err := os.Chmod(targetFilePath, mode); err != nil { // Not subject to the umask, unlike WriteFile
+				t.Fatalf("Failed to set initial mode: %v", err)
+			}
+
+			if err := writeOutput(true, targetFilePath, bytes.NewBuffer(contentBytes)); err != nil {
+				t.Fatalf("writeOutput to file returned error: %v", err)
+			}
+
+			info, err := os.Stat(targetFilePath)
+			if err != nil {
+				t.Fatalf("Failed to stat target file: %v", err)
+			}
+			if got := info.Mode().Perm(); got != mode {
+				t.Errorf("mode after write = %o, want %o", got, mode)
+			}
+		}
+	})
+}
+
+func TestWriteFileAtomicNewFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not have Unix permission bits")
+	}
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "input.toml")
+	if err := os.WriteFile(inputPath, []byte("a = 1\n"), 0o600); err != nil {
+		t.Fatalf("Failed to create input file: %v", err)
+	}
+	if err := os.Chmod(inputPath, 0o640); err != nil { // Not subject to the umask, unlike WriteFile
+		t.Fatalf("Failed to set input mode: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		modeFrom string
+		wantMode os.FileMode
+	}{
+		{"from_input", inputPath, 0o640},
+		{"no_source", "", newFileMode},
+		{"missing_source", filepath.Join(tmpDir, "missing.toml"), newFileMode},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetPath := filepath.Join(tmpDir, tc.name+".toml")
+			if err := writeFileAtomic(targetPath, tc.modeFrom, bytes.NewBufferString("a = 1\n")); err != nil {
+				t.Fatalf("writeFileAtomic returned error: %v", err)
+			}
+			info, err := os.Stat(targetPath)
+			if err != nil {
+				t.Fatalf("Failed to stat target file: %v", err)
+			}
+			if got := info.Mode().Perm(); got != tc.wantMode {
+				t.Errorf("mode of new file = %o, want %o", got, tc.wantMode)
+			}
+		})
+	}
+}
+
+func TestReplaceFileRetries(t *testing.T) {
+	testCases := []struct {
+		name        string
+		failures    int // Rename attempts that fail before one succeeds
+		wantRenamed bool
+	}{
+		{"first_try", 0, true},
+		{"transient_error", 2, true},
+		{"copy_fallback", 100, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			oldRename, oldDelays := renameFile, renameRetryDelays
+			defer func() { renameFile, renameRetryDelays = oldRename, oldDelays }()
+			renameRetryDelays = make([]time.Duration, len(oldDelays)) // Retry without waiting
+			attempts := 0
+			renameFile = func(oldpath, newpath string) error {
+				attempts++
+				if attempts <= tc.failures {
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+				}
+				return os.Rename(oldpath, newpath)
+			}
+
+			dir := t.TempDir()
+			target := filepath.Join(dir, "config.toml")
+			temp := filepath.Join(dir, "config.toml.tmp")
+			if err := os.WriteFile(target, []byte("old\n"), 0o600); err != nil {
+				t.Fatalf("writing target: %v", err)
+			}
+			if err := os.WriteFile(temp, []byte("new\n"), 0o600); err != nil {
+				t.Fatalf("writing temp file: %v", err)
+			}
+
+			if err := replaceFile(temp, target); err != nil {
+				t.Fatalf("replaceFile() returned unexpected error: %v", err)
+			}
+			got, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatalf("reading target: %v", err)
+			}
+			if string(got) != "new\n" {
+				t.Errorf("target content = %q, want %q", got, "new\n")
+			}
+			if _, err := os.Stat(temp); !os.IsNotExist(err) {
+				t.Errorf("temporary file still exists after replaceFile() (stat error: %v)", err)
+			}
+			if renamed := attempts == tc.failures+1; renamed != tc.wantRenamed {
+				t.Errorf("renamed after %d attempt(s) = %v, want %v", attempts, renamed, tc.wantRenamed)
+			}
+		})
+	}
+}
+
+func TestApplyBOMPolicy(t *testing.T) {
+	content := "key = 1\n"
+	bom := string(utf8BOM)
+
+	testCases := []struct {
+		name        string
+		bomMode     string
+		inputHadBOM bool
+		want        string
+	}{
+		{"preserve_with_bom", "preserve", true, bom + content},
+		{"preserve_without_bom", "preserve", false, content},
+		{"always_with_bom", "always", true, bom + content},
+		{"always_without_bom", "always", false, bom + content},
+		{"never_with_bom", "never", true, content},
+		{"never_without_bom", "never", false, content},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := applyBOMPolicy(tc.bomMode, tc.inputHadBOM, bytes.NewBufferString(content))
+			if got.String() != tc.want {
+				t.Errorf("applyBOMPolicy(%q, %v) = %q, want %q", tc.bomMode, tc.inputHadBOM, got.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestStripBOM(t *testing.T) {
+	got, hadBOM := stripBOM(append(append([]byte{}, utf8BOM...), "a = 1\n"...))
+	if !hadBOM || string(got) != "a = 1\n" {
+		t.Errorf("stripBOM(with BOM) = %q, %v; want %q, true", got, hadBOM, "a = 1\n")
+	}
+	got, hadBOM = stripBOM([]byte("a = 1\n"))
+	if hadBOM || string(got) != "a = 1\n" {
+		t.Errorf("stripBOM(without BOM) = %q, %v; want %q, false", got, hadBOM, "a = 1\n")
+	}
+}
+
+func TestIndentUnitFor(t *testing.T) {
+	testCases := []struct {
+		name    string
+		enable  bool
+		style   string
+		size    int
+		mode    string
+		want    string
+		wantErr bool
+	}{
+		{"off", false, "", 0, "", "", false},
+		{"indent_flag", true, "", 0, "", "  ", false},
+		{"four_spaces", false, "", 4, "", "    ", false},
+		{"tab", false, "tab", 0, "", "\t", false},
+		{"two_tabs", true, "tab", 2, "", "\t\t", false},
+		{"explicit_space", false, "space", 0, "", "  ", false},
+		{"mode", false, "", 0, "tables-only", "  ", false},
+		{"negative", true, "", -1, "", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := indentUnitFor(tc.enable, tc.style, tc.size, tc.mode)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("indentUnitFor(%v, %q, %d, %q) error = %v, wantErr %v", tc.enable, tc.style, tc.size, tc.mode, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("indentUnitFor(%v, %q, %d, %q) = %q, want %q", tc.enable, tc.style, tc.size, tc.mode, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindConfigFile(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(nested, 0o750); err != nil {
+		t.Fatalf("creating directories: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, ".tomlfmt"), []byte("indent = true\n"), 0o600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+
+	got, err := findConfigFile(nested)
+	if err != nil {
+		t.Fatalf("findConfigFile() returned unexpected error: %v", err)
+	}
+	if want := filepath.Join(root, ".tomlfmt"); got != want {
+		t.Errorf("findConfigFile() = %q, want %q", got, want)
+	}
+
+	// .tomlfmt.toml is preferred over .tomlfmt in the same directory
+	if err := os.WriteFile(filepath.Join(root, ".tomlfmt.toml"), []byte("indent = true\n"), 0o600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	got, err = findConfigFile(nested)
+	if err != nil {
+		t.Fatalf("findConfigFile() returned unexpected error: %v", err)
+	}
+	if want := filepath.Join(root, ".tomlfmt.toml"); got != want {
+		t.Errorf("findConfigFile() = %q, want %q", got, want)
+	}
+}
+
+func TestFileConfigApplyTo(t *testing.T) {
+	size := 4
+	sortMode := "none"
+	sortArrayTables := true
+	cfg := fileConfig{IndentSize: &size, Sort: &sortMode, SortArrayTables: &sortArrayTables}
+
+	testCases := []struct {
+		name                string
+		setFlags            map[string]bool
+		wantIndentSize      int
+		wantSortMode        string
+		wantSortArrayTables bool
+	}{
+		{"config_applies", nil, 4, "none", true},
+		{"flag_wins", map[string]bool{"sort": true}, 4, "asc", true},
+		{"keep_order_wins", map[string]bool{"keep-array-table-order": true}, 4, "none", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := cfg.applyTo(cliOptions{sortMode: "asc", setFlags: tc.setFlags})
+			if got.indentSize != tc.wantIndentSize {
+				t.Errorf("indentSize = %d, want %d", got.indentSize, tc.wantIndentSize)
+			}
+			if got.sortMode != tc.wantSortMode {
+				t.Errorf("sortMode = %q, want %q", got.sortMode, tc.wantSortMode)
+			}
+			if got.sortArrayTables != tc.wantSortArrayTables {
+				t.Errorf("sortArrayTables = %v, want %v", got.sortArrayTables, tc.wantSortArrayTables)
+			}
+		})
+	}
+}
+
+func TestEnvVarName(t *testing.T) {
+	testCases := []struct {
+		flag string
+		want string
+	}{
+		{"indent", "TOMLFMT_INDENT"},
+		{"sort", "TOMLFMT_SORT"},
+		{"max-line-width", "TOMLFMT_MAX_LINE_WIDTH"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.flag, func(t *testing.T) {
+			if got := envVarName(tc.flag); got != tc.want {
+				t.Errorf("envVarName(%q) = %q, want %q", tc.flag, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := configKeys()
+	for _, want := range []string{"indent", "sort", "max-line-width", "trailing-comma"} {
+		if !slices.Contains(keys, want) {
+			t.Errorf("configKeys() = %v, missing %q", keys, want)
+		}
+	}
+	if slices.Contains(keys, "") {
+		t.Errorf("configKeys() = %v, contains a field without a toml tag", keys)
+	}
+}
+
+func TestFixNewlines(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"already_fixed", "b=1\na = 2\n", "b=1\na = 2\n"},
+		{"crlf", "b=1\r\na = 2\r\n", "b=1\na = 2\n"},
+		{"lone_cr_kept", "a = \"x\"\r# c\n", "a = \"x\"\r# c\n"},
+		{"missing_final_newline", "a=1", "a=1\n"},
+		{"extra_final_newlines", "a=1\n\n\r\n\n", "a=1\n"},
+		{"inner_blank_lines_kept", "a=1\r\n\r\n\r\nb=2", "a=1\n\n\nb=2\n"},
+		{"trailing_spaces_kept", "a=1  \n  \n", "a=1  \n  \n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := fixNewlines([]byte(tc.input))
+			if string(got) != tc.want {
+				t.Errorf("fixNewlines(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFixNewlinesOnlyWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	input := "\ufeffz = 1\r\na=[1,2]  # keep\r\n\r\n"
+	if err := os.WriteFile(path, []byte(input), 0o600); err != nil {
+		t.Fatalf("writing input: %v", err)
+	}
+	err := runFormattingLogic(cliOptions{
+		writeToFile:     true,
+		filenameArgs:    []string{path},
+		maxDepth:        -1,
+		bomMode:         "preserve",
+		from:            "auto",
+		sortMode:        "asc",
+		configMode:      configAuto,
+		fixNewlinesOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("runFormattingLogic() returned unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+	want := "\ufeffz = 1\na=[1,2]  # keep\n"
+	if string(got) != want {
+		t.Errorf("file content = %q, want %q", got, want)
+	}
+}
+
+func TestDetectLineEnding(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", lineEndingLF},
+		{"no_newline", "a = 1", lineEndingLF},
+		{"lf", "a = 1\nb = 2\n", lineEndingLF},
+		{"crlf", "a = 1\r\nb = 2\r\n", lineEndingCRLF},
+		{"mostly_crlf", "a = 1\r\nb = 2\r\nc = 3\n", lineEndingCRLF},
+		{"tie", "a = 1\r\nb = 2\n", lineEndingLF},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := detectLineEnding([]byte(tc.input)); got != tc.want {
+				t.Errorf("detectLineEnding(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLineEndingWrite(t *testing.T) {
+	testCases := []struct {
+		name            string
+		lineEnding      string
+		fixNewlinesOnly bool
+		input           string
+		want            string
+	}{
+		{"auto_keeps_crlf", lineEndingAuto, false, "b=2\r\na=1\r\n", "a = 1\r\nb = 2\r\n"},
+		{"auto_keeps_lf", lineEndingAuto, false, "b=2\na=1\n", "a = 1\nb = 2\n"},
+		{"lf_normalizes", lineEndingLF, false, "b=2\r\na=1\r\n", "a = 1\nb = 2\n"},
+		{"crlf_converts", lineEndingCRLF, false, "b=2\na=1\n", "a = 1\r\nb = 2\r\n"},
+		{"fix_newlines_auto_is_lf", lineEndingAuto, true, "b=2\r\na=1\r\n", "b=2\na=1\n"},
+		{"fix_newlines_crlf", lineEndingCRLF, true, "b=2\na=1", "b=2\r\na=1\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(tc.input), 0o600); err != nil {
+				t.Fatalf("writing input: %v", err)
+			}
+			err := runFormattingLogic(cliOptions{
+				writeToFile:     true,
+				filenameArgs:    []string{path},
+				maxDepth:        -1,
+				bomMode:         "preserve",
+				from:            "auto",
+				sortMode:        "asc",
+				configMode:      configNone,
+				fixNewlinesOnly: tc.fixNewlinesOnly,
+				lineEnding:      tc.lineEnding,
+			})
+			if err != nil {
+				t.Fatalf("runFormattingLogic() returned unexpected error: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading output: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("file content = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatZipArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "bundle.zip")
+	readme := "This is not TOML = unchanged\n"
+
+	// Build an archive with one TOML entry and one non-TOML entry
+	var archiveBuf bytes.Buffer
+	zw := zip.NewWriter(&archiveBuf)
+	for name, content := range map[string]string{
+		"config/app.toml": "name=\"app\"\n[server]\nport=80\n",
+		"README.txt":      readme,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("creating zip entry %s: %v", name, err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatalf("writing zip entry %s: %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing zip writer: %v", err)
+	}
+	if err := os.WriteFile(archivePath, archiveBuf.Bytes(), 0o644); err != nil {
+		t.Fatalf("writing zip archive: %v", err)
+	}
+
+	opts := cliOptions{
+		writeToFile: true,
+		zipPath:     archivePath,
+		bomMode:     "preserve",
+		sortMode:    "asc",
+		lineEnding:  lineEndingAuto,
+	}
+	if err := formatZipArchive(opts, nil); err != nil {
+		t.Fatalf("formatZipArchive() returned error: %v", err)
+	}
+
+	// Read the rewritten archive back
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		t.Fatalf("opening rewritten archive: %v", err)
+	}
+	defer zr.Close()
+
+	want := map[string]string{
+		"config/app.toml": "name = \"app\"\n\n[server]\nport = 80\n",
+		"README.txt":      readme,
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("rewritten archive has %d entries, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening entry %s: %v", f.Name, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading entry %s: %v", f.Name, err)
+		}
+		if string(got) != want[f.Name] {
+			t.Errorf("entry %s = %q, want %q", f.Name, string(got), want[f.Name])
+		}
+	}
+}
+
+func TestResolveInputFormat(t *testing.T) {
+	testCases := []struct {
+		name           string
+		from           string
+		assumeFilename string
+		filename       string
+		want           string
+	}{
+		{"default_stdin", "auto", "", "", "toml"},
+		{"toml_file", "auto", "", "config.toml", "toml"},
+		{"json_file", "auto", "", "config.json", "json"},
+		{"assumed_json", "auto", "config.json", "", "json"},
+		{"assumed_wins_over_file", "auto", "config.toml", "data.json", "toml"},
+		{"explicit_from_wins", "toml", "config.json", "", "toml"},
+		{"explicit_json", "json", "", "config.toml", "json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := resolveInputFormat(tc.from, tc.assumeFilename, tc.filename)
+			if got != tc.want {
+				t.Errorf("resolveInputFormat(%q, %q, %q) = %q, want %q",
+					tc.from, tc.assumeFilename, tc.filename, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatJSONOutput(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", "{}\n", false},
+		{"scalars", "b = true\na = 1\n", "{\n  \"a\": 1,\n  \"b\": true\n}\n", false},
+		{"offset_datetime", "t = 2024-01-02T03:04:05.5Z\n", "{\n  \"t\": \"2024-01-02T03:04:05.5Z\"\n}\n", false},
+		{"local_date", "d = 2024-01-02\n", "{\n  \"d\": \"2024-01-02\"\n}\n", false},
+		{"nan", "x = [nan]\n", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _, err := formatJSONOutput([]byte(tc.input), inputFormatTOML, "test", nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("formatJSONOutput() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && got.String() != tc.want {
+				t.Errorf("formatJSONOutput() = %q, want %q", got.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"one_per_line", "a.toml\nsub/b.toml\n", []string{"a.toml", "sub/b.toml"}},
+		{"no_final_newline", "a.toml\nb.toml", []string{"a.toml", "b.toml"}},
+		{"blank_lines_and_comments", "# changed\n\na.toml\n  \n  # indented comment\nb.toml\n", []string{"a.toml", "b.toml"}},
+		{"crlf_and_surrounding_space", "a.toml\r\n  b.toml  \r\n", []string{"a.toml", "b.toml"}},
+		{"spaces_inside_paths", "my dir/a b.toml\n", []string{"my dir/a b.toml"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readFileList(strings.NewReader(tc.input), "test list")
+			if err != nil {
+				t.Fatalf("readFileList() returned unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("readFileList() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWalkTOMLFiles(t *testing.T) {
+	root := t.TempDir()
+	mustWrite := func(rel string) {
+		t.Helper()
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("creating directory for %s: %v", rel, err)
+		}
+		if err := os.WriteFile(path, []byte("a = 1\n"), 0o644); err != nil {
+			t.Fatalf("writing %s: %v", rel, err)
+		}
+	}
+	mustWrite("a.toml")
+	mustWrite("notes.txt")
+	mustWrite("sub/b.toml")
+
+	// A self-referential link: sub/loop points back at the root
+	if err := os.Symlink(root, filepath.Join(root, "sub", "loop")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	t.Run("symlinks_ignored", func(t *testing.T) {
+		result, err := walkTOMLFiles(root, false, -1)
+		if err != nil {
+			t.Fatalf("walkTOMLFiles() returned error: %v", err)
+		}
+		want := []string{filepath.Join(root, "a.toml"), filepath.Join(root, "sub", "b.toml")}
+		if strings.Join(result.files, "\n") != strings.Join(want, "\n") {
+			t.Errorf("files = %q, want %q", result.files, want)
+		}
+		if len(result.skipped) != 0 {
+			t.Errorf("skipped = %q, want none", result.skipped)
+		}
+	})
+
+	t.Run("symlink_cycle_detected", func(t *testing.T) {
+		result, err := walkTOMLFiles(root, true, -1)
+		if err != nil {
+			t.Fatalf("walkTOMLFiles() returned error: %v", err)
+		}
+		want := []string{filepath.Join(root, "a.toml"), filepath.Join(root, "sub", "b.toml")}
+		if strings.Join(result.files, "\n") != strings.Join(want, "\n") {
+			t.Errorf("files = %q, want %q", result.files, want)
+		}
+		wantSkipped := []string{filepath.Join(root, "sub", "loop")}
+		if strings.Join(result.skipped, "\n") != strings.Join(wantSkipped, "\n") {
+			t.Errorf("skipped = %q, want %q", result.skipped, wantSkipped)
+		}
+	})
+
+	t.Run("max_depth", func(t *testing.T) {
+		result, err := walkTOMLFiles(root, true, 0)
+		if err != nil {
+			t.Fatalf("walkTOMLFiles() returned error: %v", err)
+		}
+		want := []string{filepath.Join(root, "a.toml")}
+		if strings.Join(result.files, "\n") != strings.Join(want, "\n") {
+			t.Errorf("files = %q, want %q", result.files, want)
+		}
+		if len(result.skipped) != 0 {
+			t.Errorf("skipped = %q, want none", result.skipped)
+		}
+	})
+}
+
+func TestGlobFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"a.toml", "notes.txt", "sub/b.toml", "sub/deep/c.toml", "other/d.toml"} {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("creating directory for %s: %v", rel, err)
+		}
+		if err := os.WriteFile(path, []byte("a = 1\n"), 0o644); err != nil {
+			t.Fatalf("writing %s: %v", rel, err)
+		}
+	}
+
+	testCases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.toml", []string{"a.toml"}},
+		{"**/*.toml", []string{"a.toml", "other/d.toml", "sub/b.toml", "sub/deep/c.toml"}},
+		{"sub/**/*.toml", []string{"sub/b.toml", "sub/deep/c.toml"}},
+		{"sub/**", []string{"sub/b.toml", "sub/deep/c.toml"}},
+		{"*/b.toml", []string{"sub/b.toml"}},
+		{"s?b/*.toml", []string{"sub/b.toml"}},
+		{"[ab].*", []string{"a.toml"}},
+		{"*", []string{"a.toml", "notes.txt"}},
+		{"missing/*.toml", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			got, err := globFiles(filepath.Join(root, tc.pattern), false)
+			if err != nil {
+				t.Fatalf("globFiles(%q) returned error: %v", tc.pattern, err)
+			}
+			var want []string
+			for _, rel := range tc.want {
+				want = append(want, filepath.Join(root, rel))
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("globFiles(%q) = %q, want %q", tc.pattern, got, want)
+			}
+		})
+	}
+
+	if _, err := globFiles(filepath.Join(root, "[a.toml"), false); err == nil {
+		t.Error("globFiles() with a malformed pattern returned no error")
+	}
+}
+
+func TestParseHunkRanges(t *testing.T) {
+	diff := `diff --git a/config.toml b/config.toml
+index 1111111..2222222 100644
+--- a/config.toml
++++ b/config.toml
+@@ -2 +2 @@ name = "app"
+-port=1
++port=2
+@@ -5,0 +6,2 @@ host = "x"
++a=1
++b=2
+@@ -9,3 +10,0 @@
+-gone
+@@ -20,2 +19 @@
+-x
++y
+`
+	got, err := parseHunkRanges([]byte(diff))
+	if err != nil {
+		t.Fatalf("parseHunkRanges() returned unexpected error: %v", err)
+	}
+	want := map[int]bool{2: true, 6: true, 7: true, 19: true}
+	if len(got) != len(want) {
+		t.Fatalf("parseHunkRanges() = %v, want %v", got, want)
+	}
+	for n := range want {
+		if !got[n] {
+			t.Errorf("parseHunkRanges() is missing line %d: got %v", n, got)
+		}
+	}
+}
+
+func TestMisformattedLines(t *testing.T) {
+	testCases := []struct {
+		name      string
+		input     string
+		formatted string
+		want      []int
+	}{
+		{"already_formatted", "a = 1\nb = 2\n", "a = 1\nb = 2\n", nil},
+		{"rewritten_line", "a = 1\nb=2\n", "a = 1\nb = 2\n", []int{2}},
+		{"reordered_keys", "b = 2\na = 1\n", "a = 1\nb = 2\n", []int{1, 2}},
+		{"inserted_blank_line", "a = 1\n[t]\nx = 1\n", "a = 1\n\n[t]\nx = 1\n", []int{2}},
+		{"removed_lines", "a = 1\n\n\nb = 2\n", "a = 1\nb = 2\n", []int{2, 3}},
+		{"appended_at_end", "a = 1", "a = 1\n# end\n", []int{1}},
+		{"crlf_is_not_a_change", "a = 1\r\nb = 2\r\n", "a = 1\nb = 2\n", nil},
+		{"empty_input", "", "a = 1\n", []int{1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := misformattedLines([]byte(tc.input), []byte(tc.formatted))
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("misformattedLines() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLineEdits(t *testing.T) {
+	// lcsLength is the textbook quadratic table, which lineEdits must agree with
+	lcsLength := func(a, b []string) int {
+		table := make([][]int, len(a)+1)
+		for i := range table {
+			table[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					table[i][j] = table[i+1][j+1] + 1
+				} else {
+					table[i][j] = max(table[i+1][j], table[i][j+1])
+				}
+			}
+		}
+		return table[0][0]
+	}
+
+	testCases := []struct {
+		name string
+		a, b string
+	}{
+		{"equal", "abc", "abc"},
+		{"both_empty", "", ""},
+		{"all_inserted", "", "abc"},
+		{"all_deleted", "abc", ""},
+		{"rewritten_middle", "abcde", "abXde"},
+		{"reordered", "abcd", "dcba"},
+		{"repeated_lines", "aabbaabb", "ababab"},
+		{"interleaved", "axbycz", "xaybzc"},
+		{"long_shifted", strings.Repeat("abcdefg", 40), "x" + strings.Repeat("bacdegf", 40)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := strings.Split(tc.a, ""), strings.Split(tc.b, "")
+			var rebuilt []string
+			common := 0
+			for _, e := range lineEdits(a, b) {
+				switch e.op {
+				case editEqual:
+					if a[e.a] != b[e.b] {
+						t.Fatalf("edit %+v pairs %q with %q", e, a[e.a], b[e.b])
+					}
+					rebuilt = append(rebuilt, a[e.a])
+					common++
+				case editInsert:
+					rebuilt = append(rebuilt, b[e.b])
+				}
+			}
+			if !slices.Equal(rebuilt, b) {
+				t.Errorf("edits rebuild %q, want %q", rebuilt, b)
+			}
+			if want := lcsLength(a, b); common != want {
+				t.Errorf("edits keep %d common lines, want %d", common, want)
+			}
+		})
+	}
+}
+
+func TestColorizeDiff(t *testing.T) {
+	const (
+		reset  = "\x1b[0m"
+		bold   = "\x1b[1m"
+		red    = "\x1b[31m"
+		green  = "\x1b[32m"
+		yellow = "\x1b[33m"
+		cyan   = "\x1b[36m"
+	)
+	testCases := []struct {
+		name   string
+		format string
+		diff   string
+		want   string
+	}{
+		{
+			name:   "unified",
+			format: diffFormatUnified,
+			diff:   "--- a/x.toml\n+++ b/x.toml\n@@ -1,2 +1,2 @@\n-b=2\n a = 1\n+b = 2\n",
+			want: bold + "--- a/x.toml" + reset + "\n" + bold + "+++ b/x.toml" + reset + "\n" +
+				cyan + "@@ -1,2 +1,2 @@" + reset + "\n" + red + "-b=2" + reset + "\n a = 1\n" +
+				green + "+b = 2" + reset + "\n",
+		},
+		{
+			name:   "context",
+			format: diffFormatContext,
+			diff:   "*** a/x.toml\n--- b/x.toml\n***************\n*** 1 ****\n! a=1\n--- 1 ----\n! a = 1\n",
+			want: bold + "*** a/x.toml" + reset + "\n" + bold + "--- b/x.toml" + reset + "\n" +
+				cyan + "***************" + reset + "\n" + cyan + "*** 1 ****" + reset + "\n" +
+				yellow + "! a=1" + reset + "\n" + cyan + "--- 1 ----" + reset + "\n" +
+				yellow + "! a = 1" + reset + "\n",
+		},
+		{
+			name:   "name_only",
+			format: diffFormatNameOnly,
+			diff:   "x.toml\n",
+			want:   "x.toml\n",
+		},
+		{
+			name:   "empty",
+			format: diffFormatUnified,
+			diff:   "",
+			want:   "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := colorizeDiff(tc.format, tc.diff); got != tc.want {
+				t.Errorf("colorizeDiff() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrintError(t *testing.T) {
+	err := errors.New("parsing TOML from x.toml at line 2, column 5: bad value")
+
+	var plain bytes.Buffer
+	printError(&plain, err, false)
+	if want := "Error: " + err.Error() + "\n"; plain.String() != want {
+		t.Errorf("printError() without color = %q, want %q", plain.String(), want)
+	}
+
+	var colored bytes.Buffer
+	printError(&colored, err, true)
+	want := "\x1b[1;31mError:\x1b[0m parsing TOML from x.toml at \x1b[1;31mline 2, column 5\x1b[0m: bad value\n"
+	if colored.String() != want {
+		t.Errorf("printError() with color = %q, want %q", colored.String(), want)
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatalf("os.CreateTemp() returned unexpected error: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	t.Setenv("NO_COLOR", "")
+	if useColor(colorAuto, file) {
+		t.Error("useColor(auto) = true for a regular file")
+	}
+	if !useColor(colorAlways, file) {
+		t.Error("useColor(always) = false")
+	}
+	if useColor(colorNever, file) {
+		t.Error("useColor(never) = true")
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	original := "b=2\na = 1\n"
+	formatted := "a = 1\nb = 2\n"
+
+	testCases := []struct {
+		name      string
+		format    string
+		original  string
+		formatted string
+		want      string
+	}{
+		{
+			name: "unified", format: diffFormatUnified, original: original, formatted: formatted,
+			want: "--- a/x.toml\n+++ b/x.toml\n@@ -1,2 +1,2 @@\n-b=2\n a = 1\n+b = 2\n",
+		},
+		{
+			name: "context", format: diffFormatContext, original: original, formatted: formatted,
+			want: "*** a/x.toml\n--- b/x.toml\n***************\n*** 1,2 ****\n- b=2\n  a = 1\n--- 1,2 ----\n  a = 1\n+ b = 2\n",
+		},
+		{
+			name: "name_only", format: diffFormatNameOnly, original: original, formatted: formatted,
+			want: "x.toml\n",
+		},
+		{
+			name: "unchanged", format: diffFormatUnified, original: formatted, formatted: formatted,
+			want: "",
+		},
+		{
+			name: "unified_insertion", format: diffFormatUnified, original: "a = 1\n", formatted: "a = 1\n\n[t]\n",
+			want: "--- a/x.toml\n+++ b/x.toml\n@@ -1 +1,3 @@\n a = 1\n+\n+[t]\n",
+		},
+		{
+			name: "unified_into_empty", format: diffFormatUnified, original: "", formatted: "a = 1\n",
+			want: "--- a/x.toml\n+++ b/x.toml\n@@ -0,0 +1 @@\n+a = 1\n",
+		},
+		{
+			name: "context_changed_line", format: diffFormatContext, original: "a=1\n", formatted: "a = 1\n",
+			want: "*** a/x.toml\n--- b/x.toml\n***************\n*** 1 ****\n! a=1\n--- 1 ----\n! a = 1\n",
+		},
+		{
+			name: "missing_final_newline", format: diffFormatUnified, original: "a = 1", formatted: "a = 1\n",
+			want: "--- a/x.toml\n+++ b/x.toml\n@@ -1 +1 @@\n-a = 1\n\\ No newline at end of file\n+a = 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeDiff(&buf, tc.format, "x.toml", []byte(tc.original), []byte(tc.formatted)); err != nil {
+				t.Fatalf("writeDiff() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("writeDiff() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+
+	// Distant changes are split into separate hunks with three lines of context
+	long := "x=0\n1\n2\n3\n4\n5\n6\n7\n8\ny=9\n"
+	var buf bytes.Buffer
+	if err := writeDiff(&buf, diffFormatUnified, "x.toml", []byte(long),
+		[]byte(strings.NewReplacer("x=0", "x = 0", "y=9", "y = 9").Replace(long))); err != nil {
+		t.Fatalf("writeDiff() returned unexpected error: %v", err)
+	}
+	if got := strings.Count(buf.String(), "@@ -"); got != 2 {
+		t.Errorf("writeDiff() produced %d hunks, want 2:\n%s", got, buf.String())
+	}
 }
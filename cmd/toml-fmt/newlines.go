@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import "bytes"
+
+// fixNewlines is the whole of --fix-newlines-only: it works on the raw bytes and
+// changes exactly two things, leaving every other byte as it was:
+//
+//   - Each CRLF line ending becomes LF. A lone CR is left alone.
+//   - The line endings at the end of the file become exactly one LF, adding one
+//     when the last line has none. Whitespace before them is kept.
+//
+// Empty input stays empty. A BOM is handled by the caller's BOM policy.
+//
+// Parameters:
+//   - input: Raw document bytes (without a BOM)
+//
+// Returns:
+//   - []byte: The document with normalized line endings
+func fixNewlines(input []byte) []byte {
+	if len(input) == 0 {
+		return input
+	}
+	out := bytes.ReplaceAll(input, []byte("\r\n"), []byte("\n"))
+	out = bytes.TrimRight(out, "\n") // Trailing blank lines collapse into the single final newline
+	return append(out, '\n')
+}
+
+// Values accepted by --line-ending.
+const (
+	lineEndingAuto = "auto" // Keep the dominant line ending of the input
+	lineEndingLF   = "lf"   // Always write "\n"
+	lineEndingCRLF = "crlf" // Always write "\r\n"
+)
+
+// detectLineEnding picks the line ending most lines of the input end with. Ties,
+// including input without any line breaks, go to LF.
+//
+// Parameters:
+//   - input: Raw document bytes
+//
+// Returns:
+//   - string: lineEndingLF or lineEndingCRLF
+func detectLineEnding(input []byte) string {
+	crlf := bytes.Count(input, []byte("\r\n"))
+	lf := bytes.Count(input, []byte("\n")) - crlf
+	if crlf > lf {
+		return lineEndingCRLF
+	}
+	return lineEndingLF
+}
+
+// applyLineEnding rewrites the LF line endings the formatter produces according
+// to the --line-ending policy.
+//
+// Parameters:
+//   - mode: lineEndingAuto, lineEndingLF, or lineEndingCRLF
+//   - input: The original document, whose line endings auto keeps
+//   - output: The formatted document, using LF line endings
+//
+// Returns:
+//   - *bytes.Buffer: The document with the chosen line endings (output itself for LF)
+func applyLineEnding(mode string, input []byte, output *bytes.Buffer) *bytes.Buffer {
+	if mode == lineEndingAuto {
+		mode = detectLineEnding(input)
+	}
+	if mode != lineEndingCRLF {
+		return output
+	}
+	normalized := bytes.ReplaceAll(output.Bytes(), []byte("\r\n"), []byte("\n")) // Never produce "\r\r\n"
+	return bytes.NewBuffer(bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n")))
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts writing a CPU profile to cpuPath, for the hidden
+// --cpuprofile flag, and returns a function that stops it and writes a memory
+// profile to memPath, for --memprofile. Either path may be empty to skip that
+// profile. The profiles are read with go tool pprof.
+//
+// Parameters:
+//   - cpuPath: File the CPU profile is written to (empty for none)
+//   - memPath: File the memory profile is written to when profiling stops (empty for none)
+//
+// Returns:
+//   - func() error: Stops profiling; it must be called before the program exits
+//   - error: If the CPU profile cannot be started
+func startProfiling(cpuPath, memPath string) (func() error, error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		var err error
+		cpuFile, err = os.Create(filepath.Clean(cpuPath))
+		if err != nil {
+			return nil, fmt.Errorf("creating CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			_ = cpuFile.Close()
+			return nil, fmt.Errorf("starting CPU profile: %w", err)
+		}
+	}
+
+	stop := func() error {
+		var errs []error
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("writing CPU profile: %w", err))
+			}
+		}
+		if memPath != "" {
+			errs = append(errs, writeMemProfile(memPath))
+		}
+		return errors.Join(errs...)
+	}
+	return stop, nil
+}
+
+// writeMemProfile writes a profile of the memory allocated so far to path.
+func writeMemProfile(path string) error {
+	memFile, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("creating memory profile: %w", err)
+	}
+	runtime.GC() // Bring the statistics of live memory up to date
+	if err := pprof.Lookup("allocs").WriteTo(memFile, 0); err != nil {
+		_ = memFile.Close()
+		return fmt.Errorf("writing memory profile: %w", err)
+	}
+	if err := memFile.Close(); err != nil {
+		return fmt.Errorf("writing memory profile: %w", err)
+	}
+	return nil
+}
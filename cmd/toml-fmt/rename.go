@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// renameFile is os.Rename; tests replace it to simulate failures.
+var renameFile = os.Rename
+
+// renameRetryDelays are the pauses before each new rename attempt. On Windows a
+// virus scanner or an editor can hold the target open for a moment, which makes
+// the rename fail with "access denied" until it lets go.
+var renameRetryDelays = []time.Duration{
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	40 * time.Millisecond,
+	80 * time.Millisecond,
+	160 * time.Millisecond,
+}
+
+// replaceFile moves the temporary file over the target. The rename is retried
+// with growing pauses; if it keeps failing, the content is copied into the target
+// instead (not atomic, but it still gets the file written) and the temporary
+// file is removed.
+//
+// Parameters:
+//   - tempFilename: The fully written temporary file
+//   - target: The file to replace
+//
+// Returns:
+//   - error: If neither renaming nor copying succeeds
+func replaceFile(tempFilename, target string) error {
+	err := renameFile(tempFilename, target)
+	for _, delay := range renameRetryDelays {
+		if err == nil {
+			return nil
+		}
+		time.Sleep(delay)
+		err = renameFile(tempFilename, target)
+	}
+	if err == nil {
+		return nil
+	}
+
+	// Last resort: overwrite the target in place
+	if copyErr := copyFileContent(tempFilename, target); copyErr != nil {
+		return fmt.Errorf("renaming temporary file '%s' to '%s': %w (copying instead failed: %v)", tempFilename, target, err, copyErr)
+	}
+	_ = os.Remove(tempFilename) // The content is in place; the temporary file is no longer needed
+	return nil
+}
+
+// copyFileContent truncates dst and writes the content of src into it, keeping
+// dst's mode and owner.
+func copyFileContent(src, dst string) error {
+	content, err := os.ReadFile(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Clean(dst), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// walkResult holds the outcome of scanning a directory tree for TOML files.
+type walkResult struct {
+	files   []string // TOML files found, in lexical order
+	skipped []string // Symlinks that were not followed because they lead to an already visited directory
+	broken  []string // Symlinks that were not followed because their target does not exist
+}
+
+// walkTOMLFiles finds every *.toml file under root. Symbolic links are ignored
+// unless followSymlinks is set. When following links, each directory is visited
+// at most once, identified by its resolved path, so a link pointing back at one
+// of its ancestors (or at any directory already walked) cannot cause an endless
+// loop; such links are recorded in walkResult.skipped instead. Links whose
+// target does not exist are recorded in walkResult.broken.
+//
+// Parameters:
+//   - root: Directory to scan
+//   - followSymlinks: Whether to descend into symlinked directories and include symlinked files
+//   - maxDepth: How many levels of subdirectories to descend into (0 for root only, negative for no limit)
+//
+// Returns:
+//   - walkResult: The TOML files found and any links skipped to avoid cycles
+//   - error: Any error encountered reading the tree, or nil on success
+func walkTOMLFiles(root string, followSymlinks bool, maxDepth int) (walkResult, error) {
+	var result walkResult
+	visited := map[string]bool{} // Resolved paths of directories already walked
+	err := walkDir(filepath.Clean(root), followSymlinks, maxDepth, visited, &result)
+	return result, err
+}
+
+// walkDir scans a single directory, recursing into subdirectories while depthLeft
+// allows (negative means no limit).
+func walkDir(dir string, followSymlinks bool, depthLeft int, visited map[string]bool, result *walkResult) error {
+	realDir, err := filepath.EvalSymlinks(dir) // Identify the directory by its target, not by the link used to reach it
+	if err != nil {
+		return fmt.Errorf("resolving directory '%s': %w", dir, err)
+	}
+	if visited[realDir] {
+		result.skipped = append(result.skipped, dir) // Reached again through a link: a cycle or a duplicate
+		return nil
+	}
+	visited[realDir] = true
+
+	entries, err := os.ReadDir(dir) // Entries are returned sorted by name
+	if err != nil {
+		return fmt.Errorf("reading directory '%s': %w", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		mode := entry.Type()
+		if mode&fs.ModeSymlink != 0 {
+			if !followSymlinks {
+				continue // Links are not followed by default
+			}
+			info, err := os.Stat(path) // Stat follows the link to its target
+			if errors.Is(err, fs.ErrNotExist) {
+				result.broken = append(result.broken, path) // A dangling link holds nothing to format
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("following symlink '%s': %w", path, err)
+			}
+			mode = info.Mode().Type()
+		}
+		switch {
+		case mode.IsDir():
+			if depthLeft == 0 {
+				continue // Deep enough
+			}
+			if err := walkDir(path, followSymlinks, depthLeft-1, visited, result); err != nil {
+				return err
+			}
+		case mode.IsRegular() && strings.EqualFold(filepath.Ext(path), ".toml"):
+			result.files = append(result.files, path)
+		}
+	}
+	return nil
+}
+
+// hasGlobMeta reports whether s contains any of the characters that make a
+// glob pattern: *, ?, or [.
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// globMatcher collects the files matching a glob pattern.
+type globMatcher struct {
+	followSymlinks bool
+	visited        map[string]bool // Resolved paths of directories already searched by **
+	seen           map[string]bool // Files already matched, since ** can reach a file in several ways
+	files          []string
+}
+
+// globFiles expands a glob pattern into the files it matches, for shells that
+// leave quoted or unsupported patterns unexpanded. Each path segment is matched
+// like filepath.Match, and a segment of ** matches any number of directories,
+// including none, so "**/*.toml" matches every TOML file in the tree. Only
+// files are matched, never directories, and symbolic links are ignored unless
+// followSymlinks is set, as when walking a directory argument.
+//
+// Parameters:
+//   - pattern: The glob pattern, using / or the platform's separator
+//   - followSymlinks: Whether to match symlinked files and search symlinked directories
+//
+// Returns:
+//   - []string: The matching files, in lexical order
+//   - error: If the pattern is malformed or a directory cannot be read
+func globFiles(pattern string, followSymlinks bool) ([]string, error) {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	literal := 0 // Leading segments without glob characters name the directory to search from
+	for literal < len(segments) && !hasGlobMeta(segments[literal]) {
+		literal++
+	}
+	base := strings.Join(segments[:literal], "/")
+	switch {
+	case literal == 0:
+		base = "."
+	case base == "":
+		base = "/" // The pattern starts at the root directory
+	}
+	m := globMatcher{followSymlinks: followSymlinks, visited: map[string]bool{}, seen: map[string]bool{}}
+	if err := m.match(filepath.FromSlash(base), segments[literal:]); err != nil {
+		return nil, fmt.Errorf("expanding pattern '%s': %w", pattern, err)
+	}
+	slices.Sort(m.files)
+	return m.files, nil
+}
+
+// match adds the files under dir that match the remaining pattern segments.
+func (m *globMatcher) match(dir string, segments []string) error {
+	if segments[0] == "**" {
+		if len(segments) > 1 {
+			if err := m.match(dir, segments[1:]); err != nil { // ** matching no directories
+				return err
+			}
+		}
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil || m.visited[realDir] {
+			return nil // Missing, or already searched through another link
+		}
+		m.visited[realDir] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // Nothing to match in a directory that is not there
+	}
+	if err != nil {
+		return fmt.Errorf("reading directory '%s': %w", dir, err)
+	}
+	for _, entry := range entries {
+		entryPath := filepath.Join(dir, entry.Name())
+		mode := entry.Type()
+		if mode&fs.ModeSymlink != 0 {
+			if !m.followSymlinks {
+				continue // Links are not followed by default
+			}
+			info, err := os.Stat(entryPath)
+			if err != nil {
+				continue // A dangling link matches nothing
+			}
+			mode = info.Mode().Type()
+		}
+		if segments[0] == "**" {
+			if mode.IsDir() {
+				if err := m.match(entryPath, segments); err != nil { // ** matching one more directory
+					return err
+				}
+			} else if len(segments) == 1 {
+				m.add(entryPath, mode) // A trailing ** matches every file below
+			}
+			continue
+		}
+		matched, err := path.Match(segments[0], entry.Name())
+		if err != nil {
+			return err
+		}
+		switch {
+		case !matched:
+		case len(segments) == 1:
+			m.add(entryPath, mode)
+		case mode.IsDir():
+			if err := m.match(entryPath, segments[1:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add records a matched path if it is a file not matched before.
+func (m *globMatcher) add(file string, mode fs.FileMode) {
+	if !mode.IsRegular() || m.seen[file] {
+		return
+	}
+	m.seen[file] = true
+	m.files = append(m.files, file)
+}
+
+// expandFileArgs replaces every directory among the filename arguments with the
+// TOML files found under it, keeping the arguments' order. Like the go tool, a
+// directory may be written as "dir/..." (and "..." alone means "."). An argument
+// that does not exist but contains glob characters is expanded with globFiles,
+// and it is an error for it to match nothing. Other arguments are kept as given,
+// so a missing file is reported when it is opened. Symlinks that were skipped to
+// avoid a cycle are reported on stderr.
+//
+// Parameters:
+//   - args: Filename arguments from the command line
+//   - followSymlinks: Whether to follow symlinks inside directories
+//   - maxDepth: How many levels of subdirectories to descend into (negative for no limit)
+//
+// Returns:
+//   - []string: The files to format
+//   - error: If a directory cannot be read, or a pattern is malformed or matches nothing
+func expandFileArgs(args []string, followSymlinks bool, maxDepth int) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if arg == "..." {
+			arg = "."
+		} else if dir, ok := strings.CutSuffix(filepath.ToSlash(arg), "/..."); ok {
+			if dir == "" {
+				dir = "/" // "/..." is the root directory
+			}
+			arg = filepath.FromSlash(dir)
+		}
+		info, err := os.Stat(arg)
+		if err != nil && hasGlobMeta(arg) {
+			matches, err := globFiles(arg, followSymlinks)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match pattern '%s'", arg)
+			}
+			files = append(files, matches...)
+			continue
+		}
+		if err != nil || !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		result, err := walkTOMLFiles(arg, followSymlinks, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range result.skipped {
+			fmt.Fprintf(os.Stderr, "skipping symlink '%s': its directory was already visited\n", link)
+		}
+		for _, link := range result.broken {
+			fmt.Fprintf(os.Stderr, "skipping symlink '%s': its target does not exist\n", link)
+		}
+		files = append(files, result.files...)
+	}
+	return files, nil
+}
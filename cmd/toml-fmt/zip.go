@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/esacteksab/go-pretty-toml/internal/schema"
+)
+
+// isTOMLEntry reports whether a zip entry holds a TOML document, based on its extension.
+func isTOMLEntry(f *zip.File) bool {
+	return !f.FileInfo().IsDir() && strings.EqualFold(filepath.Ext(f.Name), ".toml")
+}
+
+// zipEntryResult is a formatted TOML entry of an archive.
+type zipEntryResult struct {
+	sourceName  string              // Description of the entry for messages
+	formatted   *bytes.Buffer       // The formatted content, with the BOM policy applied
+	diagnostics []schema.Diagnostic // Schema mismatches, reported after the output is written
+}
+
+// formatZipEntry reads a single TOML entry from an archive and formats it like
+// a file of its own with the same options.
+//
+// Parameters:
+//   - f: The zip entry to format
+//   - opts: Options for the archive (flags merged with any config file)
+//   - indentUnit: String used for each level of indentation
+//   - sortArrayTables: Whether [[array.table]] entries are sorted
+//   - docSchema: Schema to validate the entry against (nil to skip validation)
+//
+// Returns:
+//   - zipEntryResult: The formatted entry and its schema mismatches
+//   - error: Any error encountered reading, parsing, or formatting the entry
+func formatZipEntry(
+	f *zip.File,
+	opts cliOptions,
+	indentUnit string,
+	sortArrayTables bool,
+	docSchema schema.Schema,
+) (zipEntryResult, error) {
+	sourceName := fmt.Sprintf("entry '%s' in '%s'", f.Name, opts.zipPath) // Describe the entry for error messages
+
+	rc, err := f.Open() // Open the (possibly compressed) entry for reading
+	if err != nil {
+		return zipEntryResult{}, fmt.Errorf("opening %s: %w", sourceName, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	inputBytes, err := io.ReadAll(rc) // Read the whole entry
+	if err != nil {
+		return zipEntryResult{}, fmt.Errorf("reading %s: %w", sourceName, err)
+	}
+	inputBytes, inputHadBOM := stripBOM(inputBytes)
+
+	outputBuf, diagnostics, err := formatInput(opts, inputBytes, inputFormatTOML, sourceName, indentUnit, sortArrayTables, docSchema)
+	if err != nil {
+		return zipEntryResult{}, err
+	}
+	outputBuf = applyLineEnding(opts.lineEnding, inputBytes, outputBuf)
+	return zipEntryResult{
+		sourceName:  sourceName,
+		formatted:   applyBOMPolicy(opts.bomMode, inputHadBOM, outputBuf),
+		diagnostics: diagnostics,
+	}, nil
+}
+
+// formatZipArchive formats every TOML entry inside a zip archive. Without writeToFile,
+// each formatted entry is printed to stdout under a "==> name <==" header. With
+// writeToFile, a new archive is built in which TOML entries are replaced by their
+// formatted content and all other entries are copied through unchanged, and it
+// atomically replaces the original archive. Entries are formatted with the same
+// options as a file would be, and schema mismatches are reported once the output
+// is written.
+//
+// Parameters:
+//   - opts: Options for the archive (flags merged with any config file), including its path and -w
+//   - docSchema: Schema to validate each entry against (nil to skip validation)
+//
+// Returns:
+//   - error: Any error encountered during processing, or nil on success
+func formatZipArchive(opts cliOptions, docSchema schema.Schema) error {
+	indentUnit, sortArrayTables, err := documentSettings(opts)
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Clean(opts.zipPath) // Clean the path like regular file input
+	opts.zipPath = archivePath
+	reader, err := zip.OpenReader(archivePath) // Open the archive and read its directory
+	if err != nil {
+		return fmt.Errorf("opening zip archive '%s': %w", archivePath, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	var entries []zipEntryResult // Formatted entries, whose schema mismatches are reported last
+	if !opts.writeToFile {
+		// Print each formatted TOML entry to stdout
+		for _, f := range reader.File {
+			if !isTOMLEntry(f) {
+				continue // Only TOML entries are shown
+			}
+			entry, err := formatZipEntry(f, opts, indentUnit, sortArrayTables, docSchema)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				fmt.Fprintln(os.Stdout) // Blank line between entries
+			}
+			entries = append(entries, entry)
+			fmt.Fprintf(os.Stdout, "==> %s <==\n", f.Name) // Header naming the entry
+			if _, err := entry.formatted.WriteTo(os.Stdout); err != nil {
+				return fmt.Errorf("writing to stdout: %w", err)
+			}
+		}
+		return reportZipDiagnostics(entries)
+	}
+
+	// Build the new archive in memory, preserving entry order and metadata
+	var archiveBuf bytes.Buffer
+	writer := zip.NewWriter(&archiveBuf)
+	for _, f := range reader.File {
+		if !isTOMLEntry(f) {
+			// Copy non-TOML entries through without recompressing them
+			if err := writer.Copy(f); err != nil {
+				return fmt.Errorf("copying entry '%s' in '%s': %w", f.Name, archivePath, err)
+			}
+			continue
+		}
+		entry, err := formatZipEntry(f, opts, indentUnit, sortArrayTables, docSchema)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		header := f.FileHeader // Keep name, method, timestamps, and attributes
+		entryWriter, err := writer.CreateHeader(&header)
+		if err != nil {
+			return fmt.Errorf("creating entry '%s' in '%s': %w", f.Name, archivePath, err)
+		}
+		if _, err := entry.formatted.WriteTo(entryWriter); err != nil {
+			return fmt.Errorf("writing entry '%s' in '%s': %w", f.Name, archivePath, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("finalizing zip archive '%s': %w", archivePath, err)
+	}
+	_ = reader.Close() // Release the original archive before it is replaced
+
+	// Replace the original archive using the same atomic write as regular files
+	if err := writeOutput(true, archivePath, &archiveBuf); err != nil {
+		return err
+	}
+	return reportZipDiagnostics(entries)
+}
+
+// reportZipDiagnostics prints the schema mismatches of each entry to stderr.
+//
+// Parameters:
+//   - entries: The formatted entries of an archive
+//
+// Returns:
+//   - error: If any entry does not match the schema, or nil
+func reportZipDiagnostics(entries []zipEntryResult) error {
+	var errs []error
+	for _, entry := range entries {
+		if err := reportDiagnostics(entry.sourceName, entry.diagnostics); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
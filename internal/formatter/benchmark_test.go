@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+// largeDocument builds a synthetic document of tables with a mix of value types,
+// similar to generated configuration, whose formatted size grows with n.
+func largeDocument(n int) map[string]any {
+	services := make(map[string]any, n)
+	for i := range n {
+		services[fmt.Sprintf("service%05d", i)] = map[string]any{
+			"name":     fmt.Sprintf("service number %d", i),
+			"port":     int64(8000 + i),
+			"enabled":  i%2 == 0,
+			"ratio":    float64(i) / 7,
+			"tags":     []any{"alpha", "beta", fmt.Sprintf("tag%d", i)},
+			"replicas": []any{map[string]any{"zone": "a", "weight": int64(1)}, map[string]any{"zone": "b", "weight": int64(2)}},
+		}
+	}
+	return map[string]any{"title": "generated", "services": services}
+}
+
+// BenchmarkFormatLargeDocument compares assembling the whole document in memory
+// (FormatWithOptions) with streaming it (StreamWithOptions). Run with -benchmem:
+// the bytes allocated per operation show what streaming saves.
+func BenchmarkFormatLargeDocument(b *testing.B) {
+	data := largeDocument(5000)
+	opts := DefaultOptions()
+	opts.IndentUnit = "  "
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := FormatWithOptions(data, opts, io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := StreamWithOptions(data, opts, io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// deepDocument builds a chain of depth nested tables, each holding a few scalar
+// keys next to the table below it.
+func deepDocument(depth int) map[string]any {
+	root := map[string]any{}
+	current := root
+	for i := range depth {
+		current["id"] = int64(i)
+		current["name"] = fmt.Sprintf("level %d", i)
+		current["enabled"] = true
+		next := map[string]any{}
+		current[fmt.Sprintf("level%03d", i)] = next
+		current = next
+	}
+	current["leaf"] = "end"
+	return root
+}
+
+// wideDocument builds a single table with n scalar keys.
+func wideDocument(n int) map[string]any {
+	table := make(map[string]any, n)
+	for i := range n {
+		table[fmt.Sprintf("key%05d", i)] = fmt.Sprintf("value %d", i)
+	}
+	return map[string]any{"settings": table}
+}
+
+// BenchmarkFormatDeepNesting measures the per-level cost of recursing through
+// nested tables, where paths and key categories are rebuilt at every level.
+func BenchmarkFormatDeepNesting(b *testing.B) {
+	data := deepDocument(200)
+	opts := DefaultOptions()
+	opts.IndentUnit = "  "
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := StreamWithOptions(data, opts, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFormatWideTable measures the per-key cost within one table.
+func BenchmarkFormatWideTable(b *testing.B) {
+	data := wideDocument(10000)
+	opts := DefaultOptions()
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := StreamWithOptions(data, opts, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MIT
+
+package formatter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// DuplicateKeyError reports a key or table that a document defines more than
+// once, such as a = 1 followed by "a" = 2, or a second [table] header for the
+// same table. Both definitions name the same key once quotes are removed, so
+// decoding would have to drop one of them.
+type DuplicateKeyError struct {
+	Key       string // Dotted path of the key or table, without quotes
+	Line      int    // Line of the conflicting definition
+	FirstLine int    // Line of the earlier definition it conflicts with
+}
+
+// Error implements the error interface.
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("line %d: key '%s' is already defined at line %d", e.Line, e.Key, e.FirstLine)
+}
+
+// definitionKind says how a key or table came to exist, which decides what may
+// define it again.
+type definitionKind int
+
+const (
+	definedByHeaderPrefix definitionKind = iota // A table named only as a prefix of a header, like a in [a.b]
+	definedByHeader                             // A table with its own [header]
+	definedByDottedKey                          // A table named as a prefix of a dotted key, like a in a.b = 1
+	definedByValue                              // A key with a value, including inline tables and arrays
+	definedByArrayTable                         // An array of tables, from [[header]]
+)
+
+// definition records how and where a key or table was first defined.
+type definition struct {
+	kind definitionKind
+	line int
+}
+
+// duplicateChecker tracks the definitions seen while scanning a document.
+type duplicateChecker struct {
+	parser  *unstable.Parser
+	defined map[string]definition // Definitions by entry path
+	entries entryTracker
+}
+
+// CheckDuplicateKeys scans TOML source text for keys and tables that are
+// defined more than once, which the decoder rejects without saying where.
+// Keys match once their quotes are removed, so a and "a" are the same key;
+// keys that differ only in case are distinct in TOML and are not reported.
+//
+// Parameters:
+//   - input: Raw TOML document (without a BOM)
+//
+// Returns:
+//   - error: A *DuplicateKeyError for the first conflicting definition, an
+//     error if the document cannot be parsed, or nil
+func CheckDuplicateKeys(input []byte) error {
+	parser := unstable.Parser{}
+	parser.Reset(input)
+	c := duplicateChecker{
+		parser:  &parser,
+		defined: map[string]definition{},
+		entries: entryTracker{arrays: map[string]bool{}, counts: map[string]int{}},
+	}
+	var tablePath []string  // Path of the most recent [table] or [[array.table]] header
+	var tableEntry []string // Entry path of the most recent header
+	for parser.NextExpression() {
+		expr := parser.Expression()
+		var err error
+		switch expr.Kind {
+		case unstable.Table:
+			if tablePath, err = c.header(expr.Key()); err == nil {
+				tableEntry = c.entries.entryPath(tablePath)
+			}
+		case unstable.ArrayTable:
+			if tablePath, err = c.arrayTableHeader(expr.Key()); err == nil {
+				tableEntry = c.entries.newEntry(tablePath)
+			}
+		case unstable.KeyValue:
+			err = c.keyValue(tablePath, tableEntry, expr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := parser.Error(); err != nil {
+		return fmt.Errorf("scanning TOML source: %w", err)
+	}
+	return nil
+}
+
+// header records a [table] header and returns its table path.
+func (c *duplicateChecker) header(key unstable.Iterator) ([]string, error) {
+	path, line := c.keyPath(key)
+	if err := c.headerPrefixes(path, line); err != nil {
+		return nil, err
+	}
+	// The last segment is looked up without an entry index, so that [a] after [[a]] clashes
+	parent := c.entries.entryPath(path[:len(path)-1])
+	entry := pathKey(append(parent, path[len(path)-1]))
+	if prev, ok := c.defined[entry]; ok && prev.kind != definedByHeaderPrefix {
+		return nil, c.conflict(path, line, prev)
+	}
+	c.defined[entry] = definition{kind: definedByHeader, line: line}
+	return path, nil
+}
+
+// arrayTableHeader records an [[array.table]] header and returns its table path.
+func (c *duplicateChecker) arrayTableHeader(key unstable.Iterator) ([]string, error) {
+	path, line := c.keyPath(key)
+	if err := c.headerPrefixes(path, line); err != nil {
+		return nil, err
+	}
+	parent := c.entries.entryPath(path[:len(path)-1])
+	entry := pathKey(append(parent, path[len(path)-1]))
+	prev, ok := c.defined[entry]
+	if ok && prev.kind != definedByArrayTable {
+		return nil, c.conflict(path, line, prev)
+	}
+	if !ok {
+		c.defined[entry] = definition{kind: definedByArrayTable, line: line}
+	}
+	return path, nil
+}
+
+// headerPrefixes records the tables a header names on its way to the last
+// segment; only a key with a value cannot be extended by a header.
+func (c *duplicateChecker) headerPrefixes(path []string, line int) error {
+	for i := 1; i < len(path); i++ {
+		entry := pathKey(c.entries.entryPath(path[:i]))
+		prev, ok := c.defined[entry]
+		if !ok {
+			c.defined[entry] = definition{kind: definedByHeaderPrefix, line: line}
+			continue
+		}
+		if prev.kind == definedByValue {
+			return c.conflict(path[:i], line, prev)
+		}
+	}
+	return nil
+}
+
+// keyValue records a key/value expression of the table at tablePath, along
+// with the keys of an inline table value.
+func (c *duplicateChecker) keyValue(tablePath, tableEntry []string, kv *unstable.Node) error {
+	keyPath, line := c.keyPath(kv.Key())
+	path := append(append([]string{}, tablePath...), keyPath...)
+	entry := append(append([]string{}, tableEntry...), keyPath...)
+	// Tables named by a dotted key can only be extended by more dotted keys
+	for i := len(tableEntry) + 1; i < len(entry); i++ {
+		prev, ok := c.defined[pathKey(entry[:i])]
+		if !ok {
+			c.defined[pathKey(entry[:i])] = definition{kind: definedByDottedKey, line: line}
+			continue
+		}
+		if prev.kind != definedByDottedKey {
+			return c.conflict(path[:i], line, prev) // Entry paths and table paths have the same length
+		}
+	}
+	if prev, ok := c.defined[pathKey(entry)]; ok {
+		return c.conflict(path, line, prev)
+	}
+	c.defined[pathKey(entry)] = definition{kind: definedByValue, line: line}
+
+	value := kv.Value()
+	if value.Kind != unstable.InlineTable {
+		return nil
+	}
+	it := value.Children()
+	for it.Next() {
+		if child := it.Node(); child.Kind == unstable.KeyValue {
+			if err := c.keyValue(path, entry, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keyPath returns the unquoted parts of a (possibly dotted) key and the line it starts on.
+func (c *duplicateChecker) keyPath(key unstable.Iterator) ([]string, int) {
+	var parts []string
+	line := 0
+	for key.Next() {
+		part := key.Node()
+		if line == 0 {
+			line = c.parser.Shape(part.Raw).Start.Line
+		}
+		parts = append(parts, string(part.Data))
+	}
+	return parts, line
+}
+
+// conflict returns the error for a definition of path at line that clashes with prev.
+func (c *duplicateChecker) conflict(path []string, line int, prev definition) error {
+	return &DuplicateKeyError{Key: strings.Join(path, "."), Line: line, FirstLine: prev.line}
+}
@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"errors"
+	"testing"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+func TestCheckDuplicateKeys(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		wantKey       string // "" when the document is valid
+		wantLine      int
+		wantFirstLine int
+	}{
+		{
+			name:  "distinct keys",
+			input: "a = 1\nb = 2\n[t]\na = 3\n",
+		},
+		{
+			name:  "keys differing only in case are distinct",
+			input: "key = 1\nKey = 2\nKEY = 3\n",
+		},
+		{
+			name:  "header names a table created by an earlier header",
+			input: "[a.b]\nx = 1\n[a]\ny = 2\n",
+		},
+		{
+			name:  "sub-table of a table created by dotted keys",
+			input: "[fruit]\napple.color = \"red\"\napple.taste.sweet = true\n[fruit.apple.texture]\nsmooth = true\n",
+		},
+		{
+			name:  "dotted keys extending each other",
+			input: "a.b = 1\na.c = 2\na.d.e = 3\n",
+		},
+		{
+			name:  "array of tables entries and their sub-tables",
+			input: "[[a]]\nx = 1\n[a.b]\ny = 1\n[[a]]\nx = 2\n[a.b]\ny = 2\n",
+		},
+		{
+			name:          "bare and quoted key",
+			input:         "a = 1\n\"a\" = 2\n",
+			wantKey:       "a",
+			wantLine:      2,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "bare and literal key in a table",
+			input:         "[t]\nname = 1\n\n'name' = 2\n",
+			wantKey:       "t.name",
+			wantLine:      4,
+			wantFirstLine: 2,
+		},
+		{
+			name:          "table header repeated",
+			input:         "[t]\nx = 1\n[u]\n[\"t\"]\ny = 2\n",
+			wantKey:       "t",
+			wantLine:      4,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "header for a table created by dotted keys",
+			input:         "a.b = 1\n[a]\nc = 2\n",
+			wantKey:       "a",
+			wantLine:      2,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "dotted key into a table created by a header",
+			input:         "[a.b.c]\nz = 9\n[a]\nb.c.t = 1\n",
+			wantKey:       "a.b",
+			wantLine:      4,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "value then dotted key through it",
+			input:         "a = 1\na.b = 2\n",
+			wantKey:       "a",
+			wantLine:      2,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "header through a key with a value",
+			input:         "a = { x = 1 }\n[a.b]\ny = 2\n",
+			wantKey:       "a",
+			wantLine:      2,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "key inside an inline table repeated",
+			input:         "a = 0\npoint = { x = 1, y = 2, \"x\" = 3 }\n",
+			wantKey:       "point.x",
+			wantLine:      2,
+			wantFirstLine: 2,
+		},
+		{
+			name:          "table after an array of tables of the same name",
+			input:         "[[a]]\nx = 1\n[a]\ny = 2\n",
+			wantKey:       "a",
+			wantLine:      3,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "array of tables after a table of the same name",
+			input:         "[a]\nx = 1\n[[a]]\ny = 2\n",
+			wantKey:       "a",
+			wantLine:      3,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "array of tables after a static array",
+			input:         "a = [{ x = 1 }]\n[[a]]\nx = 2\n",
+			wantKey:       "a",
+			wantLine:      2,
+			wantFirstLine: 1,
+		},
+		{
+			name:          "key repeated within one array of tables entry",
+			input:         "[[a]]\nx = 1\n[[a]]\nx = 2\nx = 3\n",
+			wantKey:       "a.x",
+			wantLine:      5,
+			wantFirstLine: 4,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckDuplicateKeys([]byte(tc.input))
+			var data map[string]any
+			decodeErr := toml.Unmarshal([]byte(tc.input), &data)
+			if tc.wantKey == "" {
+				if err != nil {
+					t.Fatalf("CheckDuplicateKeys() returned unexpected error: %v", err)
+				}
+				if decodeErr != nil {
+					t.Fatalf("invalid test input: %v", decodeErr)
+				}
+				return
+			}
+			if decodeErr == nil {
+				t.Fatalf("test input decodes without error, so it has no duplicate")
+			}
+			var dupErr *DuplicateKeyError
+			if !errors.As(err, &dupErr) {
+				t.Fatalf("CheckDuplicateKeys() error = %v, want a *DuplicateKeyError", err)
+			}
+			if dupErr.Key != tc.wantKey || dupErr.Line != tc.wantLine || dupErr.FirstLine != tc.wantFirstLine {
+				t.Errorf("CheckDuplicateKeys() = key %q line %d (first %d), want key %q line %d (first %d)",
+					dupErr.Key, dupErr.Line, dupErr.FirstLine, tc.wantKey, tc.wantLine, tc.wantFirstLine)
+			}
+		})
+	}
+}
+
+func TestCheckDuplicateKeysInvalidTOML(t *testing.T) {
+	if err := CheckDuplicateKeys([]byte("a = \n")); err == nil {
+		t.Fatal("CheckDuplicateKeys() returned no error for invalid TOML")
+	}
+}
@@ -4,14 +4,344 @@ package formatter
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// SortMode controls the order in which keys of a table are emitted.
+type SortMode string
+
+const (
+	// SortAscending emits keys in alphabetical order.
+	SortAscending SortMode = "asc"
+	// SortNone keeps the order in which keys were declared in the source document.
+	// It requires Options.Source; without it keys fall back to alphabetical order.
+	SortNone SortMode = "none"
+	// SortGroupOnly keeps the source order within each group but still emits
+	// simple keys, then arrays of tables, then tables, as SortAscending does.
+	// Like SortNone it requires Options.Source.
+	SortGroupOnly SortMode = "group-only"
+)
+
+// keepsSourceOrder reports whether keys within a group keep their source order.
+func (m SortMode) keepsSourceOrder() bool {
+	return m == SortNone || m == SortGroupOnly
+}
+
+// SectionOrder controls the order of the [table] and [[array.table]] sections
+// that follow a table's simple keys. The simple keys themselves always come
+// first, because TOML assigns keys written after a header to that header's table.
+type SectionOrder string
+
+const (
+	// SectionArrayTablesFirst writes arrays of tables before tables.
+	SectionArrayTablesFirst SectionOrder = "array-tables-first"
+	// SectionTablesFirst writes tables before arrays of tables.
+	SectionTablesFirst SectionOrder = "tables-first"
+)
+
+// IndentMode controls which lines Options.IndentUnit indents: the headers of
+// nested tables, the key/value lines below each header, or both.
+type IndentMode string
+
+const (
+	// IndentNested indents each table one level deeper than its parent, and its
+	// key/value lines one level deeper than its header.
+	IndentNested IndentMode = "nested"
+	// IndentTablesOnly indents the headers of nested tables by their depth, and
+	// writes key/value lines flush with the header of their table.
+	IndentTablesOnly IndentMode = "tables-only"
+	// IndentEntriesOnly writes every header flush-left, and indents key/value
+	// lines one level relative to their header.
+	IndentEntriesOnly IndentMode = "entries-only"
 )
 
+// headerIndent returns the indentation of the headers of the tables nested in a
+// table whose depth indentation (one IndentUnit per level) is depthIndent.
+func (m IndentMode) headerIndent(depthIndent string) string {
+	if m == IndentEntriesOnly {
+		return ""
+	}
+	return depthIndent
+}
+
+// entryIndent returns the indentation of the key/value lines of a table whose
+// depth indentation is depthIndent; the root table's lines are never indented.
+func (m IndentMode) entryIndent(depthIndent, unit string, root bool) string {
+	switch {
+	case root:
+		return depthIndent
+	case m == IndentTablesOnly:
+		return strings.TrimSuffix(depthIndent, unit) // Flush with the table's own header
+	case m == IndentEntriesOnly:
+		return unit
+	}
+	return depthIndent
+}
+
+// MultilineMode controls when string values are written as multi-line basic strings.
+type MultilineMode string
+
+const (
+	// MultilineNever always writes single-line basic strings, escaping newlines as \n.
+	MultilineNever MultilineMode = "never"
+	// MultilineWhenNewlines writes strings that contain a newline as """...""" blocks
+	// that keep their interior line breaks.
+	MultilineWhenNewlines MultilineMode = "newlines"
+)
+
+// StringStyle controls whether single-line strings are written as basic "..."
+// or literal '...' strings. A string that cannot be a literal string, because it
+// contains a single quote or a control character other than a tab, is always
+// written as a basic string.
+type StringStyle string
+
+const (
+	// StringAuto writes a string with backslashes as a literal string when it can,
+	// so that paths and regular expressions read as written, and every other
+	// string as a basic string.
+	StringAuto StringStyle = "auto"
+	// StringBasic writes every string as a basic string.
+	StringBasic StringStyle = "basic"
+	// StringLiteral writes every string that can be one as a literal string.
+	StringLiteral StringStyle = "literal"
+	// StringPreserve keeps the style each string had in Options.Source. Strings
+	// inside arrays, and strings not found in the source, are written as with StringAuto.
+	StringPreserve StringStyle = "preserve"
+)
+
+// FloatFormat controls the notation used for float values.
+type FloatFormat string
+
+const (
+	// FloatShortest writes the shortest text that reads back as the same float,
+	// switching to exponent notation for large and small magnitudes (from 1e+06
+	// up and below 1e-04).
+	FloatShortest FloatFormat = "shortest"
+	// FloatDecimal always writes plain decimal notation, such as 1000000000000000000000.0
+	// or 0.00001, never an exponent.
+	FloatDecimal FloatFormat = "decimal"
+	// FloatExponent always writes exponent notation, such as 1.5e+00 or 1e-05.
+	FloatExponent FloatFormat = "exponent"
+)
+
+// SeparatorPolicy sets how many blank lines precede a [table] or [[array.table]]
+// header, depending on what was emitted just before it. "Keys" means the simple
+// key/value pairs of the enclosing table; a table or array table means either the
+// header of the enclosing table (when it has no simple keys) or the previous
+// sibling section. Nothing is ever written before the first line of the document.
+type SeparatorPolicy struct {
+	KeysToArrayTable       int // Simple keys followed by an [[array.table]]
+	KeysToTable            int // Simple keys followed by a [table]
+	ArrayTableToArrayTable int // An [[array.table]] followed by another, including the next entry of the same array
+	ArrayTableToTable      int // An [[array.table]] followed by a [table]
+	TableToArrayTable      int // A [table] followed by an [[array.table]]
+	TableToTable           int // A [table] followed by another [table]
+}
+
+// DefaultSeparatorPolicy returns the policy used by DefaultOptions: a single
+// blank line before every header except the first line of the document.
+func DefaultSeparatorPolicy() SeparatorPolicy {
+	return SeparatorPolicy{
+		KeysToArrayTable:       1,
+		KeysToTable:            1,
+		ArrayTableToArrayTable: 1,
+		ArrayTableToTable:      1,
+		TableToArrayTable:      1,
+		TableToTable:           1,
+	}
+}
+
+// sectionKind identifies what was emitted before a header, for SeparatorPolicy.
+type sectionKind int
+
+const (
+	kindDocumentStart sectionKind = iota // Nothing has been emitted yet
+	kindKeys                             // Simple key/value pairs
+	kindTable                            // A [table] header or section
+	kindArrayTable                       // An [[array.table]] header or entry
+)
+
+// blankLines returns the number of blank lines to write between prev and a header of kind next.
+func (p SeparatorPolicy) blankLines(prev, next sectionKind) int {
+	var n int
+	switch prev {
+	case kindKeys:
+		n = p.KeysToTable
+		if next == kindArrayTable {
+			n = p.KeysToArrayTable
+		}
+	case kindArrayTable:
+		n = p.ArrayTableToTable
+		if next == kindArrayTable {
+			n = p.ArrayTableToArrayTable
+		}
+	case kindTable:
+		n = p.TableToTable
+		if next == kindArrayTable {
+			n = p.TableToArrayTable
+		}
+	}
+	return max(n, 0) // The document start never gets a separator, and negative counts mean none
+}
+
+// Options controls how a TOML document is rendered by FormatWithOptions.
+// Use DefaultOptions to obtain the standard settings and adjust from there.
+type Options struct {
+	// IndentUnit is the string used for each level of indentation (e.g. "" or "  ").
+	IndentUnit string
+	// IndentMode selects which lines IndentUnit indents. The zero value behaves
+	// like IndentNested.
+	IndentMode IndentMode
+	// QuoteAmbiguousKeys quotes bare keys that read like values, such as
+	// true, false, inf, nan, or numeric-looking keys like 123.
+	QuoteAmbiguousKeys bool
+	// SortKeys selects alphabetical or source order for keys within each group.
+	// Simple keys are always emitted before the tables of the same table.
+	SortKeys SortMode
+	// SectionOrder selects whether arrays of tables or tables come first after
+	// the simple keys. The zero value behaves like SectionArrayTablesFirst. It has
+	// no effect with SortNone, which keeps sections in their source order.
+	SectionOrder SectionOrder
+	// Source carries information from the original document, such as key order.
+	// It may be nil when formatting programmatically built data. It also carries
+	// the "# tomlfmt:ignore" directives of the document: a key below one is written
+	// exactly as in the source and takes no part in alignment, and the keys of a
+	// table whose header has one are all written that way, in source order, with
+	// the blank lines between them kept as with PreserveBlankLines.
+	Source *SourceInfo
+	// SortArrayTables reorders the entries of every array of tables. By default
+	// entries keep their source order, which is usually significant.
+	SortArrayTables bool
+	// ArrayTableSortField, when set with SortArrayTables, sorts entries by the value
+	// of this key. Entries without the key keep their relative order after the rest.
+	// When empty, entries are sorted by their content: their key/value pairs in
+	// alphabetical key order.
+	ArrayTableSortField string
+	// MultilineStrings selects when the value of a key is written as a multi-line
+	// basic string. Strings inside arrays are always written on one line. The zero
+	// value behaves like MultilineNever.
+	MultilineStrings MultilineMode
+	// Annotations maps dotted key paths (e.g. "server.port") to text emitted as a
+	// trailing "# ..." comment on that key's line, or on the header line of the
+	// table or array of tables at that path (on every entry of an array). A comment
+	// kept from the source takes precedence over an annotation for the same line.
+	Annotations map[string]string
+	// Separators controls the blank lines written before table and array table headers.
+	Separators SeparatorPolicy
+	// GroupKeysByValueType emits the simple keys of each table in groups by the
+	// kind of their value: scalars first, then arrays, then inline tables. Each
+	// group keeps the order selected by SortKeys, and values stay aligned across groups.
+	GroupKeysByValueType bool
+	// InlineTableMaxKeys, when positive, writes tables with at most this many keys
+	// as inline tables ({ x = 1, y = 2 }) on their key's line, provided they hold
+	// no nested tables or arrays of tables. Tables written inline in opts.Source
+	// always stay inline. Zero expands every other table into a [section].
+	InlineTableMaxKeys int
+	// PreserveKeyQuotes writes keys and header segments exactly as they were
+	// written in opts.Source, keeping quotes around keys that would be valid bare
+	// keys ("name" stays "name"). Keys not found in the source are quoted only as needed.
+	PreserveKeyQuotes bool
+	// PreserveBlankLines keeps the groups of simple keys that blank lines separate
+	// in opts.Source: keys stay in the group they were declared in, ordered by
+	// SortKeys within it, and one blank line is written between groups, however
+	// many the source had. Keys not found in the source join the last group.
+	PreserveBlankLines bool
+	// StringStyle selects basic "..." or literal '...' quoting for single-line
+	// strings. The zero value behaves like StringAuto.
+	StringStyle StringStyle
+	// ForceBasicStrings writes every single-line string as a basic "..." string,
+	// whatever StringStyle says.
+	//
+	// Deprecated: Set StringStyle to StringBasic instead.
+	ForceBasicStrings bool
+	// CollapseTableChains writes a chain of tables that each hold a single key as
+	// one dotted key (a.b.c = 1) instead of a [header] per level, when the chain
+	// has at least one table holding nothing but the next table. Tables with
+	// several keys, or with comments on their headers, keep their headers.
+	CollapseTableChains bool
+	// FloatFormat selects the notation of float values. The zero value behaves
+	// like FloatShortest.
+	FloatFormat FloatFormat
+	// AlignValues pads the keys of each table so that their "=" signs line up.
+	// When false, every key is followed by a single " = ".
+	AlignValues bool
+	// MaxLineWidth, when positive, is the width in characters beyond which an
+	// array value is written with one element per line, and an inline table is
+	// written as a [table] under its own header instead. Zero means no limit.
+	MaxLineWidth int
+	// TrailingComma writes a comma after the last element of arrays written with
+	// one element per line. Arrays on a single line never get one.
+	TrailingComma bool
+	// FinalNewlines is the exact number of newlines that end non-empty output.
+	// Negative values are treated as zero. Empty documents are always emitted as zero bytes.
+	FinalNewlines int
+	// MaxNestingDepth is the deepest level of nested tables that is formatted,
+	// counting the tables of the root table as level 1; deeper documents are an
+	// error instead of a stack overflow. The zero value behaves like
+	// DefaultMaxNestingDepth, and a negative value sets no limit.
+	MaxNestingDepth int
+}
+
+// DefaultMaxNestingDepth is the nesting limit used when Options.MaxNestingDepth
+// is zero. Real documents stay far below it.
+const DefaultMaxNestingDepth = 1000
+
+// nestingDepthError reports a table nested deeper than Options.MaxNestingDepth.
+type nestingDepthError struct {
+	path  []string // Path of the first table beyond the limit
+	limit int
+}
+
+// Error implements the error interface, naming only the start of the path,
+// which may be thousands of segments long.
+func (e *nestingDepthError) Error() string {
+	name := strings.Join(e.path, ".")
+	if len(e.path) > 3 {
+		name = strings.Join(e.path[:3], ".") + "..."
+	}
+	return fmt.Sprintf("table '%s' is nested more than %d levels deep", name, e.limit)
+}
+
+// maxNestingDepth returns the nesting limit to enforce, or -1 for none.
+func (o Options) maxNestingDepth() int {
+	switch {
+	case o.MaxNestingDepth == 0:
+		return DefaultMaxNestingDepth
+	case o.MaxNestingDepth < 0:
+		return -1
+	}
+	return o.MaxNestingDepth
+}
+
+// DefaultOptions returns the options used by the toml-fmt CLI when no flags are given:
+// no indentation, minimal key quoting, alphabetical keys, aligned values, and a
+// single trailing newline. It sets no line width limit, while the CLI defaults to
+// --max-line-width=80.
+func DefaultOptions() Options {
+	return Options{
+		SortKeys:         SortAscending,
+		SectionOrder:     SectionArrayTablesFirst,
+		AlignValues:      true,
+		MultilineStrings: MultilineNever,
+		FloatFormat:      FloatShortest,
+		StringStyle:      StringAuto,
+		Separators:       DefaultSeparatorPolicy(),
+		FinalNewlines:    1,
+	}
+}
+
 // Format takes a map representing parsed TOML data and writes it to the provided
 // output writer with proper formatting including alignment of values and optional
 // indentation. Keys are sorted alphabetically and grouped by type.
@@ -22,88 +352,950 @@ import (
 //   - output: Writer where formatted TOML will be written (io.Writer)
 //
 // Returns:
-//   - error: If any formatting operation fails
+//   - error: If output is nil or any formatting operation fails
+//
+// Deprecated: Use FormatWithOptions with DefaultOptions and IndentUnit set instead.
 func Format(data map[string]any, indentUnit string, output io.Writer) error {
-	var internalBuf bytes.Buffer // Use a buffer to accumulate the formatted output
+	opts := DefaultOptions()
+	opts.IndentUnit = indentUnit
+	return FormatWithOptions(data, opts, output)
+}
+
+// FormatWithOptions behaves like Format but takes the full set of formatting
+// options instead of only the indentation unit. With opts.SortKeys set to SortNone
+// and opts.Source provided, keys keep their source order and tables and arrays of
+// tables are emitted in the order they were declared; with SortGroupOnly keys
+// keep their source order within each group. Whenever opts.Source is
+// provided, the comments it recorded are re-emitted around their keys and headers.
+// The document is assembled in memory and written only if formatting succeeds;
+// see StreamWithOptions for output that is written as it is produced.
+//
+// Parameters:
+//   - data: Map representing parsed TOML data structure (map[string]interface{})
+//   - opts: Options controlling indentation, key rendering, and trailing newlines
+//   - output: Writer where formatted TOML will be written (io.Writer)
+//
+// Returns:
+//   - error: If output is nil or any formatting operation fails
+func FormatWithOptions(data map[string]any, opts Options, output io.Writer) error {
+	if output == nil {
+		return errors.New("output writer must not be nil") // Fail before doing any work rather than panic at the end
+	}
+	var buf bytes.Buffer // Hold the document so that nothing is written on error
+	if err := StreamWithOptions(data, opts, &buf); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(output)
+	return err
+}
+
+// StreamWithOptions behaves like FormatWithOptions but writes the document to
+// output while it is being formatted, through a small buffer, instead of
+// assembling it in memory first. Memory use then stays flat however large the
+// document is, but if formatting fails part of the document may already have
+// been written.
+//
+// Parameters:
+//   - data: Map representing parsed TOML data structure (map[string]interface{})
+//   - opts: Options controlling indentation, key rendering, and trailing newlines
+//   - output: Writer the formatted TOML is streamed to
+//
+// Returns:
+//   - error: If output is nil, any formatting operation fails, or writing fails
+func StreamWithOptions(data map[string]any, opts Options, output io.Writer) error {
+	if output == nil {
+		return errors.New("output writer must not be nil")
+	}
+	// Trailing whitespace is never meaningful outside strings, and multi-line
+	// strings escape theirs, so it is stripped from every line as it is written,
+	// and the end of the document is normalized to exactly opts.FinalNewlines newlines
+	doc := newDocWriter(output, opts.FinalNewlines)
+	// The comment block opening the document stays on top, set apart by a blank line
+	if header := opts.Source.headerComments(); len(header) > 0 {
+		writeLeadingComments(header, "", doc)
+		if len(data) > 0 {
+			doc.WriteString("\n")
+		}
+	}
 	// Start with an empty path for the root map. The path represents the nested structure of the TOML file.
-	err := formatMap(data, []string{}, "", indentUnit, &internalBuf)
+	err := formatMap(data, []string{}, []string{}, "", kindDocumentStart, opts, doc)
 	if err != nil {
 		return err
 	}
-	// Write the content of the buffer to the output writer
-	_, err = internalBuf.WriteTo(output)
-	return err
+	// Comments that followed the last key or header close the document
+	writeLeadingComments(opts.Source.footerComments(), "", doc)
+	return doc.finish()
 }
 
 // formatTomlValue converts a Go value to its TOML string representation.
-// Handles strings, integers, floats, booleans, times, nil values, and arrays.
+// Handles strings, integers, floats, booleans, offset and local date-times, local
+// dates, local times, and arrays; nil values are rejected because TOML has no null,
+// and values of any other type are rejected with an error naming the type.
+// Numbers are rendered with the fmt/strconv verbs, which never consult the
+// process locale (LC_ALL, LANG, ...): output never contains thousands
+// separators and always uses '.' as the decimal point.
+// Floats are written in their shortest form and strings as basic strings; see
+// formatTomlValueWith.
 //
 // Parameters:
 //   - v: The Go value to be converted to a TOML string
 //
 // Returns:
 //   - string: TOML string representation of the value
-func formatTomlValue(v any) string {
+//   - error: If the value cannot be represented inline (e.g. a table nested in an array value)
+func formatTomlValue(v any) (string, error) {
+	return formatTomlValueWith(v, Options{FloatFormat: FloatShortest, StringStyle: StringBasic})
+}
+
+// formatTomlValueWith is formatTomlValue with floats, including those inside
+// arrays, written in the notation of opts.FloatFormat, and strings quoted in the
+// style of opts.StringStyle.
+func formatTomlValueWith(v any, opts Options) (string, error) {
 	switch val := v.(type) {
 	case string:
-		return fmt.Sprintf("%q", val) // Quote strings
-	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-		return fmt.Sprintf("%d", val) // Format integers
-	case float32, float64:
-		return fmt.Sprintf("%g", val) // Format floats using compact representation ("g" format is shortest representation)
+		return quoteString(val, opts.stringStyle()), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil // The type TOML decodes integers to, so skip fmt
+	case int, int8, int16, int32, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", val), nil // Format integers
+	case float32:
+		return formatFloat(float64(val), 32, opts.FloatFormat), nil // Digits that read back as the same float32
+	case float64:
+		return formatFloat(val, 64, opts.FloatFormat), nil
 	case bool:
-		return strconv.FormatBool(val) // Convert boolean to "true" or "false"
+		return strconv.FormatBool(val), nil // Convert boolean to "true" or "false"
 	case time.Time:
-		return val.Format(time.RFC3339Nano) // Format time in RFC3339 format (most precise)
+		return val.Format(time.RFC3339Nano), nil // Format time in RFC3339 format (most precise)
+	case toml.LocalDate, toml.LocalTime, toml.LocalDateTime:
+		// Values without an offset keep their own form; as a time.Time they would gain a Z
+		return fmt.Sprint(val), nil
 	case nil:
-		return "''" // Represent nil as empty quoted string
+		// TOML has no null; inventing a value (such as "") would silently change the data
+		return "", errors.New("nil value cannot be represented in TOML")
 	case []any:
 		// Handle arrays by formatting each element and joining with commas
 		var elements []string
-		for _, item := range val {
-			elements = append(elements, formatTomlValue(item)) // Recursively format each element
+		for i, item := range val {
+			element, err := formatTomlValueWith(item, opts) // Recursively format each element
+			if err != nil {
+				return "", fmt.Errorf("array index %d: %w", i, err)
+			}
+			elements = append(elements, element)
+		}
+		return "[" + strings.Join(elements, ", ") + "]", nil // Join the elements with commas and enclose in square brackets
+	case map[string]any:
+		// Tables may only appear as entries of an array of tables, never inside a plain array value
+		return "", errors.New("table found inside an array value; tables in arrays are only supported as arrays of tables")
+	default:
+		if _, ok := asTable(v); ok { // Concrete map types such as map[string]string are tables too
+			return "", errors.New("table found inside an array value; tables in arrays are only supported as arrays of tables")
 		}
-		return "[" + strings.Join(elements, ", ") + "]" // Join the elements with commas and enclose in square brackets
+		if arr, ok := asArray(v); ok { // Concrete slices such as []string or []int are arrays too
+			return formatTomlValueWith(arr, opts)
+		}
+		// Writing a placeholder would produce output that looks valid but is not; callers add the key path
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// formatFloat renders a float in the given notation with the fewest digits that
+// parse back to exactly the same value at the given bit size. The result always
+// reads as a TOML float: integral values keep a ".0" (1.0, not 1, which would be
+// an integer) and the special values use TOML's inf, -inf, and nan.
+func formatFloat(f float64, bitSize int, notation FloatFormat) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf" // TOML spells infinities and NaN in lower case, unlike Go's +Inf and NaN
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	var s string
+	switch notation {
+	case FloatDecimal:
+		s = strconv.FormatFloat(f, 'f', -1, bitSize)
+	case FloatExponent:
+		s = strconv.FormatFloat(f, 'e', -1, bitSize) // An exponent alone makes a TOML float
 	default:
-		return fmt.Sprintf("<<UNKNOWN TYPE %T>>", v) // Handle unknown types - returns a debug string
+		s = strconv.FormatFloat(f, 'g', -1, bitSize)
+	}
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0" // Integral value without an exponent
+	}
+	return s
+}
+
+// formatValue converts the value of a key to its TOML representation, applying
+// the options that only affect top-level values (such as multi-line strings) and
+// the notation recorded in opts.Source (such as an integer's base) before falling
+// back to formatTomlValue. A table value is written as an inline table.
+//
+// Parameters:
+//   - v: The Go value to be converted to a TOML string
+//   - path: Key path of the key, used to look up the source order of inline table keys
+//   - entryPath: Entry path of the key, used to look up source details
+//   - opts: Formatting options
+//
+// Returns:
+//   - string: TOML representation of the value, possibly spanning several lines
+//   - error: If the value cannot be represented
+func formatValue(v any, path []string, entryPath []string, opts Options) (string, error) {
+	if str, ok := v.(string); ok && opts.MultilineStrings == MultilineWhenNewlines && strings.Contains(str, "\n") {
+		// The newline after the opening delimiter is trimmed by TOML parsers
+		return `"""` + "\n" + escapeTOMLMultilineString(str) + `"""`, nil
+	}
+	if arr, ok := asArray(v); ok && containsTable(arr) {
+		if allTables(arr) {
+			return formatInlineArrayOfTables(arr, path, entryPath, opts) // An array of tables chosen to stay on one line
+		}
+		return formatTomlValueWith(arr, opts) // Tables mixed with other values are an error
+	}
+	return formatInlineValue(v, path, entryPath, opts)
+}
+
+// formatInlineArrayOfTables writes an array of tables on one line as an array of
+// inline tables, [{ x = 1 }, { x = 2 }]. Each entry is looked up in opts.Source
+// under its own entry path, as it would be under a [[header]].
+func formatInlineArrayOfTables(arr []any, path []string, entryPath []string, opts Options) (string, error) {
+	elements := make([]string, 0, len(arr))
+	for i, item := range arr {
+		table, _ := asTable(item)
+		var itemEntry []string
+		if len(entryPath) > 0 {
+			itemEntry = childPath(entryPath[:len(entryPath)-1], entrySegment(entryPath[len(entryPath)-1], i))
+		}
+		element, err := formatInlineTable(table, path, itemEntry, opts)
+		if err != nil {
+			return "", fmt.Errorf("array index %d: %w", i, err)
+		}
+		elements = append(elements, element)
 	}
+	return "[" + strings.Join(elements, ", ") + "]", nil
+}
+
+// formatInlineValue converts a value that is written on a single line, such as a
+// value inside an inline table. Tables become inline tables, including tables
+// inside arrays, and integers and strings keep the notation recorded in opts.Source.
+//
+// Parameters:
+//   - v: The Go value to be converted to a TOML string
+//   - path: Key path of the value, used to look up the source order of inline table keys
+//   - entryPath: Entry path of the value, or nil inside arrays, where no notation is recorded
+//   - opts: Formatting options
+//
+// Returns:
+//   - string: Single-line TOML representation of the value
+//   - error: If the value cannot be represented
+func formatInlineValue(v any, path []string, entryPath []string, opts Options) (string, error) {
+	if n, ok := v.(int64); ok && n >= 0 && entryPath != nil { // TOML only allows unsigned non-decimal integers
+		if f, ok := opts.Source.intFormatFor(entryPath); ok {
+			return formatIntInBase(n, f), nil
+		}
+	}
+	if str, ok := v.(string); ok && opts.stringStyle() == StringPreserve {
+		style := StringAuto
+		if literal, ok := opts.Source.stringFormFor(entryPath); ok {
+			style = StringBasic
+			if literal {
+				style = StringLiteral
+			}
+		}
+		return quoteString(str, style), nil
+	}
+	if table, ok := asTable(v); ok {
+		return formatInlineTable(table, path, entryPath, opts)
+	}
+	if arr, ok := asArray(v); ok && containsTable(arr) {
+		elements := make([]string, 0, len(arr))
+		for i, item := range arr {
+			element, err := formatInlineValue(item, path, nil, opts) // Entries share the array's path
+			if err != nil {
+				return "", fmt.Errorf("array index %d: %w", i, err)
+			}
+			elements = append(elements, element)
+		}
+		return "[" + strings.Join(elements, ", ") + "]", nil
+	}
+	return formatTomlValueWith(v, opts)
+}
+
+// formatInlineTable writes a table as an inline table, { a = 1, b = 2 }, with its
+// keys ordered like the keys of any other table. Values are not padded for
+// alignment inside the braces, and nested tables are inline tables as well.
+func formatInlineTable(table map[string]any, path []string, entryPath []string, opts Options) (string, error) {
+	if len(table) == 0 {
+		return "{}", nil
+	}
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	keys = orderKeys(keys, path, opts)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		var childEntry []string
+		if entryPath != nil {
+			childEntry = childPath(entryPath, k)
+		}
+		value, err := formatInlineValue(table[k], childPath(path, k), childEntry, opts)
+		if err != nil {
+			return "", fmt.Errorf("inline table key '%s': %w", k, err)
+		}
+		pairs = append(pairs, displayKey(k, childEntry, opts)+" = "+value)
+	}
+	return "{ " + strings.Join(pairs, ", ") + " }", nil
+}
+
+// containsTable reports whether any element of an array is a table.
+func containsTable(arr []any) bool {
+	for _, item := range arr {
+		if _, ok := asTable(item); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// valueTypeName names the TOML type of a decoded value for error messages.
+func valueTypeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "integer"
+	case float32, float64:
+		return "float"
+	case bool:
+		return "boolean"
+	case time.Time, toml.LocalDateTime:
+		return "datetime"
+	case toml.LocalDate:
+		return "date"
+	case toml.LocalTime:
+		return "time"
+	case nil:
+		return "nil"
+	default:
+		if _, ok := asArray(v); ok {
+			return "array"
+		}
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// allTables reports whether every element of an array is a table.
+func allTables(arr []any) bool {
+	for _, item := range arr {
+		if _, ok := asTable(item); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// inlineArrayOfTables reports whether the array of tables at key is written as a
+// single line of inline tables instead of [[header]] entries. This needs both
+// opts.MaxLineWidth and opts.InlineTableMaxKeys: every entry must qualify as an
+// inline table, carry no comments, and the key's line, before alignment padding,
+// must fit within MaxLineWidth.
+//
+// Parameters:
+//   - arr: Entries of the array of tables
+//   - key: Key of the array in its parent table
+//   - currentPath: Path to the parent table
+//   - sourcePath: Entry path to the parent table, used to look up source details
+//   - currentIndent: Indentation of the key's line
+//   - opts: Formatting options
+//
+// Returns:
+//   - bool: True if the array is written inline
+func inlineArrayOfTables(arr []any, key string, currentPath, sourcePath []string, currentIndent string, opts Options) bool {
+	if opts.MaxLineWidth <= 0 || opts.InlineTableMaxKeys <= 0 {
+		return false
+	}
+	keyPath := childPath(sourcePath, key)
+	for i, item := range arr {
+		table, ok := asTable(item)
+		entryPath := childPath(sourcePath, entrySegment(key, i))
+		if !ok || opts.Source.commentsFor(entryPath) != nil || !inlineTable(table, entryPath, opts) {
+			return false // Entries that need a header, or whose comments would be lost
+		}
+	}
+	value, err := formatValue(arr, childPath(currentPath, key), keyPath, opts)
+	if err != nil {
+		return false // Keep the [[header]] form, which reports the error with more context
+	}
+	line := currentIndent + displayKey(key, keyPath, opts) + " = " + value
+	return utf8.RuneCountInString(line) <= opts.MaxLineWidth
+}
+
+// inlineTableFits reports whether an inline table value fits on its key's line,
+// before alignment padding, within opts.MaxLineWidth. Without a limit every
+// table fits.
+//
+// Parameters:
+//   - table: The table value
+//   - key: Key of the table in its parent table
+//   - currentPath: Path to the parent table
+//   - sourcePath: Entry path to the parent table, used to look up source details
+//   - currentIndent: Indentation of the key's line
+//   - opts: Formatting options
+//
+// Returns:
+//   - bool: False if the table is too wide and is written under a header instead
+func inlineTableFits(table map[string]any, key string, currentPath, sourcePath []string, currentIndent string, opts Options) bool {
+	if opts.MaxLineWidth <= 0 {
+		return true
+	}
+	keyPath := childPath(sourcePath, key)
+	value, err := formatValue(table, childPath(currentPath, key), keyPath, opts)
+	if err != nil {
+		return true // Keep the inline form, which reports the error with more context
+	}
+	line := currentIndent + displayKey(key, keyPath, opts) + " = " + value
+	return utf8.RuneCountInString(line) <= opts.MaxLineWidth
+}
+
+// inlineTable reports whether the table at entryPath is written as an inline
+// table on its key's line instead of under its own [section] header: either it
+// was written inline in the source, or it is small and flat enough for
+// opts.InlineTableMaxKeys.
+func inlineTable(table map[string]any, entryPath []string, opts Options) bool {
+	if opts.Source.isInlineTable(entryPath) {
+		return true
+	}
+	if opts.InlineTableMaxKeys <= 0 || len(table) == 0 || len(table) > opts.InlineTableMaxKeys {
+		return false
+	}
+	for k, v := range table {
+		if _, ok := asTable(v); ok {
+			return false // Nested tables keep their own headers
+		}
+		if arr, ok := asArray(v); ok && containsTable(arr) {
+			return false // Arrays of tables keep their [[headers]]
+		}
+		if opts.Source.commentsFor(childPath(entryPath, k)) != nil {
+			return false // Comments on the table's keys have no place inside braces
+		}
+	}
+	return true
+}
+
+// formatIntInBase writes a non-negative integer with the prefix of its base
+// (0x, 0o, or 0b). Underscores used as digit separators in the source are dropped.
+func formatIntInBase(n int64, f intFormat) string {
+	digits := strconv.FormatInt(n, f.base)
+	switch f.base {
+	case 16:
+		if f.upper {
+			digits = strings.ToUpper(digits)
+		}
+		return "0x" + digits
+	case 8:
+		return "0o" + digits
+	case 2:
+		return "0b" + digits
+	}
+	return digits
+}
+
+// escapeTOMLMultilineString escapes s for use between the delimiters of a TOML
+// multi-line basic string. Line feeds and tabs are kept as-is, except that spaces
+// and tabs at the end of a line are escaped so that no output line ends in
+// whitespace; carriage returns, backslashes, and other control characters are
+// escaped as in a basic string.
+// Quotes are only escaped where they would otherwise close the string: the third
+// quote of any run of three, and a quote that ends the string.
+func escapeTOMLMultilineString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	quoteRun := 0        // Unescaped quotes written in a row
+	blankRun := []rune{} // Spaces and tabs not yet written, in case a line break follows
+	flushBlanks := func(escape bool) {
+		for _, blank := range blankRun {
+			switch {
+			case !escape:
+				b.WriteRune(blank)
+			case blank == '\t':
+				b.WriteString(`\t`)
+			default:
+				b.WriteString(`\u0020`)
+			}
+		}
+		blankRun = blankRun[:0]
+	}
+	for i, r := range s {
+		if r == ' ' || r == '\t' {
+			quoteRun = 0
+			blankRun = append(blankRun, r)
+			continue
+		}
+		// Whitespace at the end of a line is escaped so it survives trailing-whitespace trimming
+		flushBlanks(r == '\n')
+		if r == '"' {
+			if quoteRun == 2 || i == len(s)-1 {
+				b.WriteString(`\"`)
+				quoteRun = 0
+				continue
+			}
+			quoteRun++
+			b.WriteRune(r)
+			continue
+		}
+		quoteRun = 0
+		if r == '\n' {
+			b.WriteRune(r) // Allowed literally in multi-line strings
+			continue
+		}
+		b.WriteString(escapeTOMLBasicString(string(r)))
+	}
+	flushBlanks(false) // The closing delimiter follows on the same line
+	return b.String()
+}
+
+// stringStyle returns the quoting style of single-line strings, taking the
+// deprecated ForceBasicStrings into account.
+func (o Options) stringStyle() StringStyle {
+	if o.ForceBasicStrings {
+		return StringBasic
+	}
+	return o.StringStyle
+}
+
+// quoteString writes s as a single-line string in the given style. StringPreserve
+// must be resolved by the caller; here it behaves like StringAuto.
+func quoteString(s string, style StringStyle) string {
+	switch {
+	case style == StringBasic:
+	case style == StringLiteral && canBeLiteral(s, true):
+		return "'" + s + "'"
+	case style != StringLiteral && preferLiteral(s):
+		return "'" + s + "'" // Backslashes read as written, without escaping
+	}
+	return `"` + escapeTOMLBasicString(s) + `"` // Quote strings as TOML basic strings
+}
+
+// preferLiteral reports whether a string is better written as a literal string,
+// 'C:\Users\me', than as a basic string: it contains backslashes, which a basic
+// string would have to escape, and no single quotes, control characters, or
+// invalid UTF-8. Tabs are allowed in literal strings, but an escaped \t is
+// easier to spot, so strings with tabs stay basic strings.
+func preferLiteral(s string) bool {
+	return strings.Contains(s, `\`) && canBeLiteral(s, false)
+}
+
+// canBeLiteral reports whether s can be written as a single-line literal string:
+// it is valid UTF-8 and has no single quotes or control characters, except tabs
+// when allowTab is set.
+func canBeLiteral(s string, allowTab bool) bool {
+	if strings.Contains(s, "'") || !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r == '\t' && allowTab {
+			continue
+		}
+		if r < 0x20 || r == 0x7F {
+			return false // Literal strings have no escapes for control characters
+		}
+	}
+	return true
+}
+
+// escapeTOMLBasicString escapes s for use between the double quotes of a TOML
+// basic string. Quotes, backslashes, and control characters are escaped using the
+// short forms TOML defines (\b, \t, \n, \f, \r, \", \\) or \uXXXX for other
+// control characters; every other character, including non-ASCII and astral-plane
+// code points, is written as-is since TOML documents are UTF-8. Invalid UTF-8 bytes
+// are replaced by U+FFFD, as TOML strings must be valid Unicode.
+//
+// Parameters:
+//   - s: The raw string value
+//
+// Returns:
+//   - string: The escaped string, without surrounding quotes
+func escapeTOMLBasicString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2) // Most strings need few or no escapes
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r) // Other control characters have no short escape
+				continue
+			}
+			b.WriteRune(r) // Invalid UTF-8 decodes to utf8.RuneError (U+FFFD)
+		}
+	}
+	return b.String()
 }
 
 // formatSimpleKeys formats and writes simple key-value pairs with proper alignment.
-// Simple keys are those with non-table, non-array-table values.
+// Simple keys are those with non-table, non-array-table values. Values are aligned
+// within each group of adjacent keys (see alignmentWidths), so one long key only
+// pads the keys near it.
 //
 // Parameters:
-//   - dataMap: Map containing the key-value pairs
+//   - dataMap: Map containing the key-value pairs (the leaf value for collapsed keys)
 //   - simpleKeys: Slice of keys to process
-//   - maxKeyLen: Maximum key length for alignment
+//   - chains: Full key segments of keys written as dotted keys (see collapseChain)
+//   - currentPath: Current path to this section, used for error context
+//   - sourcePath: Entry path of this section, used to look up comments
 //   - currentIndent: Current indentation string
-//   - output: Buffer where formatted output is written
+//   - opts: Formatting options
+//   - output: Writer the formatted output is streamed to
+//
+// Returns:
+//   - error: If a value cannot be formatted
 func formatSimpleKeys(
 	dataMap map[string]any,
 	simpleKeys []string,
-	maxKeyLen int,
+	chains map[string][]string,
+	currentPath []string, // Path to the parent map
+	sourcePath []string, // Entry path to the parent map
 	currentIndent string, // Indent for the line itself
-	output *bytes.Buffer,
-) {
-	for _, k := range simpleKeys {
+	opts Options,
+	output *docWriter,
+) error {
+	var groups []int // Blank-line group of each key, or nil when blank lines are not kept
+	if opts.PreserveBlankLines || opts.Source.isIgnoredTable(sourcePath) {
+		simpleKeys, groups = blankLineGroups(simpleKeys, sourcePath, opts)
+	}
+	keyTexts := make([]string, len(simpleKeys)) // Key text of each line, quoted and dotted as written
+	verbatim := make([]string, len(simpleKeys)) // Source text of lines kept by tomlfmt:ignore, or ""
+	for i, k := range simpleKeys {
+		chain := keyChain(k, chains)
+		if text, ok := verbatimText(chain, dataMap[k], childPath(sourcePath, chain...), opts); ok {
+			verbatim[i] = text // Verbatim lines take no part in alignment, so their key text stays ""
+			continue
+		}
+		keyTexts[i] = dottedKeyText(chain, sourcePath, opts)
+	}
+	widths := alignmentWidths(simpleKeys, keyTexts, chains, groups, sourcePath, opts) // Width each key is padded to
+
+	// The value and source paths are rebuilt in place for every key; callees only read them
+	var entryPath, valuePath []string
+	for i, k := range simpleKeys {
 		v := dataMap[k] // Get the value associated with the key
-		displayKey := formatKey(k)
-		padding := strings.Repeat(
-			" ",
-			maxKeyLen-len(displayKey),
-		) // Calculate padding for alignment
-		formattedValue := formatTomlValue(
+		chain := keyChain(k, chains)
+		entryPath = append(append(entryPath[:0], sourcePath...), chain...)
+		keyText := keyTexts[i]
+		padding := 0 // No padding unless values are aligned
+		if opts.AlignValues {
+			padding = widths[i] - utf8.RuneCountInString(keyText) // Calculate padding for alignment
+		}
+		valuePath = append(append(valuePath[:0], currentPath...), chain...)
+		if groups != nil && i > 0 && groups[i] != groups[i-1] {
+			output.WriteString("\n") // One blank line where the source had one or more
+		}
+		comments := opts.Source.commentsFor(entryPath)
+		writeLeadingComments(comments.leadingComments(), currentIndent, output) // Comments above the key
+		if verbatim[i] != "" {
+			output.WriteString(currentIndent)
+			output.WriteRaw(verbatim[i]) // Trailing spaces inside a multi-line string are part of its value
+			output.WriteString(trailingText(comments, annotationPath(valuePath, opts), opts))
+			output.WriteString("\n")
+			continue
+		}
+		formattedValue, err := formatValue(
 			v,
+			valuePath,
+			entryPath,
+			opts,
 		) // Format the value into a TOML string
-		fmt.Fprintf(
-			output,
-			"%s%s%s = %s\n",
-			currentIndent,
-			displayKey,
-			padding,
-			formattedValue,
-		) // Write the formatted key-value pair to the output buffer
+		if err != nil {
+			return fmt.Errorf("key '%s': %w", strings.Join(valuePath, "."), err) // Add the key path to the error
+		}
+		if arr, ok := asArray(v); ok && len(arr) > 0 && opts.MaxLineWidth > 0 {
+			lineWidth := utf8.RuneCountInString(currentIndent) + utf8.RuneCountInString(keyText) + padding +
+				len(" = ") + utf8.RuneCountInString(formattedValue)
+			if lineWidth > opts.MaxLineWidth {
+				formattedValue, err = formatWrappedArray(arr, valuePath, currentIndent, opts)
+				if err != nil {
+					return fmt.Errorf("key '%s': %w", strings.Join(valuePath, "."), err)
+				}
+			}
+		}
+		// Write the formatted key-value pair piece by piece, which saves fmt's allocations on the hottest line
+		output.WriteString(currentIndent)
+		output.WriteString(keyText)
+		writeSpaces(output, padding)
+		output.WriteString(" = ")
+		output.WriteString(formattedValue)
+		output.WriteString(trailingText(comments, annotationPath(valuePath, opts), opts))
+		output.WriteString("\n")
 	}
+	return nil
+}
+
+// verbatimText returns the source text of the line of a key when a tomlfmt:ignore
+// directive asks for it to be kept, as long as the line's own key is the one
+// written here (a dotted key a.b = 1 cannot be written as b = 1 under [a]) and
+// its text still holds v; a value changed since the source was read is
+// formatted as usual instead.
+//
+// Parameters:
+//   - chain: Segments of the key as it is written, more than one for a dotted key
+//   - v: The key's current value
+//   - entryPath: Entry path of the key, used to look up its source text
+//   - opts: Formatting options
+//
+// Returns:
+//   - string: The key/value text as written in the source
+//   - bool: Whether the text should be written instead of formatting the value
+func verbatimText(chain []string, v any, entryPath []string, opts Options) (string, bool) {
+	line, ok := opts.Source.verbatimFor(entryPath)
+	if !ok || !slices.Equal(line.key, chain) {
+		return "", false
+	}
+	var decoded map[string]any
+	if err := toml.Unmarshal([]byte(line.text), &decoded); err != nil || len(decoded) != 1 {
+		return "", false
+	}
+	var sourceValue any = decoded
+	for _, segment := range chain {
+		table, ok := sourceValue.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		sourceValue = table[segment]
+	}
+	return line.text, reflect.DeepEqual(sourceValue, v)
+}
+
+// writeSpaces writes n spaces without building a string of them.
+func writeSpaces(output *docWriter, n int) {
+	const spaces = "                                " // Written in chunks of up to this many
+	for n > 0 {
+		chunk := min(n, len(spaces))
+		output.WriteString(spaces[:chunk])
+		n -= chunk
+	}
+}
+
+// annotationPath returns the dotted path that opts.Annotations is keyed by, or
+// "" when there are no annotations to look up, which saves joining the path.
+func annotationPath(path []string, opts Options) string {
+	if len(opts.Annotations) == 0 {
+		return ""
+	}
+	return strings.Join(path, ".")
+}
+
+// alignmentWidths returns, for each key, the width its key text is padded to so
+// that values line up. Keys are aligned in groups: a key with comments above it,
+// or the first key after a blank line, starts a new group, and each group is as
+// wide as its longest key. Widths count characters, not bytes, so keys like
+// "café" line up too.
+//
+// Parameters:
+//   - keys: Simple keys in the order they are written
+//   - keyTexts: Text written for each key, by index in keys (see dottedKeyText)
+//   - chains: Full key segments of keys written as dotted keys
+//   - blankGroups: Blank-line group of each key, by index in keys (nil when blank lines are not kept)
+//   - sourcePath: Entry path of the table holding the keys, used to look up comments
+//   - opts: Formatting options
+//
+// Returns:
+//   - []int: The padded width of each key, by index in keys
+func alignmentWidths(
+	keys, keyTexts []string,
+	chains map[string][]string,
+	blankGroups []int,
+	sourcePath []string,
+	opts Options,
+) []int {
+	widths := make([]int, len(keys))
+	start := 0 // Index of the first key in the current group
+	groupWidth := 0
+	for i, k := range keys {
+		afterBlankLine := blankGroups != nil && i > 0 && blankGroups[i] != blankGroups[i-1]
+		if afterBlankLine || i > 0 && opts.Source != nil && // Without a source there are no comments to split groups
+			len(opts.Source.commentsFor(childPath(sourcePath, keyChain(k, chains)...)).leadingComments()) > 0 {
+			for j := start; j < i; j++ {
+				widths[j] = groupWidth // Close the group before the comment
+			}
+			start, groupWidth = i, 0
+		}
+		groupWidth = max(groupWidth, utf8.RuneCountInString(keyTexts[i]))
+	}
+	for j := start; j < len(keys); j++ {
+		widths[j] = groupWidth
+	}
+	return widths
+}
+
+// collapseChain reports whether the table at key is written as a dotted key,
+// a.b.c = 1, instead of a chain of [a], [a.b], [a.b.c] headers. With
+// opts.CollapseTableChains, a table collapses when it and every table below it
+// hold exactly one key, ending in a value that is not a table with a header of
+// its own, and no table in the chain has comments that would need its header.
+// The chain must pass through at least one table holding only another table, so
+// [server] with a single port = 80 keeps its header.
+//
+// Parameters:
+//   - table: The table at key
+//   - key: Key of the table in its parent table
+//   - sourcePath: Entry path to the parent table, used to look up source details
+//   - opts: Formatting options
+//
+// Returns:
+//   - []string: The key segments of the dotted key, starting with key, or nil if the table keeps its header
+//   - any: The value at the end of the chain
+func collapseChain(table map[string]any, key string, sourcePath []string, opts Options) ([]string, any) {
+	if !opts.CollapseTableChains {
+		return nil, nil
+	}
+	chain := []string{key}
+	current := table
+	for {
+		entryPath := childPath(sourcePath, chain...)
+		if len(current) != 1 || opts.Source.commentsFor(entryPath) != nil {
+			return nil, nil // Several children, an empty table, or a commented header
+		}
+		var child string
+		for k := range current {
+			child = k
+		}
+		v := current[child]
+		chain = append(chain, child)
+		if next, ok := asTable(v); ok && !inlineTable(next, append(entryPath, child), opts) {
+			current = next // Another level of the chain
+			continue
+		}
+		if arr, ok := asArray(v); ok && len(arr) > 0 && allTables(arr) {
+			return nil, nil // Arrays of tables keep their [[headers]]
+		}
+		if len(chain) < 3 {
+			return nil, nil // A lone table with one key has no redundant header to drop
+		}
+		if line, ok := opts.Source.verbatimFor(childPath(sourcePath, chain...)); ok && !slices.Equal(line.key, chain) {
+			return nil, nil // The leaf's line is kept as written, under the header it was written under
+		}
+		return chain, v
+	}
+}
+
+// verbatimChain finds a dotted key line kept by tomlfmt:ignore that starts at
+// key, such as a.b = 1, so it is written back as that line rather than as a
+// table. This works only while every table along its key holds nothing else.
+//
+// Returns the key segments of the line and its value, or nil when there is no
+// such line.
+func verbatimChain(table map[string]any, key string, sourcePath []string, opts Options) ([]string, any) {
+	if opts.Source == nil || len(opts.Source.verbatim) == 0 {
+		return nil, nil // The common case: nothing is ignored
+	}
+	chain := []string{key}
+	current := table
+	for len(current) == 1 {
+		var child string
+		for k := range current {
+			child = k
+		}
+		v := current[child]
+		chain = append(chain, child)
+		if line, ok := opts.Source.verbatimFor(childPath(sourcePath, chain...)); ok && slices.Equal(line.key, chain) {
+			return chain, v
+		}
+		next, ok := asTable(v)
+		if !ok {
+			return nil, nil
+		}
+		current = next
+	}
+	return nil, nil
+}
+
+// childPath returns a new path made of parent followed by keys. It is allocated
+// once, at its final size, and never shares memory with parent.
+func childPath(parent []string, keys ...string) []string {
+	path := make([]string, 0, len(parent)+len(keys))
+	path = append(path, parent...)
+	return append(path, keys...)
+}
+
+// keyChain returns the key segments written for a simple key: the segments of
+// its dotted key when it collapses a chain of tables, or just the key.
+func keyChain(k string, chains map[string][]string) []string {
+	if chain, ok := chains[k]; ok {
+		return chain
+	}
+	return []string{k}
+}
+
+// dottedKeyText joins the key segments of a simple key with dots, each quoted as
+// a key on its own.
+func dottedKeyText(chain []string, sourcePath []string, opts Options) string {
+	if len(chain) == 1 && !opts.PreserveKeyQuotes {
+		return formatKey(chain[0], opts) // The common case needs neither a path nor a join
+	}
+	parts := make([]string, len(chain))
+	for i, segment := range chain {
+		parts[i] = displayKey(segment, childPath(sourcePath, chain[:i+1]...), opts)
+	}
+	return strings.Join(parts, ".")
+}
+
+// formatWrappedArray writes an array value with one element per line, for arrays
+// too wide for opts.MaxLineWidth. Elements are indented one level deeper than
+// the key (two spaces when opts.IndentUnit is empty), the last one followed by a
+// comma only with opts.TrailingComma, and the closing bracket is aligned with the
+// key. A nested array that is still too wide on its own line is wrapped the
+// same way, one level deeper.
+//
+// Parameters:
+//   - arr: Elements of the array
+//   - path: Key path of the array, used to look up the source order of inline table keys
+//   - currentIndent: Indentation of the key's line
+//   - opts: Formatting options
+//
+// Returns:
+//   - string: The array, spanning several lines
+//   - error: If an element cannot be represented
+func formatWrappedArray(arr []any, path []string, currentIndent string, opts Options) (string, error) {
+	elementIndent := currentIndent + opts.IndentUnit
+	if opts.IndentUnit == "" {
+		elementIndent = currentIndent + "  " // Elements must stand out from the key even without indentation
+	}
+	var b strings.Builder
+	b.WriteString("[\n")
+	for i, item := range arr {
+		element, err := formatInlineValue(item, path, nil, opts) // Each element stays on one line
+		if err != nil {
+			return "", fmt.Errorf("array index %d: %w", i, err)
+		}
+		if inner, ok := asArray(item); ok && len(inner) > 0 &&
+			utf8.RuneCountInString(elementIndent+element+",") > opts.MaxLineWidth {
+			element, err = formatWrappedArray(inner, path, elementIndent, opts)
+			if err != nil {
+				return "", fmt.Errorf("array index %d: %w", i, err)
+			}
+		}
+		b.WriteString(elementIndent + element)
+		if i < len(arr)-1 || opts.TrailingComma {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(currentIndent + "]")
+	return b.String(), nil
 }
 
 // formatArrayTables formats and writes array tables with proper headers and content.
@@ -112,18 +1304,22 @@ func formatSimpleKeys(
 // Parameters:
 //   - arrayTableKeys: Map of keys to array tables
 //   - currentPath: Current path to this section
+//   - sourcePath: Entry path of this section, used to look up comments
 //   - currentIndent: Current indentation string
-//   - indentUnit: Unit of indentation for nested content
-//   - output: Buffer where formatted output is written
+//   - prev: What was emitted before the first header; updated as headers are written
+//   - opts: Formatting options (indentation unit for nested content, key quoting)
+//   - output: Writer the formatted output is streamed to
 //
 // Returns:
 //   - error: If any formatting operation fails
 func formatArrayTables(
 	arrayTableKeys map[string][]any,
 	currentPath []string, // Path to the parent map
+	sourcePath []string, // Entry path to the parent map
 	currentIndent string,
-	indentUnit string,
-	output *bytes.Buffer,
+	prev *sectionKind,
+	opts Options,
+	output *docWriter,
 ) error {
 	// Sort keys for consistent output
 	sortedArrayTableKeys := make(
@@ -134,17 +1330,18 @@ func formatArrayTables(
 	for k := range arrayTableKeys {
 		sortedArrayTableKeys = append(sortedArrayTableKeys, k) // Add each key to the slice
 	}
-	sort.Strings(sortedArrayTableKeys) // Sort the keys alphabetically
+	sortedArrayTableKeys = orderKeys(sortedArrayTableKeys, currentPath, opts) // Alphabetical or source order
 
 	for _, k := range sortedArrayTableKeys {
 		arrData := arrayTableKeys[k] // Retrieve the array of data for the key
 		// Construct the full path for the array table key
-		fullPath := append(append([]string{}, currentPath...), k) // Create copy before appending
+		fullPath := childPath(currentPath, k) // A new path, so currentPath is never modified
 		fullPathString := strings.Join(
 			fullPath,
 			".",
 		) // Convert the path to a dot-separated string
 
+		subMaps := make([]map[string]any, len(arrData)) // Entries as tables, by source index
 		for i, item := range arrData {
 			subMap, ok := item.(map[string]any) // Type assert each item as a map
 			if !ok {
@@ -153,35 +1350,46 @@ func formatArrayTables(
 					fullPathString,
 				)
 			}
-			// Add newline separator between sections
-			if output.Len() > 0 {
-				trimmedLen := len(
-					bytes.TrimRight(output.Bytes(), "\n\t "),
-				) // Calculate length of output after trimming whitespace
-				if (trimmedLen > 0 && trimmedLen < output.Len()) || i > 0 {
-					if !bytes.HasSuffix(output.Bytes(), []byte("\n\n")) {
-						output.WriteString("\n") // Add newline if one isn't already there
-					}
-				}
+			subMaps[i] = subMap
+		}
+		entryOrder := arrayTableOrder(subMaps, opts) // Source order unless sorting was requested
+
+		for n, i := range entryOrder {
+			subMap := subMaps[i]
+			// Add the blank lines the separator policy asks for
+			writeSeparator(*prev, kindArrayTable, opts, output)
+			*prev = kindArrayTable // The next header follows this array table entry
+			entryPath := childPath(sourcePath, entrySegment(k, i))
+			comments := opts.Source.commentsFor(entryPath)
+			headerIndent := opts.IndentMode.headerIndent(currentIndent)
+			if n == 0 {
+				// An inline array of tables (key = [{...}]) keeps its comments on the key itself
+				writeLeadingComments(
+					opts.Source.commentsFor(childPath(sourcePath, k)).leadingComments(),
+					headerIndent,
+					output,
+				)
 			}
-			// Header uses currentIndent for positioning, but fullPathString for the name
-			fmt.Fprintf(
-				output,
-				"%s[[%s]]\n",
-				currentIndent,
-				fullPathString,
-			) // Write the array table header
+			writeLeadingComments(comments.leadingComments(), headerIndent, output) // Comments above the header
+			// Header uses headerIndent for positioning, and the quoted path for the name
+			writeHeader(output, headerIndent, "[[", headerName(fullPath, entryPath, opts), "]]",
+				trailingText(comments, fullPathString, opts)) // Write the array table header
 
 			// Content uses an increased indent level
-			nextIndent := currentIndent + indentUnit // Calculate the next level of indent
+			nextIndent := currentIndent + opts.IndentUnit // Calculate the next level of indent
 			// Recursive call passes the fullPath and nextIndent
 			err := formatMap(
 				subMap,
 				fullPath,
+				entryPath,
 				nextIndent,
-				indentUnit,
+				kindArrayTable,
+				opts,
 				output,
 			) // Recursively format the submap
+			if errors.As(err, new(*nestingDepthError)) {
+				return err // It names the table; adding every level's path would make it enormous
+			}
 			if err != nil {
 				// Add context to the error
 				return fmt.Errorf(
@@ -203,9 +1411,11 @@ func formatArrayTables(
 //   - dataMap: Map containing the tables
 //   - tableKeys: Slice of keys representing tables
 //   - currentPath: Current path to this section
+//   - sourcePath: Entry path of this section, used to look up comments
 //   - currentIndent: Current indentation string
-//   - indentUnit: Unit of indentation for nested content
-//   - output: Buffer where formatted output is written
+//   - prev: What was emitted before the first header; updated as headers are written
+//   - opts: Formatting options (indentation unit for nested content, key quoting)
+//   - output: Writer the formatted output is streamed to
 //
 // Returns:
 //   - error: If any formatting operation fails
@@ -213,16 +1423,15 @@ func formatRegularTables(
 	dataMap map[string]any,
 	tableKeys []string,
 	currentPath []string, // Path to the parent map
+	sourcePath []string, // Entry path to the parent map
 	currentIndent string,
-	indentUnit string,
-	output *bytes.Buffer,
+	prev *sectionKind,
+	opts Options,
+	output *docWriter,
 ) error {
 	for _, k := range tableKeys {
 		// Construct the full path for the table key
-		fullPath := append(
-			append([]string{}, currentPath...),
-			k,
-		) // Create a copy and append the new key
+		fullPath := childPath(currentPath, k) // A new path, so currentPath is never modified
 		fullPathString := strings.Join(
 			fullPath,
 			".",
@@ -237,32 +1446,35 @@ func formatRegularTables(
 				subMapInterface,
 			)
 		}
-		// Add newline separator between sections
-		if output.Len() > 0 {
-			trimmedLen := len(
-				bytes.TrimRight(output.Bytes(), "\n\t "),
-			) // Get length after trimming whitespace from end
-			if trimmedLen > 0 && trimmedLen < output.Len() {
-				if !bytes.HasSuffix(output.Bytes(), []byte("\n\n")) {
-					output.WriteString("\n") // Add newline if one isn't already there
-				}
-			} else if trimmedLen == output.Len() && output.Len() > 0 {
-				output.WriteString("\n") // Add newline if the buffer is non empty after trimming
-			}
+		// Add the blank lines the separator policy asks for
+		writeSeparator(*prev, kindTable, opts, output)
+		*prev = kindTable // The next header follows this table
+		entryPath := childPath(sourcePath, k)
+		comments := opts.Source.commentsFor(entryPath)
+		headerIndent := opts.IndentMode.headerIndent(currentIndent)
+		writeLeadingComments(comments.leadingComments(), headerIndent, output) // Comments above the header
+		// Header uses headerIndent for positioning, and the quoted path for the name
+		writeHeader(output, headerIndent, "[", headerName(fullPath, entryPath, opts), "]",
+			trailingText(comments, fullPathString, opts)) // Write the table header
+		if len(subMap) == 0 {
+			continue // An empty table is just its header, which is what defines it
 		}
-		// Header uses currentIndent for positioning, but fullPathString for the name
-		fmt.Fprintf(output, "%s[%s]\n", currentIndent, fullPathString) // Write the table header
 
 		// Content uses an increased indent level
-		nextIndent := currentIndent + indentUnit // Calculate the next level of indent
+		nextIndent := currentIndent + opts.IndentUnit // Calculate the next level of indent
 		// Recursive call passes the fullPath and nextIndent
 		err := formatMap(
 			subMap,
 			fullPath,
+			entryPath,
 			nextIndent,
-			indentUnit,
+			kindTable,
+			opts,
 			output,
 		) // Recursively format the sub-map
+		if errors.As(err, new(*nestingDepthError)) {
+			return err // It names the table; adding every level's path would make it enormous
+		}
 		if err != nil {
 			// Add context to the error
 			return fmt.Errorf("formatting table '%s': %w", fullPathString, err)
@@ -278,19 +1490,29 @@ func formatRegularTables(
 // Parameters:
 //   - dataMap: Map to format
 //   - currentPath: Current path of keys leading to this map
-//   - currentIndent: Current indentation string
-//   - indentUnit: Unit of indentation for nested content
-//   - output: Buffer where formatted output is written
+//   - sourcePath: Entry path of this map, used to look up comments
+//   - currentIndent: Indentation of this map's depth, one IndentUnit per level (see IndentMode)
+//   - ownKind: Kind of the header that introduces this map (kindDocumentStart for the root)
+//   - opts: Formatting options (indentation unit for nested content, key quoting)
+//   - output: Writer the formatted output is streamed to
 //
 // Returns:
 //   - error: If any formatting operation fails
 func formatMap(
 	dataMap map[string]any,
 	currentPath []string, // Current path of keys leading to this map
-	currentIndent string, // Current indentation string for content
-	indentUnit string, // Unit of indentation ("" or "  ")
-	output *bytes.Buffer,
+	sourcePath []string, // Entry path of this map, which also names array table entries
+	currentIndent string, // Indentation of this map's depth
+	ownKind sectionKind, // Kind of this map's own header
+	opts Options, // Formatting options, including the unit of indentation ("" or "  ")
+	output *docWriter,
 ) error {
+	if limit := opts.maxNestingDepth(); limit >= 0 && len(currentPath) > limit {
+		// Recursing without a limit lets a hostile document exhaust the stack
+		return &nestingDepthError{path: currentPath, limit: limit}
+	}
+	dataMap = normalizeValues(dataMap) // Treat map[string]T and []T values like map[string]any and []any
+
 	// Get and sort all keys for consistent output
 	keys := make(
 		[]string,
@@ -300,77 +1522,608 @@ func formatMap(
 	for k := range dataMap {
 		keys = append(keys, k) // Add each key from the map to the slice
 	}
-	sort.Strings(keys) // Sort the slice of keys alphabetically
+	ignored := opts.Source.isIgnoredTable(sourcePath)
+	orderOpts := opts
+	if ignored {
+		orderOpts.SortKeys = SortNone // A table under tomlfmt:ignore keeps its keys where they were
+	}
+	keys = orderKeys(keys, currentPath, orderOpts) // Sort alphabetically or restore source order
+	// Key/value lines may sit at a different level than the nested headers
+	entryIndent := opts.IndentMode.entryIndent(currentIndent, opts.IndentUnit, ownKind == kindDocumentStart)
 
-	maxKeyLen := 0                       // Initialize the maximum key length to 0
 	simpleKeys := []string{}             // Slice to store keys of simple key-value pairs
 	tableKeys := []string{}              // Slice to store keys of tables
 	arrayTableKeys := map[string][]any{} // Map to store keys of array tables and their associated data
+	sectionKeys := []string{}            // Keys of tables and array tables, in emission order
+	chains := map[string][]string{}      // Key segments of tables collapsed into dotted keys
+	simpleValues := map[string]any{}     // Values written on the simple keys' lines
 
 	// Categorize keys and find max length for simple keys
 	for _, k := range keys {
 		v := dataMap[k] // Get the value associated with the key
+		// An empty array is not an array table: TOML has no header for zero entries, so it is written as "k = []"
 		if maybeArray, ok := v.([]any); ok &&
 			len(maybeArray) > 0 { // Check if it is a non-empty array
 			isArrTable := true    // Assume its an array table initially
 			containsMaps := false // Flag to track if the array contains map
 			// Check if array contains maps (for array tables)
-			for _, item := range maybeArray {
+			for i, item := range maybeArray {
 				_, itemIsMap := item.(map[string]any) // type assert the item
 				if itemIsMap {
 					containsMaps = true // set the flag to true
 				} else {
 					isArrTable = false // If any array entry is not a map, its not an array table
 					if containsMaps {  // If we've already found a map
-						// Error if array mixes tables and non-tables
-						fullPathString := strings.Join(append(append([]string{}, currentPath...), k), ".")
+						// Error if array mixes tables and non-tables, naming the first element that breaks the rule
+						fullPathString := strings.Join(childPath(currentPath, k), ".")
 						return fmt.Errorf(
-							"key '%s': arrays cannot mix tables and non-tables", fullPathString)
+							"key '%s': arrays cannot mix tables and non-tables: array index %d has type %s, not table",
+							fullPathString, i, valueTypeName(item))
 					}
 					break
 				}
 			}
-			if isArrTable {
-				arrayTableKeys[k] = maybeArray // store the array data
-				continue                       // Move to the next key
+			if isArrTable && !inlineArrayOfTables(maybeArray, k, currentPath, sourcePath, entryIndent, opts) {
+				arrayTableKeys[k] = maybeArray       // store the array data
+				sectionKeys = append(sectionKeys, k) // remember its position among sections
+				continue                             // Move to the next key
 			}
 		}
-		// Check if value is a regular table
-		if _, ok := v.(map[string]any); ok {
-			tableKeys = append(tableKeys, k) // Add the key to the list of table keys
-			continue                         // Move to the next key
+		// Check if value is a regular table; small or source-inline tables that fit are written as simple keys
+		if table, ok := v.(map[string]any); ok &&
+			(!inlineTable(table, childPath(sourcePath, k), opts) ||
+				!inlineTableFits(table, k, currentPath, sourcePath, entryIndent, opts)) {
+			chain, leaf := verbatimChain(table, k, sourcePath, opts)
+			if chain == nil {
+				chain, leaf = collapseChain(table, k, sourcePath, opts)
+			}
+			if chain == nil {
+				tableKeys = append(tableKeys, k)     // Add the key to the list of table keys
+				sectionKeys = append(sectionKeys, k) // remember its position among sections
+				continue                             // Move to the next key
+			}
+			chains[k] = chain // A chain of single-key tables is written as one dotted key
+			v = leaf
 		}
 		// If we get here, it's a simple key-value pair
 		simpleKeys = append(simpleKeys, k) // Add the key to the list of simple keys
-		// If a multi word key becomes the longest key, the subsequent keys get padded to align =
-		if fkLen := len(formatKey(k)); fkLen > maxKeyLen {
-			maxKeyLen = fkLen
+		simpleValues[k] = v
+	}
+
+	if opts.GroupKeysByValueType && !ignored {
+		simpleKeys = groupByValueType(simpleValues, simpleKeys)
+	}
+
+	// Format sections in order: simple keys, then array tables and regular tables in opts.SectionOrder
+	err := formatSimpleKeys(simpleValues, simpleKeys, chains, currentPath, sourcePath, entryIndent, opts, output)
+	if err != nil {
+		return err
+	}
+
+	// The first nested header follows either this map's simple keys or its own header
+	prev := ownKind
+	if len(simpleKeys) > 0 {
+		prev = kindKeys
+	}
+
+	// In source order, tables and array tables are interleaved as they were declared
+	if opts.SortKeys == SortNone && opts.Source != nil {
+		for _, k := range sectionKeys {
+			if arrData, ok := arrayTableKeys[k]; ok {
+				err = formatArrayTables(
+					map[string][]any{k: arrData}, currentPath, sourcePath, currentIndent, &prev, opts, output)
+			} else {
+				err = formatRegularTables(
+					dataMap, []string{k}, currentPath, sourcePath, currentIndent, &prev, opts, output)
+			}
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
-	// Format sections in order: simple keys, then array tables, then regular tables
-	formatSimpleKeys(dataMap, simpleKeys, maxKeyLen, currentIndent, output)
+	if opts.SectionOrder == SectionTablesFirst {
+		err = formatRegularTables(dataMap, tableKeys, currentPath, sourcePath, currentIndent, &prev, opts, output)
+		if err != nil {
+			return err
+		}
+		return formatArrayTables(arrayTableKeys, currentPath, sourcePath, currentIndent, &prev, opts, output)
+	}
 
 	// Process array tables
-	err := formatArrayTables(arrayTableKeys, currentPath, currentIndent, indentUnit, output)
+	err = formatArrayTables(arrayTableKeys, currentPath, sourcePath, currentIndent, &prev, opts, output)
 	if err != nil {
 		return err
 	}
 
 	// Process regular tables
-	err = formatRegularTables(dataMap, tableKeys, currentPath, currentIndent, indentUnit, output)
+	err = formatRegularTables(dataMap, tableKeys, currentPath, sourcePath, currentIndent, &prev, opts, output)
 
 	// returns err, which will be nil if no error occurred, or the error itself otherwise
 	return err
 }
 
+// asTable reports whether v is a map with string keys (such as map[string]string,
+// map[string]int, or a map keyed by a named string type) and returns it as a
+// map[string]any. Values of the returned map are not converted.
+func asTable(v any) (map[string]any, bool) {
+	if m, ok := v.(map[string]any); ok {
+		return m, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	if rv.IsNil() {
+		return map[string]any{}, true // A nil map is an empty table
+	}
+	m := make(map[string]any, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		m[iter.Key().String()] = iter.Value().Interface()
+	}
+	return m, true
+}
+
+// asArray reports whether v is a slice or array of any element type (such as
+// []string, []int, or []map[string]any) and returns its elements as a []any.
+// The elements themselves are not converted.
+func asArray(v any) ([]any, bool) {
+	if arr, ok := v.([]any); ok {
+		return arr, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	arr := make([]any, rv.Len()) // A nil slice becomes an empty array
+	for i := range arr {
+		arr[i] = rv.Index(i).Interface()
+	}
+	return arr, true
+}
+
+// normalizeValues returns dataMap with every concrete map value converted to
+// map[string]any, every concrete slice value converted to []any, and every
+// concrete map entry of an array converted to map[string]any, so the rest of the
+// formatter only deals with one table type and one array type. dataMap is copied
+// only when something needs converting.
+func normalizeValues(dataMap map[string]any) map[string]any {
+	normalized := dataMap
+	copied := false // Whether normalized is already a private copy
+	set := func(k string, v any) {
+		if !copied {
+			copied = true
+			normalized = make(map[string]any, len(dataMap))
+			for key, val := range dataMap {
+				normalized[key] = val
+			}
+		}
+		normalized[k] = v
+	}
+	for k, v := range dataMap {
+		if _, ok := v.(map[string]any); ok {
+			continue // Already a generic table
+		}
+		if table, ok := asTable(v); ok {
+			set(k, table)
+			continue
+		}
+		arr, isGeneric := v.([]any)
+		if !isGeneric {
+			var ok bool
+			if arr, ok = asArray(v); !ok {
+				continue // Not a table or an array
+			}
+		}
+		converted := !isGeneric // asArray already returned a fresh slice
+		for i, item := range arr {
+			if _, ok := item.(map[string]any); ok {
+				continue
+			}
+			if table, ok := asTable(item); ok {
+				if !converted {
+					arr = append([]any{}, arr...) // Never modify the caller's slice
+					converted = true
+				}
+				arr[i] = table
+			}
+		}
+		if converted {
+			set(k, arr)
+		}
+	}
+	return normalized
+}
+
+// writeSeparator writes the blank lines that opts.Separators requires between
+// what was emitted last (prev) and the next header (next).
+func writeSeparator(prev, next sectionKind, opts Options, output *docWriter) {
+	output.WriteString(strings.Repeat("\n", opts.Separators.blankLines(prev, next)))
+}
+
+// trailingText returns the end-of-line comment for the line of the key or header
+// at dotted path: the source comment if there is one, else the annotation from
+// opts.Annotations, else "". A non-empty result starts with a separating space.
+func trailingText(comments *commentInfo, dottedPath string, opts Options) string {
+	if text := comments.trailingComment(); text != "" {
+		return text
+	}
+	annotation, ok := opts.Annotations[dottedPath]
+	if !ok {
+		return ""
+	}
+	// A comment ends at the line break, so keep the annotation on one line
+	annotation = strings.Join(strings.Fields(annotation), " ")
+	if !strings.HasPrefix(annotation, "#") {
+		annotation = "# " + annotation
+	}
+	return " " + annotation
+}
+
+// writeLeadingComments writes full-line comments, each on its own line at indent.
+func writeLeadingComments(comments []string, indent string, output *docWriter) {
+	for _, c := range comments {
+		output.WriteString(indent)
+		output.WriteString(c)
+		output.WriteString("\n")
+	}
+}
+
+// writeHeader writes a table header line, such as [name] or [[name]] followed
+// by its trailing comment, piece by piece rather than through fmt.
+func writeHeader(output *docWriter, indent, open, name, closing, trailing string) {
+	output.WriteString(indent)
+	output.WriteString(open)
+	output.WriteString(name)
+	output.WriteString(closing)
+	output.WriteString(trailing)
+	output.WriteString("\n")
+}
+
+// orderKeys orders the keys of the table at currentPath. Keys are sorted
+// alphabetically unless opts.SortKeys keeps the source order and it is known,
+// in which case declared keys come first in source order, followed by any keys
+// missing from the source (e.g. added programmatically) in alphabetical order.
+func orderKeys(keys []string, currentPath []string, opts Options) []string {
+	sort.Strings(keys) // Alphabetical order is the default and the fallback
+	if !opts.SortKeys.keepsSourceOrder() {
+		return keys
+	}
+	declared := opts.Source.keysInOrder(currentPath)
+	if declared == nil {
+		return keys
+	}
+	present := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		present[k] = true
+	}
+	ordered := make([]string, 0, len(keys))
+	for _, k := range declared {
+		if present[k] {
+			ordered = append(ordered, k)
+			delete(present, k) // Anything left over was not declared in the source
+		}
+	}
+	for _, k := range keys {
+		if present[k] {
+			ordered = append(ordered, k)
+		}
+	}
+	return ordered
+}
+
+// blankLineGroups stably reorders simple keys by the blank-line separated group
+// they were declared in (see Options.PreserveBlankLines), keeping their order
+// within each group, and returns the group of each key.
+//
+// Parameters:
+//   - keys: Simple keys in the order they would otherwise be written
+//   - sourcePath: Entry path of the table holding the keys, used to look up groups
+//   - opts: Formatting options
+//
+// Returns:
+//   - []string: The keys, grouped
+//   - []int: The group of each key, by index in the returned keys (nil without a source)
+func blankLineGroups(keys []string, sourcePath []string, opts Options) ([]string, []int) {
+	if opts.Source == nil {
+		return keys, nil
+	}
+	groupOf := make(map[string]int, len(keys))
+	last := 0
+	for _, k := range keys {
+		if group, ok := opts.Source.keyGroup(childPath(sourcePath, k)); ok {
+			groupOf[k] = group
+			last = max(last, group)
+		}
+	}
+	for _, k := range keys {
+		if _, ok := groupOf[k]; !ok {
+			groupOf[k] = last // Keys added since the source was read join the last group
+		}
+	}
+	grouped := append([]string{}, keys...)
+	sort.SliceStable(grouped, func(a, b int) bool {
+		return groupOf[grouped[a]] < groupOf[grouped[b]]
+	})
+	groups := make([]int, len(grouped))
+	for i, k := range grouped {
+		groups[i] = groupOf[k]
+	}
+	return grouped, groups
+}
+
+// valueGroup returns the rank of a simple value for GroupKeysByValueType:
+// 0 for scalars, 1 for arrays, and 2 for inline tables.
+func valueGroup(v any) int {
+	if _, ok := asTable(v); ok {
+		return 2
+	}
+	if _, ok := asArray(v); ok {
+		return 1
+	}
+	return 0
+}
+
+// groupByValueType stably reorders simple keys so that scalars come first, then
+// arrays, then inline tables, keeping the existing order within each group.
+func groupByValueType(dataMap map[string]any, keys []string) []string {
+	grouped := append([]string{}, keys...)
+	sort.SliceStable(grouped, func(a, b int) bool {
+		return valueGroup(dataMap[grouped[a]]) < valueGroup(dataMap[grouped[b]])
+	})
+	return grouped
+}
+
+// arrayTableOrder returns the order in which the entries of an array of tables
+// are emitted, as indexes into entries. Entries keep their source order unless
+// opts.SortArrayTables is set; see Options.ArrayTableSortField for how they are
+// compared then. Sorting is stable, so equal entries keep their source order.
+func arrayTableOrder(entries []map[string]any, opts Options) []int {
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	if !opts.SortArrayTables {
+		return order
+	}
+
+	if field := opts.ArrayTableSortField; field != "" {
+		sort.SliceStable(order, func(a, b int) bool {
+			va, okA := entries[order[a]][field]
+			vb, okB := entries[order[b]][field]
+			if !okA || !okB {
+				return okA && !okB // Entries with the field come before entries without it
+			}
+			return compareValues(va, vb) < 0
+		})
+		return order
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return compareTables(entries[order[a]], entries[order[b]]) < 0
+	})
+	return order
+}
+
+// compareTables orders two tables by their content: their key/value pairs are
+// compared in alphabetical key order, first by key and then by value.
+func compareTables(a, b map[string]any) int {
+	keysA, keysB := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(keysA) && i < len(keysB); i++ {
+		if c := strings.Compare(keysA[i], keysB[i]); c != 0 {
+			return c
+		}
+		if c := compareValues(a[keysA[i]], b[keysB[i]]); c != 0 {
+			return c
+		}
+	}
+	return len(keysA) - len(keysB) // A table that is a prefix of the other sorts first
+}
+
+// sortedKeys returns the keys of m in alphabetical order.
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compareValues orders two TOML values for sorting: numbers numerically,
+// strings and datetimes naturally, tables by content (see compareTables), and
+// anything else by its formatted text.
+// It returns a negative number, zero, or a positive number like strings.Compare.
+func compareValues(a, b any) int {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			}
+			return 0
+		}
+	}
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb)
+		}
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			return va.Compare(vb)
+		}
+	case map[string]any:
+		if vb, ok := b.(map[string]any); ok {
+			return compareTables(va, vb)
+		}
+	}
+	textA, _ := formatTomlValue(a) // Unformattable values compare as empty text
+	textB, _ := formatTomlValue(b)
+	return strings.Compare(textA, textB)
+}
+
+// toFloat converts any integer or float value to float64 for comparison.
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
 // formatKey returns a TOML-safe representation of a key.
-// Keys containing spaces are wrapped in double quotes to comply with
-// the TOML spec, which requires quoting keys that contain whitespace.
-// Keys without spaces are returned unchanged.
-func formatKey(k string) string {
-	if strings.Contains(k, " ") {
-		return fmt.Sprintf("%q", k) // Wrap the key in double quotes (e.g. "multi word")
+// Keys that are not valid bare keys (anything but ASCII letters, digits, '_',
+// and '-', such as "multi word", "a.b", or the empty key) are wrapped in double
+// quotes, as the TOML spec requires.
+// When opts.QuoteAmbiguousKeys is set, keys that look like values
+// (see isAmbiguousKey) are quoted as well. Other keys are returned unchanged.
+func formatKey(k string, opts Options) string {
+	if !isBareKey(k) {
+		return `"` + escapeTOMLBasicString(k) + `"` // Wrap the key in double quotes (e.g. "multi word")
+	}
+	if opts.QuoteAmbiguousKeys && isAmbiguousKey(k) {
+		return `"` + escapeTOMLBasicString(k) + `"` // Quote keys that could be read as a value (e.g. "true")
 	}
 	return k // No quoting needed for simple keys
 }
+
+// isBareKey reports whether k can be written without quotes.
+func isBareKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, r := range k {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// displayKey returns the text written for the key at entryPath: the key as it
+// was written in the source when opts.PreserveKeyQuotes is set and the source
+// has it, and formatKey's form otherwise.
+func displayKey(k string, entryPath []string, opts Options) string {
+	if opts.PreserveKeyQuotes && entryPath != nil {
+		if form, ok := opts.Source.keyForm(entryPath); ok {
+			return form
+		}
+	}
+	return formatKey(k, opts)
+}
+
+// headerName returns the dotted name written in a [table] or [[array.table]]
+// header, with every segment quoted as a key would be.
+func headerName(fullPath []string, entryPath []string, opts Options) string {
+	segments := make([]string, len(fullPath))
+	for i, seg := range fullPath {
+		segments[i] = displayKey(seg, entryPath[:i+1], opts)
+	}
+	return strings.Join(segments, ".")
+}
+
+// isAmbiguousKey reports whether a bare key reads like a TOML value under the
+// spec's grammar: a boolean (true, false), a special float (inf, nan, with an
+// optional sign), or an integer or float such as 123, -1_000, 0x1F, 0o17, 0b101,
+// or 1e10. Words that only a looser parser would take for numbers, such as
+// Infinity, NaN, or 0123, are not ambiguous.
+func isAmbiguousKey(k string) bool {
+	switch k {
+	case "true", "false":
+		return true
+	}
+	if len(k) > 2 && k[0] == '0' {
+		// Prefixed integers take no sign and the prefix is lowercase only
+		switch k[1] {
+		case 'x':
+			return isDigitRun(k[2:], isHexDigit)
+		case 'o':
+			return isDigitRun(k[2:], func(c byte) bool { return '0' <= c && c <= '7' })
+		case 'b':
+			return isDigitRun(k[2:], func(c byte) bool { return c == '0' || c == '1' })
+		}
+	}
+
+	unsigned := k
+	if k != "" && (k[0] == '+' || k[0] == '-') {
+		unsigned = k[1:]
+	}
+	if unsigned == "inf" || unsigned == "nan" {
+		return true
+	}
+	mantissa, exponent, hasExponent := unsigned, "", false
+	if i := strings.IndexAny(unsigned, "eE"); i >= 0 {
+		mantissa, exponent, hasExponent = unsigned[:i], unsigned[i+1:], true
+	}
+	intPart, fraction, hasFraction := strings.Cut(mantissa, ".")
+	if !isDigitRun(intPart, isDecimalDigit) || (len(intPart) > 1 && intPart[0] == '0') {
+		return false // Decimal integers have no leading zeros
+	}
+	if hasFraction && !isDigitRun(fraction, isDecimalDigit) {
+		return false
+	}
+	if hasExponent {
+		if exponent != "" && (exponent[0] == '+' || exponent[0] == '-') {
+			exponent = exponent[1:]
+		}
+		return isDigitRun(exponent, isDecimalDigit) // The exponent may have leading zeros
+	}
+	return true
+}
+
+// isDigitRun reports whether s is a non-empty run of digits in which every
+// underscore sits between two digits, as TOML numbers require.
+func isDigitRun(s string, isDigit func(byte) bool) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' {
+			if i == 0 || i == len(s)-1 || s[i+1] == '_' {
+				return false
+			}
+			continue
+		}
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDecimalDigit reports whether c is 0-9.
+func isDecimalDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isHexDigit reports whether c is a hexadecimal digit in either case.
+func isHexDigit(c byte) bool {
+	return isDecimalDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
@@ -5,9 +5,13 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	toml "github.com/pelletier/go-toml/v2"
 )
 
 func TestFormatTomlValue(t *testing.T) {
@@ -20,17 +24,32 @@ func TestFormatTomlValue(t *testing.T) {
 		{"string", "BREAKING CHANGE", `"BREAKING CHANGE"`},
 		{"int", 123, "123"},
 		{"float", 123.45, "123.45"},
+		{"float_integral", 1.0, "1.0"},
+		{"float_shortest_round_trip", math.Nextafter(0.3, 1), "0.30000000000000004"},
+		{"float32_shortest", float32(0.1), "0.1"},
 		{"bool_true", true, "true"},
 		{"bool_false", false, "false"},
-		{"nil", nil, "''"},
 		{"time", time.Date(2023, 1, 10, 15, 4, 5, 0, time.UTC), "2023-01-10T15:04:05Z"},
+		{"local_date", toml.LocalDate{Year: 2023, Month: 1, Day: 10}, "2023-01-10"},
+		{"local_time", toml.LocalTime{Hour: 7, Minute: 32}, "07:32:00"},
+		{"local_time_fraction", toml.LocalTime{Hour: 7, Minute: 32, Nanosecond: 999000000, Precision: 3}, "07:32:00.999"},
+		{
+			"local_datetime",
+			toml.LocalDateTime{LocalDate: toml.LocalDate{Year: 1979, Month: 5, Day: 27}, LocalTime: toml.LocalTime{Hour: 7, Minute: 32}},
+			"1979-05-27T07:32:00",
+		},
+		{"local_date_array", []any{toml.LocalDate{Year: 2023, Month: 1, Day: 10}}, "[2023-01-10]"},
 		{"simple_array", []any{1, "a", true}, `[1, "a", true]`},
 		{"empty_array", []any{}, `[]`},
+		{"nested_array", []any{[]any{1, 2}, []any{"a"}}, `[[1, 2], ["a"]]`},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			got := formatTomlValue(tc.input)
+			got, err := formatTomlValue(tc.input)
+			if err != nil {
+				t.Fatalf("formatTomlValue(%#v) returned unexpected error: %v", tc.input, err)
+			}
 			if got != tc.want {
 				t.Errorf("formatTomlValue(%#v) = %q, want %q", tc.input, got, tc.want)
 			}
@@ -38,6 +57,363 @@ func TestFormatTomlValue(t *testing.T) {
 	}
 }
 
+func TestFormatSpecialFloats(t *testing.T) {
+	inputData := map[string]any{
+		"neg_inf":   math.Inf(-1),
+		"not_a_num": math.NaN(),
+		"pos_inf":   math.Inf(1),
+		"small_inf": float32(math.Inf(1)),
+		"values":    []any{math.Inf(1), math.NaN(), 1.5},
+	}
+	want := `neg_inf   = -inf
+not_a_num = nan
+pos_inf   = inf
+small_inf = inf
+values    = [inf, nan, 1.5]
+`
+	var buf bytes.Buffer
+	if err := Format(inputData, "", &buf); err != nil {
+		t.Fatalf("Format() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("Format() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// The output must parse back to the same special values
+	var reparsed map[string]any
+	if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+		t.Fatalf("decoding formatted output: %v", err)
+	}
+	if f := reparsed["pos_inf"].(float64); !math.IsInf(f, 1) {
+		t.Errorf("pos_inf decoded as %v, want +Inf", f)
+	}
+	if f := reparsed["neg_inf"].(float64); !math.IsInf(f, -1) {
+		t.Errorf("neg_inf decoded as %v, want -Inf", f)
+	}
+	if f := reparsed["not_a_num"].(float64); !math.IsNaN(f) {
+		t.Errorf("not_a_num decoded as %v, want NaN", f)
+	}
+}
+
+func TestFormatWithOptionsFloatFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    float64
+		shortest string
+		decimal  string
+		exponent string
+	}{
+		{"zero", 0, "0.0", "0.0", "0e+00"},
+		{"fraction", 1.5, "1.5", "1.5", "1.5e+00"},
+		{"integral", 3, "3.0", "3.0", "3e+00"},
+		{"hundred_thousands", 123456, "123456.0", "123456.0", "1.23456e+05"},
+		{"millions", 1234567, "1.234567e+06", "1234567.0", "1.234567e+06"},
+		{"huge", 1e21, "1e+21", "1000000000000000000000.0", "1e+21"},
+		{"ten_thousandth", 0.0001, "0.0001", "0.0001", "1e-04"},
+		{"tiny", 1e-5, "1e-05", "0.00001", "1e-05"},
+		{"negative_tiny", -2.5e-7, "-2.5e-07", "-0.00000025", "-2.5e-07"},
+		{"infinity", math.Inf(1), "inf", "inf", "inf"},
+		{"nan", math.NaN(), "nan", "nan", "nan"},
+	}
+
+	for _, tc := range testCases {
+		for _, mode := range []struct {
+			format FloatFormat
+			want   string
+		}{
+			{FloatShortest, tc.shortest},
+			{FloatDecimal, tc.decimal},
+			{FloatExponent, tc.exponent},
+		} {
+			t.Run(tc.name+"_"+string(mode.format), func(t *testing.T) {
+				opts := DefaultOptions()
+				opts.FloatFormat = mode.format
+				var buf bytes.Buffer
+				data := map[string]any{"v": tc.input, "list": []any{tc.input}}
+				if err := FormatWithOptions(data, opts, &buf); err != nil {
+					t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+				}
+				want := "list = [" + mode.want + "]\nv    = " + mode.want + "\n"
+				if buf.String() != want {
+					t.Errorf("FormatWithOptions(%v) = %q, want %q", tc.input, buf.String(), want)
+				}
+
+				// Every notation decodes to the same float
+				var reparsed map[string]any
+				if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+					t.Fatalf("decoding %q: %v", buf.String(), err)
+				}
+				got, ok := reparsed["v"].(float64)
+				if !ok || (got != tc.input && !(math.IsNaN(got) && math.IsNaN(tc.input))) {
+					t.Errorf("round trip of %v = %v (%T)", tc.input, reparsed["v"], reparsed["v"])
+				}
+			})
+		}
+	}
+}
+
+func TestFormatFloatsStayFloats(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input float64
+		want  string
+	}{
+		{"one", 1.0, "1.0"},
+		{"negative_zero", math.Copysign(0, -1), "-0.0"},
+		{"zero", 0, "0.0"},
+		{"hundred", 100.0, "100.0"},
+		{"negative_integral", -3.0, "-3.0"},
+		{"exponent", 1e10, "1e+10"},
+		{"large_exponent", 1e21, "1e+21"},
+		{"small_exponent", 1e-7, "1e-07"},
+		{"fraction", 2.5, "2.5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Format(map[string]any{"v": tc.input}, "", &buf); err != nil {
+				t.Fatalf("Format() returned unexpected error: %v", err)
+			}
+			if want := "v = " + tc.want + "\n"; buf.String() != want {
+				t.Errorf("Format(%v) = %q, want %q", tc.input, buf.String(), want)
+			}
+
+			// The value must decode as a float again, with the same bits (including the sign of zero)
+			var reparsed map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+				t.Fatalf("decoding %q: %v", buf.String(), err)
+			}
+			got, ok := reparsed["v"].(float64)
+			if !ok {
+				t.Fatalf("round trip of %v decoded as %T, want float64", tc.input, reparsed["v"])
+			}
+			if math.Float64bits(got) != math.Float64bits(tc.input) {
+				t.Errorf("round trip of %v = %v", tc.input, got)
+			}
+		})
+	}
+}
+
+func TestFormatNumericLookingStringsStayStrings(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"hex", "0x10", `"0x10"`},
+		{"octal", "0o17", `"0o17"`},
+		{"binary", "0b101", `"0b101"`},
+		{"leading_zeros", "007", `"007"`},
+		{"underscores", "1_000", `"1_000"`},
+		{"decimal", "42", `"42"`},
+		{"float", "3.14", `"3.14"`},
+		{"exponent", "1e10", `"1e10"`},
+		{"inf", "inf", `"inf"`},
+		{"negative_inf", "-inf", `"-inf"`},
+		{"nan", "nan", `"nan"`},
+		{"true", "true", `"true"`},
+		{"false", "false", `"false"`},
+		{"date", "2024-01-02", `"2024-01-02"`},
+		{"empty", "", `""`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := formatTomlValue(tc.input)
+			if err != nil {
+				t.Fatalf("formatTomlValue(%q) returned unexpected error: %v", tc.input, err)
+			}
+			if got != tc.want {
+				t.Errorf("formatTomlValue(%q) = %s, want %s", tc.input, got, tc.want)
+			}
+
+			// A document read from source keeps the value a string, also inside arrays and inline tables
+			input := "v = " + tc.want + "\nlist = [" + tc.want + "]\npoint = { v = " + tc.want + " }\n"
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+			info, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = info
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			var reparsed map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+				t.Fatalf("decoding %q: %v", buf.String(), err)
+			}
+			values := []any{reparsed["v"], reparsed["list"].([]any)[0], reparsed["point"].(map[string]any)["v"]}
+			for _, v := range values {
+				if str, ok := v.(string); !ok || str != tc.input {
+					t.Errorf("round trip of %q gave %#v (%T), want the same string\noutput:\n%s", tc.input, v, v, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestFormatTomlValueIgnoresLocale(t *testing.T) {
+	// Locales that use ',' as the decimal point and '.' or ' ' to group thousands
+	for _, locale := range []string{"de_DE.UTF-8", "fr_FR.UTF-8", "ru_RU.UTF-8"} {
+		t.Run(locale, func(t *testing.T) {
+			t.Setenv("LC_ALL", locale)
+			t.Setenv("LC_NUMERIC", locale)
+			t.Setenv("LANG", locale)
+
+			testCases := []struct {
+				input any
+				want  string
+			}{
+				{int64(1234567890), "1234567890"},
+				{-9876543, "-9876543"},
+				{uint64(18446744073709551615), "18446744073709551615"},
+				{1234.5, "1234.5"},
+				{-0.25, "-0.25"},
+				{float32(3.5), "3.5"},
+				{[]any{1000, 2.5}, "[1000, 2.5]"},
+			}
+			for _, tc := range testCases {
+				got, err := formatTomlValue(tc.input)
+				if err != nil {
+					t.Fatalf("formatTomlValue(%#v) returned unexpected error: %v", tc.input, err)
+				}
+				if got != tc.want {
+					t.Errorf("formatTomlValue(%#v) = %q, want %q", tc.input, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEscapeTOMLBasicString(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "hello", "hello"},
+		{"embedded_quotes", `say "hi"`, `say \"hi\"`},
+		{"backslash", `C:\path`, `C:\\path`},
+		{"short_escapes", "a\bb\tc\nd\fe\rf", `a\bb\tc\nd\fe\rf`},
+		{"other_control", "nul\x00esc\x1bdel\x7f", `nul\u0000esc\u001Bdel\u007F`},
+		{"backtick", "`cmd`", "`cmd`"},
+		{"single_quote", "it's", "it's"},
+		{"bmp_unicode", "café ☕", "café ☕"},
+		{"astral_plane", "emoji 😀 𝄞", "emoji 😀 𝄞"},
+		{"invalid_utf8", "bad\xffbyte", "bad\uFFFDbyte"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := escapeTOMLBasicString(tc.input)
+			if got != tc.want {
+				t.Errorf("escapeTOMLBasicString(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+
+			// The escaped form must decode back to the original (valid UTF-8) value
+			var decoded map[string]string
+			if err := toml.Unmarshal([]byte(`v = "`+got+`"`), &decoded); err != nil {
+				t.Fatalf("decoding escaped string %q: %v", got, err)
+			}
+			if want := strings.ToValidUTF8(tc.input, "\uFFFD"); decoded["v"] != want {
+				t.Errorf("round trip of %q = %q, want %q", tc.input, decoded["v"], want)
+			}
+		})
+	}
+}
+
+func TestFormatKey(t *testing.T) {
+	testCases := []struct {
+		name string
+		key  string
+		opts Options
+		want string
+	}{
+		{"plain", "name", Options{}, "name"},
+		{"space", "multi word", Options{}, `"multi word"`},
+		{"space_and_quote", `say "hi" now`, Options{}, `"say \"hi\" now"`},
+		{"true_default", "true", Options{}, "true"},
+		{"true_quoted", "true", Options{QuoteAmbiguousKeys: true}, `"true"`},
+		{"number_default", "123", Options{}, "123"},
+		{"number_quoted", "123", Options{QuoteAmbiguousKeys: true}, `"123"`},
+		{"inf_default", "inf", Options{}, "inf"},
+		{"inf_quoted", "inf", Options{QuoteAmbiguousKeys: true}, `"inf"`},
+		{"hex_quoted", "0x1F", Options{QuoteAmbiguousKeys: true}, `"0x1F"`},
+		{"not_ambiguous", "info", Options{QuoteAmbiguousKeys: true}, "info"},
+		{"dotted", "a.b", Options{}, `"a.b"`},
+		{"empty", "", Options{}, `""`},
+		{"non_ascii", "café", Options{}, `"café"`},
+		{"dash_underscore", "my-key_2", Options{}, "my-key_2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := formatKey(tc.key, tc.opts)
+			if got != tc.want {
+				t.Errorf("formatKey(%q) = %q, want %q", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsAmbiguousKey(t *testing.T) {
+	testCases := []struct {
+		key  string
+		want bool
+	}{
+		{"true", true},
+		{"false", true},
+		{"True", false},
+		{"inf", true},
+		{"-inf", true},
+		{"nan", true},
+		{"-nan", true},
+		{"Infinity", false},
+		{"NaN", false},
+		{"INF", false},
+		{"123", true},
+		{"-17", true},
+		{"0", true},
+		{"1_000", true},
+		{"1__000", false},
+		{"_1", false},
+		{"1_", false},
+		{"0123", false},
+		{"0x1F", true},
+		{"0xdead_beef", true},
+		{"0X1F", false},
+		{"0x", false},
+		{"-0x1F", false},
+		{"0o17", true},
+		{"0o8", false},
+		{"0b101", true},
+		{"0b2", false},
+		{"1e10", true},
+		{"1E-05", true},
+		{"-2e1_0", true},
+		{"1e", false},
+		{"e10", false},
+		{"1e_1", false},
+		{"0x1p3", false},
+		{"info", false},
+		{"my-key", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			if got := isAmbiguousKey(tc.key); got != tc.want {
+				t.Errorf("isAmbiguousKey(%q) = %v, want %v", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
 // Helper type to simulate write errors
 type errorWriter struct {
 	err error
@@ -138,7 +514,92 @@ func TestFormat(t *testing.T) {
 			indentUnit: "", outputWriter: nil,
 			wantOutput:         "", // Output might be partial ("key_before = ..."), safer not to check exact output on error
 			wantErr:            true,
-			wantErrMsgContains: "key 'bad_arr': arrays cannot mix tables and non-tables",
+			wantErrMsgContains: "key 'bad_arr': arrays cannot mix tables and non-tables: array index 1 has type string, not table",
+		},
+		{
+			name: "error_nested_mixed_array_names_index_and_type",
+			inputData: map[string]any{
+				"servers": map[string]any{
+					"pools": []any{
+						map[string]any{"size": 1},
+						map[string]any{"size": 2},
+						[]any{3},
+					},
+				},
+			},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'servers.pools': arrays cannot mix tables and non-tables: array index 2 has type array, not table",
+		},
+		{
+			name: "error_table_in_nested_array",
+			inputData: map[string]any{
+				"section": map[string]any{
+					"matrix": []any{
+						[]any{1, 2},
+						[]any{map[string]any{"a": 1}}, // Table inside a plain array value
+					},
+				},
+			},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'section.matrix': array index 1: array index 0: table found inside an array value",
+		},
+		{
+			name: "error_table_after_scalar_in_array",
+			inputData: map[string]any{
+				"mixed": []any{1, map[string]any{"a": 1}},
+			},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'mixed': array index 1: table found inside an array value",
+		},
+		{
+			name: "error_nil_value",
+			inputData: map[string]any{
+				"server": map[string]any{"host": "localhost", "port": nil},
+			},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'server.port': nil value cannot be represented in TOML",
+		},
+		{
+			name:               "error_nil_in_array",
+			inputData:          map[string]any{"ports": []any{80, nil}},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'ports': array index 1: nil value cannot be represented in TOML",
+		},
+		{
+			name: "error_unsupported_type",
+			inputData: map[string]any{
+				"server": map[string]any{"timeout": struct{ Seconds int }{30}},
+			},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'server.timeout': unsupported value type struct { Seconds int }",
+		},
+		{
+			name:               "error_unsupported_type_in_array",
+			inputData:          map[string]any{"handlers": []any{"log", func() {}}},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'handlers': array index 1: unsupported value type func()",
+		},
+		{
+			name:               "error_unsupported_type_in_array_table",
+			inputData:          map[string]any{"workers": []any{map[string]any{"queue": make(chan int)}}},
+			indentUnit:         "",
+			outputWriter:       nil,
+			wantErr:            true,
+			wantErrMsgContains: "key 'workers.queue': unsupported value type chan int",
 		},
 		{
 			name:               "error_write_failed",
@@ -201,3 +662,2743 @@ func TestFormat(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatNilWriter(t *testing.T) {
+	data := map[string]any{"key": "value"}
+	const want = "output writer must not be nil"
+
+	if err := Format(data, "", nil); err == nil || err.Error() != want {
+		t.Errorf("Format() with nil writer error = %v, want %q", err, want)
+	}
+	if err := FormatWithOptions(data, DefaultOptions(), nil); err == nil || err.Error() != want {
+		t.Errorf("FormatWithOptions() with nil writer error = %v, want %q", err, want)
+	}
+}
+
+func TestFormatWithOptionsFinalNewlines(t *testing.T) {
+	inputData := map[string]any{
+		"key":   "value",
+		"table": map[string]any{"a": 1},
+	}
+
+	testCases := []struct {
+		name          string
+		finalNewlines int
+		wantOutput    string
+	}{
+		{"zero", 0, "key = \"value\"\n\n[table]\na = 1"},
+		{"one", 1, "key = \"value\"\n\n[table]\na = 1\n"},
+		{"two", 2, "key = \"value\"\n\n[table]\na = 1\n\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.FinalNewlines = tc.finalNewlines
+
+			var first bytes.Buffer
+			if err := FormatWithOptions(inputData, opts, &first); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if first.String() != tc.wantOutput {
+				t.Errorf("FormatWithOptions() output = %q, want %q", first.String(), tc.wantOutput)
+			}
+
+			// Formatting the output again must not change it
+			var reparsed map[string]any
+			if err := toml.Unmarshal(first.Bytes(), &reparsed); err != nil {
+				t.Fatalf("output does not parse as TOML: %v", err)
+			}
+			var second bytes.Buffer
+			if err := FormatWithOptions(reparsed, opts, &second); err != nil {
+				t.Fatalf("FormatWithOptions() second pass returned unexpected error: %v", err)
+			}
+			if second.String() != first.String() {
+				t.Errorf("FormatWithOptions() is not idempotent:\nfirst:  %q\nsecond: %q", first.String(), second.String())
+			}
+		})
+	}
+
+	t.Run("empty_document", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.FinalNewlines = 2
+		var buf bytes.Buffer
+		if err := FormatWithOptions(map[string]any{}, opts, &buf); err != nil {
+			t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("FormatWithOptions() on empty document = %q, want empty output", buf.String())
+		}
+	})
+}
+
+func TestFormatEndsWithOneNewline(t *testing.T) {
+	testCases := []struct {
+		name       string
+		input      string // Parsed with its source, so comments are kept
+		wantEnding string // The end of the output
+	}{
+		{"simple_key", "a = 1\n\n\n", "a = 1\n"},
+		{"table", "a = 1\n[t]\nb = 2\n\n", "[t]\nb = 2\n"},
+		{"empty_table", "a = 1\n[t]\n\n\n", "[t]\n"},
+		{"nested_empty_table", "[t]\n[t.u]\n", "[t.u]\n"},
+		{"array_table", "a = 1\n[[t]]\nb = 2\n\n[[t]]\nb = 3\n\n", "[[t]]\nb = 3\n"},
+		{"empty_array_table", "[[t]]\nb = 2\n[[t]]\n\n", "[[t]]\n"},
+		{"trailing_comment", "a = 1 # note   \n", "a = 1 # note\n"},
+		{"footer_comment", "a = 1\n\n# the end\n\n\n", "# the end\n"},
+		{"no_final_newline", "[t]\nb = 2", "[t]\nb = 2\n"},
+		{"trailing_spaces_in_string", "a = \"x   \"\n", "a = \"x   \"\n"},
+	}
+
+	for _, tc := range testCases {
+		for _, separators := range []int{0, 1, 3} {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(tc.input), &data); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+			info, err := ParseSourceInfo([]byte(tc.input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = info
+			opts.Separators = SeparatorPolicy{separators, separators, separators, separators, separators, separators}
+
+			var buffered, streamed bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buffered); err != nil {
+				t.Fatalf("%s: FormatWithOptions() returned unexpected error: %v", tc.name, err)
+			}
+			if err := StreamWithOptions(data, opts, &streamed); err != nil {
+				t.Fatalf("%s: StreamWithOptions() returned unexpected error: %v", tc.name, err)
+			}
+			for _, got := range []string{buffered.String(), streamed.String()} {
+				if !strings.HasSuffix(got, tc.wantEnding) || strings.HasSuffix(got, "\n\n") {
+					t.Errorf("%s with %d separator lines: output %q should end with exactly %q",
+						tc.name, separators, got, tc.wantEnding)
+				}
+			}
+		}
+	}
+}
+
+func TestFormatWithOptionsSortNone(t *testing.T) {
+	input := `zeta = 1
+alpha = "a"
+
+[[servers]]
+name = "b"
+host = "x"
+
+[config]
+verbose = true
+level = 3
+
+[[clients]]
+id = 7
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("invalid test input: %v", err)
+	}
+	info, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+	data["added"] = 0 // Keys missing from the source are emitted after declared keys
+
+	withSort := func(mode SortMode, source *SourceInfo) Options {
+		opts := DefaultOptions()
+		opts.SortKeys = mode
+		opts.Source = source
+		return opts
+	}
+
+	testCases := []struct {
+		name       string
+		opts       Options
+		wantOutput string
+	}{
+		{
+			name: "asc",
+			opts: withSort(SortAscending, info),
+			wantOutput: "added = 0\nalpha = \"a\"\nzeta  = 1\n\n" +
+				"[[clients]]\nid = 7\n\n" +
+				"[[servers]]\nhost = \"x\"\nname = \"b\"\n\n" +
+				"[config]\nlevel   = 3\nverbose = true\n",
+		},
+		{
+			name: "none",
+			opts: withSort(SortNone, info),
+			wantOutput: "zeta  = 1\nalpha = \"a\"\nadded = 0\n\n" +
+				"[[servers]]\nname = \"b\"\nhost = \"x\"\n\n" +
+				"[config]\nverbose = true\nlevel   = 3\n\n" +
+				"[[clients]]\nid = 7\n",
+		},
+		{
+			name: "none_without_source",
+			opts: withSort(SortNone, nil),
+			wantOutput: "added = 0\nalpha = \"a\"\nzeta  = 1\n\n" +
+				"[[clients]]\nid = 7\n\n" +
+				"[[servers]]\nhost = \"x\"\nname = \"b\"\n\n" +
+				"[config]\nlevel   = 3\nverbose = true\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, tc.opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.wantOutput {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.wantOutput)
+			}
+		})
+	}
+}
+
+// TestFormatSortNoneInterleavedArrayTables checks that with SortNone array tables
+// keep their place among regular tables, at every level. Entries of one array
+// table written apart in the source are gathered where the first one appears.
+func TestFormatSortNoneInterleavedArrayTables(t *testing.T) {
+	input := `[[servers]]
+name = "a"
+
+[db]
+x = 1
+
+[[clients]]
+name = "c"
+
+[[servers]]
+name = "b"
+
+[db.replica]
+host = "r"
+
+[[db.pools]]
+size = 2
+
+[db.cache]
+ttl = 5
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("invalid test input: %v", err)
+	}
+	info, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		sortKeys   SortMode
+		wantOutput string
+	}{
+		{
+			name:     "none",
+			sortKeys: SortNone,
+			wantOutput: "[[servers]]\nname = \"a\"\n\n[[servers]]\nname = \"b\"\n\n" +
+				"[db]\nx = 1\n\n[db.replica]\nhost = \"r\"\n\n[[db.pools]]\nsize = 2\n\n[db.cache]\nttl = 5\n\n" +
+				"[[clients]]\nname = \"c\"\n",
+		},
+		{
+			name:     "asc",
+			sortKeys: SortAscending,
+			wantOutput: "[[clients]]\nname = \"c\"\n\n[[servers]]\nname = \"a\"\n\n[[servers]]\nname = \"b\"\n\n" +
+				"[db]\nx = 1\n\n[[db.pools]]\nsize = 2\n\n[db.cache]\nttl = 5\n\n[db.replica]\nhost = \"r\"\n",
+		},
+		{
+			name:     "group-only",
+			sortKeys: SortGroupOnly,
+			wantOutput: "[[servers]]\nname = \"a\"\n\n[[servers]]\nname = \"b\"\n\n[[clients]]\nname = \"c\"\n\n" +
+				"[db]\nx = 1\n\n[[db.pools]]\nsize = 2\n\n[db.replica]\nhost = \"r\"\n\n[db.cache]\nttl = 5\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SortKeys = tc.sortKeys
+			opts.Source = info
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.wantOutput {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.wantOutput)
+			}
+		})
+	}
+}
+
+func TestFormatSortGroupOnly(t *testing.T) {
+	input := `zeta = 1
+[beta]
+b2 = 2
+b1 = 1
+
+[[items]]
+n = 1
+alpha = "a"
+mid = 3
+
+[aardvark]
+q = true
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("invalid test input: %v", err)
+	}
+	info, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		sortKeys   SortMode
+		source     *SourceInfo
+		wantOutput string
+	}{
+		{
+			name:     "asc sorts every group",
+			sortKeys: SortAscending,
+			source:   info,
+			wantOutput: "zeta = 1\n\n[[items]]\nalpha = \"a\"\nmid   = 3\nn     = 1\n\n" +
+				"[aardvark]\nq = true\n\n[beta]\nb1 = 1\nb2 = 2\n",
+		},
+		{
+			name:     "none keeps the source order of keys and sections",
+			sortKeys: SortNone,
+			source:   info,
+			wantOutput: "zeta = 1\n\n[beta]\nb2 = 2\nb1 = 1\n\n" +
+				"[[items]]\nn     = 1\nalpha = \"a\"\nmid   = 3\n\n[aardvark]\nq = true\n",
+		},
+		{
+			name:     "group-only keeps the source order within groups",
+			sortKeys: SortGroupOnly,
+			source:   info,
+			wantOutput: "zeta = 1\n\n[[items]]\nn     = 1\nalpha = \"a\"\nmid   = 3\n\n" +
+				"[beta]\nb2 = 2\nb1 = 1\n\n[aardvark]\nq = true\n",
+		},
+		{
+			name:     "group-only without a source falls back to alphabetical order",
+			sortKeys: SortGroupOnly,
+			wantOutput: "zeta = 1\n\n[[items]]\nalpha = \"a\"\nmid   = 3\nn     = 1\n\n" +
+				"[aardvark]\nq = true\n\n[beta]\nb1 = 1\nb2 = 2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SortKeys = tc.sortKeys
+			opts.Source = tc.source
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.wantOutput {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.wantOutput)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsSectionOrder(t *testing.T) {
+	inputData := map[string]any{
+		"name":    "app",
+		"servers": []any{map[string]any{"host": "a"}, map[string]any{"host": "b"}},
+		"db": map[string]any{
+			"port":  5432,
+			"pools": []any{map[string]any{"size": 2}},
+			"cache": map[string]any{"ttl": 5},
+		},
+	}
+
+	testCases := []struct {
+		name       string
+		order      SectionOrder
+		wantOutput string
+	}{
+		{
+			name:  "array tables first",
+			order: SectionArrayTablesFirst,
+			wantOutput: "name = \"app\"\n\n[[servers]]\nhost = \"a\"\n\n[[servers]]\nhost = \"b\"\n\n" +
+				"[db]\nport = 5432\n\n[[db.pools]]\nsize = 2\n\n[db.cache]\nttl = 5\n",
+		},
+		{
+			name:  "zero value behaves like array tables first",
+			order: "",
+			wantOutput: "name = \"app\"\n\n[[servers]]\nhost = \"a\"\n\n[[servers]]\nhost = \"b\"\n\n" +
+				"[db]\nport = 5432\n\n[[db.pools]]\nsize = 2\n\n[db.cache]\nttl = 5\n",
+		},
+		{
+			name:  "tables first",
+			order: SectionTablesFirst,
+			wantOutput: "name = \"app\"\n\n[db]\nport = 5432\n\n[db.cache]\nttl = 5\n\n[[db.pools]]\nsize = 2\n\n" +
+				"[[servers]]\nhost = \"a\"\n\n[[servers]]\nhost = \"b\"\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SectionOrder = tc.order
+			var buf bytes.Buffer
+			if err := FormatWithOptions(inputData, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.wantOutput {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.wantOutput)
+			}
+			// Either layout must decode back to the same data
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("output is not valid TOML: %v", err)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsIndentMode(t *testing.T) {
+	inputData := map[string]any{
+		"name":    "app",
+		"servers": []any{map[string]any{"host": "a", "tls": map[string]any{"cert": "c"}}},
+		"db": map[string]any{
+			"port":  5432,
+			"cache": map[string]any{"ttl": 5, "lru": map[string]any{"size": 9}},
+		},
+	}
+
+	testCases := []struct {
+		name       string
+		mode       IndentMode
+		wantOutput string
+	}{
+		{
+			name: "nested",
+			mode: IndentNested,
+			wantOutput: "name = \"app\"\n\n[[servers]]\n  host = \"a\"\n\n  [servers.tls]\n    cert = \"c\"\n\n" +
+				"[db]\n  port = 5432\n\n  [db.cache]\n    ttl = 5\n\n    [db.cache.lru]\n      size = 9\n",
+		},
+		{
+			name: "zero value behaves like nested",
+			mode: "",
+			wantOutput: "name = \"app\"\n\n[[servers]]\n  host = \"a\"\n\n  [servers.tls]\n    cert = \"c\"\n\n" +
+				"[db]\n  port = 5432\n\n  [db.cache]\n    ttl = 5\n\n    [db.cache.lru]\n      size = 9\n",
+		},
+		{
+			name: "tables only",
+			mode: IndentTablesOnly,
+			wantOutput: "name = \"app\"\n\n[[servers]]\nhost = \"a\"\n\n  [servers.tls]\n  cert = \"c\"\n\n" +
+				"[db]\nport = 5432\n\n  [db.cache]\n  ttl = 5\n\n    [db.cache.lru]\n    size = 9\n",
+		},
+		{
+			name: "entries only",
+			mode: IndentEntriesOnly,
+			wantOutput: "name = \"app\"\n\n[[servers]]\n  host = \"a\"\n\n[servers.tls]\n  cert = \"c\"\n\n" +
+				"[db]\n  port = 5432\n\n[db.cache]\n  ttl = 5\n\n[db.cache.lru]\n  size = 9\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.IndentUnit = "  "
+			opts.IndentMode = tc.mode
+			var buf bytes.Buffer
+			if err := FormatWithOptions(inputData, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.wantOutput {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.wantOutput)
+			}
+			// Indentation never changes the data
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("output is not valid TOML: %v", err)
+			}
+		})
+	}
+
+	// Without an indentation unit every mode is flush-left
+	opts := DefaultOptions()
+	opts.IndentMode = IndentEntriesOnly
+	var buf bytes.Buffer
+	if err := FormatWithOptions(inputData, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "\n ") {
+		t.Errorf("FormatWithOptions() indented output without an IndentUnit:\n%s", buf.String())
+	}
+}
+
+func TestFormatWithOptionsPreserveBlankLines(t *testing.T) {
+	input := `name = "app"
+version = "1.0"
+
+
+# Connection
+host = "localhost"
+port = 8080
+
+[server]
+timeout = 30
+retries = 3
+
+tls = true
+cert = "a.pem"
+
+[[workers]]
+id = 1
+
+queue = "a"
+`
+	testCases := []struct {
+		name     string
+		sortKeys SortMode
+		preserve bool
+		extra    map[string]any
+		want     string
+	}{
+		{
+			name:     "off",
+			sortKeys: SortAscending,
+			want: `# Connection
+host    = "localhost"
+name    = "app"
+port    = 8080
+version = "1.0"
+
+[[workers]]
+id    = 1
+queue = "a"
+
+[server]
+cert    = "a.pem"
+retries = 3
+timeout = 30
+tls     = true
+`,
+		},
+		{
+			name:     "sorted within groups",
+			sortKeys: SortAscending,
+			preserve: true,
+			want: `name    = "app"
+version = "1.0"
+
+# Connection
+host = "localhost"
+port = 8080
+
+[[workers]]
+id = 1
+
+queue = "a"
+
+[server]
+retries = 3
+timeout = 30
+
+cert = "a.pem"
+tls  = true
+`,
+		},
+		{
+			name:     "source order",
+			sortKeys: SortNone,
+			preserve: true,
+			want: `name    = "app"
+version = "1.0"
+
+# Connection
+host = "localhost"
+port = 8080
+
+[server]
+timeout = 30
+retries = 3
+
+tls  = true
+cert = "a.pem"
+
+[[workers]]
+id = 1
+
+queue = "a"
+`,
+		},
+		{
+			name:     "added keys join the last group",
+			sortKeys: SortAscending,
+			preserve: true,
+			extra:    map[string]any{"debug": true},
+			want: `name    = "app"
+version = "1.0"
+
+debug = true
+# Connection
+host = "localhost"
+port = 8080
+
+[[workers]]
+id = 1
+
+queue = "a"
+
+[server]
+retries = 3
+timeout = 30
+
+cert = "a.pem"
+tls  = true
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+			for k, v := range tc.extra {
+				data[k] = v
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.SortKeys = tc.sortKeys
+			opts.PreserveBlankLines = tc.preserve
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsSeparators(t *testing.T) {
+	// One document exercising every transition the separator policy distinguishes
+	inputData := map[string]any{
+		"a":   1,
+		"arr": []any{map[string]any{"x": 1}, map[string]any{"y": 2}},
+		"t1": map[string]any{
+			"items": []any{map[string]any{"z": 1}},
+		},
+		"t2": map[string]any{
+			"k":   1,
+			"sub": map[string]any{"m": 1},
+		},
+	}
+	render := func(p SeparatorPolicy) string {
+		sep := func(n int) string { return strings.Repeat("\n", n) }
+		return "a = 1\n" +
+			sep(p.KeysToArrayTable) + "[[arr]]\nx = 1\n" +
+			sep(p.ArrayTableToArrayTable) + "[[arr]]\ny = 2\n" +
+			sep(p.ArrayTableToTable) + "[t1]\n" +
+			sep(p.TableToArrayTable) + "[[t1.items]]\nz = 1\n" +
+			sep(p.TableToTable) + "[t2]\nk = 1\n" +
+			sep(p.KeysToTable) + "[t2.sub]\nm = 1\n"
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(p *SeparatorPolicy)
+	}{
+		{"defaults", func(p *SeparatorPolicy) {}},
+		{"keys_to_array_table", func(p *SeparatorPolicy) { p.KeysToArrayTable = 0 }},
+		{"keys_to_table", func(p *SeparatorPolicy) { p.KeysToTable = 0 }},
+		{"array_table_to_array_table", func(p *SeparatorPolicy) { p.ArrayTableToArrayTable = 0 }},
+		{"array_table_to_table", func(p *SeparatorPolicy) { p.ArrayTableToTable = 2 }},
+		{"table_to_array_table", func(p *SeparatorPolicy) { p.TableToArrayTable = 0 }},
+		{"table_to_table", func(p *SeparatorPolicy) { p.TableToTable = 2 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tc.modify(&opts.Separators)
+			var buf bytes.Buffer
+			if err := FormatWithOptions(inputData, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if want := render(opts.Separators); buf.String() != want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsComments(t *testing.T) {
+	input := `# Document header
+
+# about zeta
+zeta = 1 # last letter
+# first letter
+alpha = 2
+
+# the server
+[server]
+port = 80 # http
+
+[[users]] # admin
+name = "root"
+
+[[users]]
+# regular user
+name = "guest"
+
+# the end
+`
+	want := `# Document header
+
+# first letter
+alpha = 2
+# about zeta
+zeta = 1 # last letter
+
+[[users]] # admin
+  name = "root"
+
+[[users]]
+  # regular user
+  name = "guest"
+
+# the server
+[server]
+  port = 80 # http
+# the end
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	source, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.IndentUnit = "  "
+	opts.Source = source
+
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Without source information the comments are simply absent
+	buf.Reset()
+	opts.Source = nil
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "#") {
+		t.Errorf("FormatWithOptions() without Source emitted comments:\n%s", buf.String())
+	}
+}
+
+func TestFormatWithOptionsArrayTableOrder(t *testing.T) {
+	inputData := map[string]any{
+		"servers": []any{
+			map[string]any{"name": "web", "weight": int64(10)},
+			map[string]any{"name": "db", "weight": int64(2)},
+			map[string]any{"name": "cache"},
+			map[string]any{"name": "api", "weight": 2.5},
+		},
+	}
+	entry := func(name string, weight string) string {
+		if weight == "" {
+			return "[[servers]]\nname = \"" + name + "\"\n"
+		}
+		return "[[servers]]\nname   = \"" + name + "\"\nweight = " + weight + "\n"
+	}
+	web, db, cache, api := entry("web", "10"), entry("db", "2"), entry("cache", ""), entry("api", "2.5")
+
+	testCases := []struct {
+		name  string
+		sort  bool
+		field string
+		want  []string
+	}{
+		{"default_keeps_source_order", false, "", []string{web, db, cache, api}},
+		{"field_ignored_without_sort", false, "name", []string{web, db, cache, api}},
+		{"sorted_by_content", true, "", []string{api, cache, db, web}},
+		{"sorted_by_string_field", true, "name", []string{api, cache, db, web}},
+		{"sorted_by_numeric_field_missing_last", true, "weight", []string{db, api, web, cache}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.SortArrayTables = tc.sort
+			opts.ArrayTableSortField = tc.field
+			var buf bytes.Buffer
+			if err := FormatWithOptions(inputData, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if want := strings.Join(tc.want, "\n"); buf.String() != want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsAnnotations(t *testing.T) {
+	input := `name = "app"
+port = 8080 # from the source
+
+[server]
+host = "localhost"
+
+[[plugins]]
+id = 1
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	source, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+
+	opts := DefaultOptions()
+	opts.Source = source
+	opts.Annotations = map[string]string{
+		"name":        "Application name",
+		"port":        "ignored: the source comment wins",
+		"server":      "# Network settings",
+		"server.host": "Interface to bind,\nor 0.0.0.0 for all",
+		"plugins":     "One entry per plugin",
+		"plugins.id":  "default: 1",
+		"missing":     "Annotations for absent keys are ignored",
+	}
+	want := `name = "app" # Application name
+port = 8080 # from the source
+
+[[plugins]] # One entry per plugin
+id = 1 # default: 1
+
+[server] # Network settings
+host = "localhost" # Interface to bind, or 0.0.0.0 for all
+`
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestFormatValueMultilineStrings(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		mode  MultilineMode
+		want  string
+	}{
+		{"never_mode", "a\nb", MultilineNever, `"a\nb"`},
+		{"zero_value_mode", "a\nb", "", `"a\nb"`},
+		{"no_newline", "plain \"text\"", MultilineWhenNewlines, `"plain \"text\""`},
+		{"script", "#!/bin/sh\necho hi\n", MultilineWhenNewlines, "\"\"\"\n#!/bin/sh\necho hi\n\"\"\""},
+		{"leading_newline", "\nbody", MultilineWhenNewlines, "\"\"\"\n\nbody\"\"\""},
+		{"tabs_and_backslashes", "a\tb\\c\nd", MultilineWhenNewlines, "\"\"\"\na\tb\\\\c\nd\"\"\""},
+		{"carriage_return", "line1\r\nline2", MultilineWhenNewlines, "\"\"\"\nline1\\r\nline2\"\"\""},
+		{"two_quotes", "say \"\"\nok", MultilineWhenNewlines, "\"\"\"\nsay \"\"\nok\"\"\""},
+		{"triple_quotes", "x\"\"\"\"y\n", MultilineWhenNewlines, "\"\"\"\nx\"\"\\\"\"y\n\"\"\""},
+		{"trailing_quote", "quoted\n\"", MultilineWhenNewlines, "\"\"\"\nquoted\n\\\"\"\"\""},
+		{"control_character", "bell\a\n", MultilineWhenNewlines, "\"\"\"\nbell\\u0007\n\"\"\""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MultilineStrings = tc.mode
+			got, err := formatValue(tc.input, nil, nil, opts)
+			if err != nil {
+				t.Fatalf("formatValue(%q) returned unexpected error: %v", tc.input, err)
+			}
+			if got != tc.want {
+				t.Errorf("formatValue(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+
+			// Whatever the form, the value must decode back unchanged
+			var decoded map[string]string
+			if err := toml.Unmarshal([]byte("v = "+got+"\n"), &decoded); err != nil {
+				t.Fatalf("decoding %q: %v", got, err)
+			}
+			if decoded["v"] != tc.input {
+				t.Errorf("round trip of %q = %q", tc.input, decoded["v"])
+			}
+		})
+	}
+
+	// Strings inside arrays stay on one line
+	opts := DefaultOptions()
+	opts.MultilineStrings = MultilineWhenNewlines
+	got, err := formatValue([]any{"a\nb"}, nil, nil, opts)
+	if err != nil {
+		t.Fatalf("formatValue() returned unexpected error: %v", err)
+	}
+	if want := `["a\nb"]`; got != want {
+		t.Errorf("formatValue() of array = %q, want %q", got, want)
+	}
+}
+
+func TestFormatWithOptionsIntegerBase(t *testing.T) {
+	input := `[files]
+mode = 0o644
+dir_mode = 0o755
+owner = 1000
+magic = 0xDEAD_BEEF
+mask = 0xff
+flags = 0b1010
+offset = -42
+limits = { max = 0x10 }
+ports = [0x50, 443]
+
+[[users]]
+uid = 0o17
+
+[[users]]
+uid = 17
+`
+	want := `[[users]]
+uid = 0o17
+
+[[users]]
+uid = 17
+
+[files]
+dir_mode = 0o755
+flags    = 0b1010
+limits   = { max = 0x10 }
+magic    = 0xDEADBEEF
+mask     = 0xff
+mode     = 0o644
+offset   = -42
+owner    = 1000
+ports    = [80, 443]
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	source, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.Source = source
+
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// The preserved notation decodes to the same values
+	var reparsed map[string]any
+	if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+		t.Fatalf("decoding formatted output: %v", err)
+	}
+	files := reparsed["files"].(map[string]any)
+	if files["mode"] != int64(0o644) || files["magic"] != int64(0xDEADBEEF) || files["flags"] != int64(10) {
+		t.Errorf("formatted values changed: %v", files)
+	}
+}
+
+func TestFormatConcreteMapTypes(t *testing.T) {
+	type label string
+	inputData := map[string]any{
+		"name":   "app",
+		"env":    map[string]string{"HOME": "/root", "PATH": "/bin"},
+		"limits": map[string]int{"cpu": 2, "memory": 512},
+		"labels": map[label]bool{"beta": true},
+		"nested": map[string]map[string]int{"inner": {"x": 1}},
+		"empty":  map[string]string(nil),
+		"hosts":  []any{map[string]string{"ip": "10.0.0.1"}, map[string]string{"ip": "10.0.0.2"}},
+	}
+	want := `name = "app"
+
+[[hosts]]
+ip = "10.0.0.1"
+
+[[hosts]]
+ip = "10.0.0.2"
+
+[empty]
+
+[env]
+HOME = "/root"
+PATH = "/bin"
+
+[labels]
+beta = true
+
+[limits]
+cpu    = 2
+memory = 512
+
+[nested]
+
+[nested.inner]
+x = 1
+`
+	var buf bytes.Buffer
+	if err := Format(inputData, "", &buf); err != nil {
+		t.Fatalf("Format() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("Format() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// A concrete map inside a plain array value is still rejected
+	err := Format(map[string]any{"mixed": []any{1, map[string]int{"a": 1}}}, "", &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "key 'mixed': array index 1: table found inside an array value") {
+		t.Errorf("Format() error = %v, want table-in-array error", err)
+	}
+}
+
+func TestFormatConcreteSliceTypes(t *testing.T) {
+	inputData := map[string]any{
+		"names":   []string{"a", "b"},
+		"ports":   []int{80, 443},
+		"matrix":  [][]int{{1, 2}, {3}},
+		"fixed":   [2]bool{true, false},
+		"none":    []string(nil),
+		"servers": []map[string]any{{"host": "x"}, {"host": "y"}},
+		"users":   []map[string]string{{"name": "root"}},
+	}
+	want := `fixed  = [true, false]
+matrix = [[1, 2], [3]]
+names  = ["a", "b"]
+none   = []
+ports  = [80, 443]
+
+[[servers]]
+host = "x"
+
+[[servers]]
+host = "y"
+
+[[users]]
+name = "root"
+`
+	var buf bytes.Buffer
+	if err := Format(inputData, "", &buf); err != nil {
+		t.Fatalf("Format() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("Format() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// The caller's data is left untouched
+	if _, ok := inputData["servers"].([]map[string]any); !ok {
+		t.Errorf("Format() modified the input data: servers is now %T", inputData["servers"])
+	}
+}
+
+func TestFormatWithOptionsTrimsTrailingWhitespace(t *testing.T) {
+	input := "# header   \n\n# about name \t\nname = \"app\"   # trailing  \t\n[server]  \n# port comment  \nport = 80\n# footer \t \n"
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	data["script"] = "echo hi  \n\tdone\t\nlast "
+	source, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.IndentUnit = "\t"
+	opts.Source = source
+	opts.MultilineStrings = MultilineWhenNewlines
+	opts.Annotations = map[string]string{"server.port": "annotated  "}
+
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	for i, line := range strings.Split(buf.String(), "\n") {
+		if strings.TrimRight(line, " \t") != line {
+			t.Errorf("output line %d has trailing whitespace: %q\nfull output:\n%s", i+1, line, buf.String())
+		}
+	}
+
+	// Whitespace inside the multi-line string is escaped rather than lost
+	var reparsed map[string]any
+	if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+		t.Fatalf("decoding formatted output: %v\n%s", err, buf.String())
+	}
+	if reparsed["script"] != data["script"] {
+		t.Errorf("script round trip = %q, want %q", reparsed["script"], data["script"])
+	}
+}
+
+func TestFormatWithOptionsInlineTables(t *testing.T) {
+	input := `name = "app"
+point = { y = 2, x = 1 }
+empty = {}
+style = { color = { fg = "red", bg = "black" }, flags = [1, 2], mask = 0xff }
+
+[server]
+host = "localhost"
+port = 8080
+
+[size]
+width = 3
+height = 4
+
+[deep]
+inner = { a = 1 }
+
+[deep.table]
+b = 2
+`
+	testCases := []struct {
+		name     string
+		sortKeys SortMode
+		maxKeys  int
+		want     string
+	}{
+		{
+			name:     "source_inline_only",
+			sortKeys: SortAscending,
+			want: `empty = {}
+name  = "app"
+point = { x = 1, y = 2 }
+style = { color = { bg = "black", fg = "red" }, flags = [1, 2], mask = 0xff }
+
+[deep]
+inner = { a = 1 }
+
+[deep.table]
+b = 2
+
+[server]
+host = "localhost"
+port = 8080
+
+[size]
+height = 4
+width  = 3
+`,
+		},
+		{
+			name:     "max_keys",
+			sortKeys: SortAscending,
+			maxKeys:  2,
+			want: `empty  = {}
+name   = "app"
+point  = { x = 1, y = 2 }
+server = { host = "localhost", port = 8080 }
+size   = { height = 4, width = 3 }
+style  = { color = { bg = "black", fg = "red" }, flags = [1, 2], mask = 0xff }
+
+[deep]
+inner = { a = 1 }
+table = { b = 2 }
+`,
+		},
+		{
+			name:     "source_order",
+			sortKeys: SortNone,
+			want: `name  = "app"
+point = { y = 2, x = 1 }
+empty = {}
+style = { color = { fg = "red", bg = "black" }, flags = [1, 2], mask = 0xff }
+
+[server]
+host = "localhost"
+port = 8080
+
+[size]
+width  = 3
+height = 4
+
+[deep]
+inner = { a = 1 }
+
+[deep.table]
+b = 2
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.SortKeys = tc.sortKeys
+			opts.InlineTableMaxKeys = tc.maxKeys
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			var reparsed map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &reparsed); err != nil {
+				t.Fatalf("decoding formatted output: %v\n%s", err, buf.String())
+			}
+			if !reflect.DeepEqual(reparsed, data) {
+				t.Errorf("formatted output decodes to %v, want %v", reparsed, data)
+			}
+		})
+	}
+}
+
+func TestFormatInlineTableHeuristic(t *testing.T) {
+	data := map[string]any{
+		"flat":      map[string]any{"a": 1},
+		"nested":    map[string]any{"inner": map[string]any{"a": 1}},
+		"array":     map[string]any{"items": []any{map[string]any{"a": 1}}},
+		"too_large": map[string]any{"a": 1, "b": 2, "c": 3},
+		"empty":     map[string]any{},
+		"typed":     map[string]int{"z": 1, "y": 2},
+	}
+	want := `flat  = { a = 1 }
+typed = { y = 2, z = 1 }
+
+[array]
+
+[[array.items]]
+a = 1
+
+[empty]
+
+[nested]
+inner = { a = 1 }
+
+[too_large]
+a = 1
+b = 2
+c = 3
+`
+	opts := DefaultOptions()
+	opts.InlineTableMaxKeys = 2
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Errors inside inline tables name the offending key
+	err := FormatWithOptions(map[string]any{"t": map[string]any{"a": nil}}, opts, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "key 't': inline table key 'a': nil value") {
+		t.Errorf("FormatWithOptions() error = %v, want inline table key error", err)
+	}
+}
+
+func TestFormatWithOptionsGroupKeysByValueType(t *testing.T) {
+	input := `zone = "eu"
+tags = ["a", "b"]
+limits = { cpu = 2 }
+name = "app"
+ports = [80, 443]
+enabled = true
+owner = { name = "ops" }
+
+[server]
+retries = [1, 2]
+host = "localhost"
+`
+	testCases := []struct {
+		name     string
+		sortKeys SortMode
+		want     string
+	}{
+		{
+			name:     "sorted",
+			sortKeys: SortAscending,
+			want: `enabled = true
+name    = "app"
+zone    = "eu"
+ports   = [80, 443]
+tags    = ["a", "b"]
+limits  = { cpu = 2 }
+owner   = { name = "ops" }
+
+[server]
+host    = "localhost"
+retries = [1, 2]
+`,
+		},
+		{
+			name:     "source_order",
+			sortKeys: SortNone,
+			want: `zone    = "eu"
+name    = "app"
+enabled = true
+tags    = ["a", "b"]
+ports   = [80, 443]
+limits  = { cpu = 2 }
+owner   = { name = "ops" }
+
+[server]
+host    = "localhost"
+retries = [1, 2]
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.SortKeys = tc.sortKeys
+			opts.GroupKeysByValueType = true
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsPreserveKeyQuotes(t *testing.T) {
+	input := `"name" = "app"
+'literal' = 1
+"needs space" = 2
+bare = 3
+"site"."host" = "x"
+point = { "x" = 1, y = 2 }
+
+["server"]
+'port' = 80
+
+[[ "items" ]]
+"id" = 1
+`
+	testCases := []struct {
+		name     string
+		preserve bool
+		want     string
+	}{
+		{
+			name: "normalize",
+			want: `bare          = 3
+literal       = 1
+name          = "app"
+"needs space" = 2
+point         = { x = 1, y = 2 }
+
+[[items]]
+id = 1
+
+[server]
+port = 80
+
+[site]
+host = "x"
+`,
+		},
+		{
+			name:     "preserve",
+			preserve: true,
+			want: `bare          = 3
+'literal'     = 1
+"name"        = "app"
+"needs space" = 2
+point         = { "x" = 1, y = 2 }
+
+[["items"]]
+"id" = 1
+
+["server"]
+'port' = 80
+
+["site"]
+"host" = "x"
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.PreserveKeyQuotes = tc.preserve
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatQuotesHeaderSegments(t *testing.T) {
+	data := map[string]any{
+		"my table": map[string]any{"a.b": map[string]any{"k": 1}},
+		"list":     []any{map[string]any{"x y": 1}},
+	}
+	want := `[[list]]
+"x y" = 1
+
+["my table"]
+
+["my table"."a.b"]
+k = 1
+`
+	var buf bytes.Buffer
+	if err := Format(data, "", &buf); err != nil {
+		t.Fatalf("Format() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("Format() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestFormatAlignsNonASCIIKeys(t *testing.T) {
+	data := map[string]any{"café": 1, "naïve": 2, "plain": 3}
+	want := `"café"  = 1
+"naïve" = 2
+plain   = 3
+`
+	var buf bytes.Buffer
+	if err := Format(data, "", &buf); err != nil {
+		t.Fatalf("Format() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("Format() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestFormatWithOptionsAlignValues(t *testing.T) {
+	data := map[string]any{
+		"name":   "app",
+		"port":   int64(80),
+		"server": map[string]any{"host": "localhost", "retries": int64(3)},
+	}
+	want := `name = "app"
+port = 80
+
+[server]
+host = "localhost"
+retries = 3
+`
+	opts := DefaultOptions()
+	opts.AlignValues = false
+
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, opts, &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestFormatWithOptionsMaxLineWidth(t *testing.T) {
+	data := map[string]any{
+		"id":    int64(1),
+		"ports": []any{int64(8000), int64(8001), int64(8002)},
+		"server": map[string]any{
+			"hosts": []any{"alpha.example.com", "beta.example.com"},
+		},
+	}
+	testCases := []struct {
+		name       string
+		width      int
+		indentUnit string
+		want       string
+	}{
+		{
+			name:  "unlimited",
+			width: 0,
+			want: `id    = 1
+ports = [8000, 8001, 8002]
+
+[server]
+hosts = ["alpha.example.com", "beta.example.com"]
+`,
+		},
+		{
+			name:  "fits",
+			width: 49,
+			want: `id    = 1
+ports = [8000, 8001, 8002]
+
+[server]
+hosts = ["alpha.example.com", "beta.example.com"]
+`,
+		},
+		{
+			name:  "wraps_long_arrays",
+			width: 30,
+			want: `id    = 1
+ports = [8000, 8001, 8002]
+
+[server]
+hosts = [
+  "alpha.example.com",
+  "beta.example.com"
+]
+`,
+		},
+		{
+			name:       "indented",
+			width:      20,
+			indentUnit: "    ",
+			want: `id    = 1
+ports = [
+    8000,
+    8001,
+    8002
+]
+
+[server]
+    hosts = [
+        "alpha.example.com",
+        "beta.example.com"
+    ]
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MaxLineWidth = tc.width
+			opts.IndentUnit = tc.indentUnit
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsMaxLineWidthInlineTables(t *testing.T) {
+	input := `p = { x = 1 }
+server = { host = "alpha.example.com", port = 8080, tls = { cert = "a.pem" } }
+`
+	testCases := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{
+			name:  "unlimited",
+			width: 0,
+			want: `p      = { x = 1 }
+server = { host = "alpha.example.com", port = 8080, tls = { cert = "a.pem" } }
+`,
+		},
+		{
+			name:  "fits",
+			width: 80,
+			want: `p      = { x = 1 }
+server = { host = "alpha.example.com", port = 8080, tls = { cert = "a.pem" } }
+`,
+		},
+		{
+			name:  "expands_wide_tables",
+			width: 40,
+			want: `p = { x = 1 }
+
+[server]
+host = "alpha.example.com"
+port = 8080
+tls  = { cert = "a.pem" }
+`,
+		},
+		{
+			name:  "expands_nested_tables",
+			width: 20,
+			want: `p = { x = 1 }
+
+[server]
+host = "alpha.example.com"
+port = 8080
+
+[server.tls]
+cert = "a.pem"
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.MaxLineWidth = tc.width
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsInlineArrayOfTables(t *testing.T) {
+	input := `name = "shape"
+
+[[points]]
+x = 1
+y = 2
+
+[[points]]
+x = 3
+y = 4
+`
+	testCases := []struct {
+		name    string
+		width   int
+		maxKeys int
+		want    string
+	}{
+		{
+			name:    "fits",
+			width:   50,
+			maxKeys: 2,
+			want: `name   = "shape"
+points = [{ x = 1, y = 2 }, { x = 3, y = 4 }]
+`,
+		},
+		{
+			name:    "too_wide",
+			width:   30,
+			maxKeys: 2,
+			want: `name = "shape"
+
+[[points]]
+x = 1
+y = 2
+
+[[points]]
+x = 3
+y = 4
+`,
+		},
+		{
+			name:    "entries_too_large",
+			width:   50,
+			maxKeys: 1,
+			want: `name = "shape"
+
+[[points]]
+x = 1
+y = 2
+
+[[points]]
+x = 3
+y = 4
+`,
+		},
+		{
+			name:    "no_width_limit",
+			width:   0,
+			maxKeys: 2,
+			want: `name = "shape"
+
+[[points]]
+x = 1
+y = 2
+
+[[points]]
+x = 3
+y = 4
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.MaxLineWidth = tc.width
+			opts.InlineTableMaxKeys = tc.maxKeys
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatAlignsValuesPerGroup(t *testing.T) {
+	input := `a = 1
+maximum_connections = 100
+b = 2
+# limits
+c = 3
+dd = 4
+# single
+e = 5
+`
+	testCases := []struct {
+		name     string
+		sortKeys SortMode
+		want     string
+	}{
+		{
+			name:     "source_order",
+			sortKeys: SortNone,
+			want: `a                   = 1
+maximum_connections = 100
+b                   = 2
+# limits
+c  = 3
+dd = 4
+# single
+e = 5
+`,
+		},
+		{
+			// Sorting decides which keys are adjacent, and so which keys share a group
+			name:     "sorted",
+			sortKeys: SortAscending,
+			want: `a = 1
+b = 2
+# limits
+c  = 3
+dd = 4
+# single
+e                   = 5
+maximum_connections = 100
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.SortKeys = tc.sortKeys
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatValueLiteralStrings(t *testing.T) {
+	testCases := []struct {
+		name       string
+		input      any
+		forceBasic bool
+		want       string
+	}{
+		{"windows_path", `C:\Users\foo`, false, `'C:\Users\foo'`},
+		{"regex", `^\d+\.\d+$`, false, `'^\d+\.\d+$'`},
+		{"forced_basic", `C:\Users\foo`, true, `"C:\\Users\\foo"`},
+		{"no_backslash", `say "hi"`, false, `"say \"hi\""`},
+		{"single_quote", `it's C:\temp`, false, `"it's C:\\temp"`},
+		{"tab", "a\tb\\c", false, `"a\tb\\c"`},
+		{"control_character", "bell\a\\", false, `"bell\u0007\\"`},
+		{"in_array", []any{`a\b`, "plain"}, false, `['a\b', "plain"]`},
+		{"in_inline_table", map[string]any{"re": `\w+`}, false, `{ re = '\w+' }`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ForceBasicStrings = tc.forceBasic
+			got, err := formatValue(tc.input, nil, nil, opts)
+			if err != nil {
+				t.Fatalf("formatValue(%q) returned unexpected error: %v", tc.input, err)
+			}
+			if got != tc.want {
+				t.Errorf("formatValue(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+
+			// Whatever the form, the value must decode back unchanged
+			var decoded map[string]any
+			if err := toml.Unmarshal([]byte("v = "+got+"\n"), &decoded); err != nil {
+				t.Fatalf("decoding %q: %v", got, err)
+			}
+			if !reflect.DeepEqual(decoded["v"], tc.input) {
+				t.Errorf("round trip of %q = %q", tc.input, decoded["v"])
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsMaxNestingDepth(t *testing.T) {
+	// deepTable builds a chain of depth tables, each holding a key and the next table
+	deepTable := func(depth int) map[string]any {
+		root := map[string]any{}
+		current := root
+		for range depth {
+			next := map[string]any{"v": int64(1)}
+			current["t"] = next
+			current = next
+		}
+		return root
+	}
+
+	testCases := []struct {
+		name     string
+		depth    int
+		maxDepth int
+		wantErr  bool
+	}{
+		{"default_limit_reached", DefaultMaxNestingDepth, 0, false},
+		{"default_limit_exceeded", DefaultMaxNestingDepth + 1, 0, true},
+		{"far_beyond_default", 100_000, 0, true},
+		{"custom_limit", 4, 3, true},
+		{"custom_limit_reached", 3, 3, false},
+		{"no_limit", DefaultMaxNestingDepth + 500, -1, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MaxNestingDepth = tc.maxDepth
+			var buf bytes.Buffer
+			err := FormatWithOptions(deepTable(tc.depth), opts, &buf)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("FormatWithOptions() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil && (!strings.Contains(err.Error(), "levels deep") || len(err.Error()) > 100) {
+				t.Errorf("FormatWithOptions() error = %.200v, want a short nesting depth error", err)
+			}
+			if err == nil && strings.Count(buf.String(), "[t") != tc.depth {
+				t.Errorf("FormatWithOptions() wrote %d headers, want %d", strings.Count(buf.String(), "[t"), tc.depth)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsIgnoreDirective(t *testing.T) {
+	input := `alpha = "app"
+# tomlfmt:ignore
+grid   =  [ 1, 0,
+            0, 1 ]  # identity
+zeta = 1
+
+# tomlfmt:ignore
+[colors]
+red   = "#f00"
+green = "#0f0"
+
+blue  =  "#00f"
+`
+	testCases := []struct {
+		name   string
+		modify func(map[string]any)
+		want   string
+	}{
+		{
+			name:   "kept",
+			modify: func(map[string]any) {},
+			want: `alpha = "app"
+# tomlfmt:ignore
+grid   =  [ 1, 0,
+            0, 1 ] # identity
+zeta = 1
+
+# tomlfmt:ignore
+[colors]
+red   = "#f00"
+green = "#0f0"
+
+blue  =  "#00f"
+`,
+		},
+		{
+			name: "changed_values_are_formatted",
+			modify: func(data map[string]any) {
+				data["grid"] = []any{int64(1)}
+				data["colors"].(map[string]any)["green"] = "#0a0"
+			},
+			want: `alpha = "app"
+# tomlfmt:ignore
+grid = [1] # identity
+zeta = 1
+
+# tomlfmt:ignore
+[colors]
+red   = "#f00"
+green = "#0a0"
+
+blue  =  "#00f"
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("Failed to parse test input: %v", err)
+			}
+			tc.modify(data)
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsIgnoreDirectiveDottedKeys(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		collapse bool
+		want     string
+	}{
+		{
+			name:  "dotted_key",
+			input: "x = 1\n# tomlfmt:ignore\na.b   =   1\n",
+			want:  "# tomlfmt:ignore\na.b   =   1\nx = 1\n",
+		},
+		{
+			name:  "dotted_key_in_table",
+			input: "[t]\n# tomlfmt:ignore\nx.y   =   1\n",
+			want:  "[t]\n# tomlfmt:ignore\nx.y   =   1\n",
+		},
+		{
+			name:     "dotted_key_with_collapsed_chains",
+			input:    "# tomlfmt:ignore\na.b.c   =   1\n",
+			collapse: true,
+			want:     "# tomlfmt:ignore\na.b.c   =   1\n",
+		},
+		{
+			name:     "collapsed_chain_keeps_its_header",
+			input:    "[a.b]\n# tomlfmt:ignore\nx   =   1\n",
+			collapse: true,
+			want:     "[a]\n\n[a.b]\n# tomlfmt:ignore\nx   =   1\n",
+		},
+		{
+			// The table a holds another key, so a.b cannot stay a line of its own
+			name:  "dotted_key_sharing_its_table",
+			input: "# tomlfmt:ignore\na.b   =   1\na.c=2\n",
+			want:  "[a]\n# tomlfmt:ignore\nb = 1\nc = 2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(tc.input), &data); err != nil {
+				t.Fatalf("Failed to parse test input: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(tc.input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.CollapseTableChains = tc.collapse
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsStringStyle(t *testing.T) {
+	input := `name = 'app'
+path = "C:\\temp"
+quote = "it's"
+regex = '\d+'
+tab = "a\tb"
+table = { re = '\w', title = "x" }
+list = ['a', "b\\c"]
+`
+	testCases := []struct {
+		name  string
+		style StringStyle
+		want  string
+	}{
+		{
+			name:  "auto",
+			style: StringAuto,
+			want: `list  = ["a", 'b\c']
+name  = "app"
+path  = 'C:\temp'
+quote = "it's"
+regex = '\d+'
+tab   = "a\tb"
+table = { re = '\w', title = "x" }
+`,
+		},
+		{
+			name:  "basic",
+			style: StringBasic,
+			want: `list  = ["a", "b\\c"]
+name  = "app"
+path  = "C:\\temp"
+quote = "it's"
+regex = "\\d+"
+tab   = "a\tb"
+table = { re = "\\w", title = "x" }
+`,
+		},
+		{
+			name:  "literal",
+			style: StringLiteral,
+			want: "list  = ['a', 'b\\c']\n" +
+				"name  = 'app'\n" +
+				"path  = 'C:\\temp'\n" +
+				"quote = \"it's\"\n" +
+				"regex = '\\d+'\n" +
+				"tab   = 'a\tb'\n" +
+				"table = { re = '\\w', title = 'x' }\n",
+		},
+		{
+			name:  "preserve",
+			style: StringPreserve,
+			want: `list  = ["a", 'b\c']
+name  = 'app'
+path  = "C:\\temp"
+quote = "it's"
+regex = '\d+'
+tab   = "a\tb"
+table = { re = '\w', title = "x" }
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("Failed to parse test input: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.StringStyle = tc.style
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("round trip changed the document: got %v, want %v", decoded, data)
+			}
+		})
+	}
+}
+
+func TestFormatLocalDateTimesRoundTrip(t *testing.T) {
+	input := `date = 2023-01-10
+datetime = 1979-05-27T07:32:00.5
+offset = 1979-05-27T07:32:00-08:00
+time = 07:32:00.999
+`
+	want := `date     = 2023-01-10
+datetime = 1979-05-27T07:32:00.5
+offset   = 1979-05-27T07:32:00-08:00
+time     = 07:32:00.999
+`
+	var data map[string]any
+	if err := toml.Unmarshal([]byte(input), &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, DefaultOptions(), &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestFormatWithOptionsCollapseTableChains(t *testing.T) {
+	input := `name = "app"
+a.b.c.d = 1
+
+[server]
+port = 80
+
+[z]
+q.r = 1
+q.s = 2
+
+# kept
+[x.y]
+z = true
+`
+	testCases := []struct {
+		name     string
+		collapse bool
+		want     string
+	}{
+		{
+			name:     "expanded",
+			collapse: false,
+			want: `name = "app"
+
+[a]
+
+[a.b]
+
+[a.b.c]
+d = 1
+
+[server]
+port = 80
+
+[x]
+
+# kept
+[x.y]
+z = true
+
+[z]
+
+[z.q]
+r = 1
+s = 2
+`,
+		},
+		{
+			// Only a.b.c.d collapses: server holds no intermediate table, z.q has
+			// two keys, and the comment on x.y needs its header
+			name:     "collapsed",
+			collapse: true,
+			want: `a.b.c.d = 1
+name    = "app"
+
+[server]
+port = 80
+
+[x]
+
+# kept
+[x.y]
+z = true
+
+[z]
+
+[z.q]
+r = 1
+s = 2
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.CollapseTableChains = tc.collapse
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			// Both forms describe the same data
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("output decodes to %v, want %v", decoded, data)
+			}
+		})
+	}
+}
+
+func TestFormatNestedArrays(t *testing.T) {
+	data := map[string]any{
+		"matrix": []any{[]any{int64(1), int64(2)}, []any{int64(3), int64(4)}},
+		"mixed":  []any{[]any{"a", "b"}, []any{1.5}, []any{}},
+		"deep":   []any{[]any{[]any{true}}},
+		"names": []any{
+			[]any{"alpha.example.com", "beta.example.com"},
+			[]any{"gamma.example.com"},
+		},
+	}
+	testCases := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{
+			name:  "one_line",
+			width: 0,
+			want: `deep   = [[[true]]]
+matrix = [[1, 2], [3, 4]]
+mixed  = [["a", "b"], [1.5], []]
+names  = [["alpha.example.com", "beta.example.com"], ["gamma.example.com"]]
+`,
+		},
+		{
+			// Inner arrays that fit stay on one line
+			name:  "wrapped",
+			width: 60,
+			want: `deep   = [[[true]]]
+matrix = [[1, 2], [3, 4]]
+mixed  = [["a", "b"], [1.5], []]
+names  = [
+  ["alpha.example.com", "beta.example.com"],
+  ["gamma.example.com"]
+]
+`,
+		},
+		{
+			// Inner arrays too wide on their own line are wrapped too
+			name:  "wrapped_nested",
+			width: 24,
+			want: `deep   = [[[true]]]
+matrix = [
+  [1, 2],
+  [3, 4]
+]
+mixed  = [
+  ["a", "b"],
+  [1.5],
+  []
+]
+names  = [
+  [
+    "alpha.example.com",
+    "beta.example.com"
+  ],
+  ["gamma.example.com"]
+]
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MaxLineWidth = tc.width
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("output decodes to %v, want %v", decoded, data)
+			}
+		})
+	}
+}
+
+func TestFormatArrayOfArraysOfTablesIsNotArrayTable(t *testing.T) {
+	// Tables nested two levels down cannot be written as [[headers]]
+	data := map[string]any{"groups": []any{[]any{map[string]any{"id": int64(1)}}}}
+	var buf bytes.Buffer
+	err := FormatWithOptions(data, DefaultOptions(), &buf)
+	want := "key 'groups': array index 0: array index 0: table found inside an array value"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("FormatWithOptions() error = %v, want error containing %q", err, want)
+	}
+}
+
+func TestFormatEmptyTables(t *testing.T) {
+	testCases := []struct {
+		name       string
+		input      string
+		indentUnit string
+		want       string
+	}{
+		{
+			name:  "followed_by_table",
+			input: "[features]\n[next]\na = 1\n",
+			want:  "[features]\n\n[next]\na = 1\n",
+		},
+		{
+			name:  "last",
+			input: "x = 1\n[features]\n",
+			want:  "x = 1\n\n[features]\n",
+		},
+		{
+			name:  "only",
+			input: "[features]\n",
+			want:  "[features]\n",
+		},
+		{
+			name:       "nested_indented",
+			input:      "[a]\n[a.b]\n[c]\nd = 1\n",
+			indentUnit: "  ",
+			want:       "[a]\n\n  [a.b]\n\n[c]\n  d = 1\n",
+		},
+		{
+			name:  "in_array_table",
+			input: "[[arr]]\n[arr.e]\n[[arr]]\nx = 1\n",
+			want:  "[[arr]]\n\n[arr.e]\n\n[[arr]]\nx = 1\n",
+		},
+		{
+			name:  "with_comments",
+			input: "# above\n[features] # none yet\n[next]\n",
+			want:  "# above\n[features] # none yet\n\n[next]\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(tc.input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			source, err := ParseSourceInfo([]byte(tc.input))
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.Source = source
+			opts.IndentUnit = tc.indentUnit
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			// The empty tables survive the round trip
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("output decodes to %v, want %v", decoded, data)
+			}
+		})
+	}
+}
+
+func TestFormatEmptyArrayTables(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "single_empty_entry",
+			input: "[[x]]\n",
+			want:  "[[x]]\n",
+		},
+		{
+			name:  "empty_entry_before_full_one",
+			input: "[[x]]\n[[x]]\na = 1\n",
+			want:  "[[x]]\n\n[[x]]\na = 1\n",
+		},
+		{
+			name:  "nested_empty_entry",
+			input: "[a]\nb = 1\n[[a.x]]\n",
+			want:  "[a]\nb = 1\n\n[[a.x]]\n",
+		},
+		{
+			// TOML cannot declare an array table without entries, so an empty array stays a value
+			name:  "empty_array",
+			input: "x = []\n[[y]]\n",
+			want:  "x = []\n\n[[y]]\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(tc.input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, DefaultOptions(), &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			// Empty entries and empty arrays survive the round trip
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("output decodes to %v, want %v", decoded, data)
+			}
+		})
+	}
+
+	// Empty slices built in Go are kept as empty arrays rather than dropped
+	data := map[string]any{
+		"a": []any{},
+		"b": []map[string]any{},
+		"t": map[string]any{"c": []any{}},
+	}
+	var buf bytes.Buffer
+	if err := FormatWithOptions(data, DefaultOptions(), &buf); err != nil {
+		t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+	}
+	if want := "a = []\nb = []\n\n[t]\nc = []\n"; buf.String() != want {
+		t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestFormatMixedArrays(t *testing.T) {
+	testCases := []struct {
+		name         string
+		input        string
+		maxLineWidth int
+		want         string
+	}{
+		{
+			name:  "scalars",
+			input: "v = [1, \"two\", true, 1.5, 1979-05-27]\n",
+			want:  "v = [1, \"two\", true, 1.5, 1979-05-27]\n",
+		},
+		{
+			name:         "scalars_wrapped",
+			input:        "v = [1, \"two\", true, 1.5, 1979-05-27]\n",
+			maxLineWidth: 12,
+			want:         "v = [\n  1,\n  \"two\",\n  true,\n  1.5,\n  1979-05-27\n]\n",
+		},
+		{
+			name:  "nested",
+			input: "n = [[1, \"a\"], [true]]\n",
+			want:  "n = [[1, \"a\"], [true]]\n",
+		},
+		{
+			name:         "nested_wrapped",
+			input:        "n = [[1, \"a\"], [true]]\n",
+			maxLineWidth: 12,
+			want:         "n = [\n  [1, \"a\"],\n  [true]\n]\n",
+		},
+		{
+			// The mixed array stays a value next to a real array of tables
+			name:  "beside_array_table",
+			input: "m = [1, 'a\\b']\n[[m2]]\nx = [false, 2]\n",
+			want:  "m = [1, 'a\\b']\n\n[[m2]]\nx = [false, 2]\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(tc.input), &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			opts := DefaultOptions()
+			opts.MaxLineWidth = tc.maxLineWidth
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			// Every element keeps its type through the round trip
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("output decodes to %v, want %v", decoded, data)
+			}
+		})
+	}
+}
+
+func TestFormatSeparatorOrderings(t *testing.T) {
+	// Each ordering of sections gets exactly one blank line between them by
+	// default, and nothing before the first line of the document
+	testCases := []struct {
+		name string
+		data map[string]any
+		want string
+	}{
+		{
+			name: "table_first",
+			data: map[string]any{"t": map[string]any{"k": 1}},
+			want: "[t]\nk = 1\n",
+		},
+		{
+			name: "array_table_first",
+			data: map[string]any{"a": []any{map[string]any{"k": 1}}},
+			want: "[[a]]\nk = 1\n",
+		},
+		{
+			name: "simple_to_table",
+			data: map[string]any{"k": 1, "t": map[string]any{"x": 1}},
+			want: "k = 1\n\n[t]\nx = 1\n",
+		},
+		{
+			name: "simple_to_array_table",
+			data: map[string]any{"k": 1, "a": []any{map[string]any{"x": 1}}},
+			want: "k = 1\n\n[[a]]\nx = 1\n",
+		},
+		{
+			name: "table_to_table",
+			data: map[string]any{"s": map[string]any{"x": 1}, "t": map[string]any{"y": 1}},
+			want: "[s]\nx = 1\n\n[t]\ny = 1\n",
+		},
+		{
+			name: "empty_table_to_table",
+			data: map[string]any{"s": map[string]any{}, "t": map[string]any{"y": 1}},
+			want: "[s]\n\n[t]\ny = 1\n",
+		},
+		{
+			name: "table_to_array_table",
+			data: map[string]any{"t": map[string]any{"a": []any{map[string]any{"x": 1}}}},
+			want: "[t]\n\n[[t.a]]\nx = 1\n",
+		},
+		{
+			name: "table_to_nested_table",
+			data: map[string]any{"t": map[string]any{"u": map[string]any{"x": 1}}},
+			want: "[t]\n\n[t.u]\nx = 1\n",
+		},
+		{
+			name: "array_table_to_array_table",
+			data: map[string]any{"a": []any{map[string]any{"x": 1}, map[string]any{"x": 2}}},
+			want: "[[a]]\nx = 1\n\n[[a]]\nx = 2\n",
+		},
+		{
+			name: "array_table_to_table",
+			data: map[string]any{"a": []any{map[string]any{"x": 1}}, "t": map[string]any{"y": 1}},
+			want: "[[a]]\nx = 1\n\n[t]\ny = 1\n",
+		},
+		{
+			name: "array_table_to_sub_table",
+			data: map[string]any{"a": []any{map[string]any{"s": map[string]any{"y": 1}}}},
+			want: "[[a]]\n\n[a.s]\ny = 1\n",
+		},
+		{
+			name: "nested_array_table_to_next_entry",
+			data: map[string]any{"a": []any{
+				map[string]any{"b": []any{map[string]any{"x": 1}}},
+				map[string]any{"y": 2},
+			}},
+			want: "[[a]]\n\n[[a.b]]\nx = 1\n\n[[a]]\ny = 2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := FormatWithOptions(tc.data, DefaultOptions(), &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatWithOptionsTrailingComma(t *testing.T) {
+	data := map[string]any{
+		"empty": []any{},
+		"hosts": []any{"alpha.example.com", "beta.example.com"},
+		"long":  []any{"a-single-element-too-wide-for-the-line"},
+		"one":   []any{int64(1)},
+		"grid":  []any{[]any{"nested.example.com", "other.example.com"}},
+	}
+	testCases := []struct {
+		name          string
+		trailingComma bool
+		want          string
+	}{
+		{
+			name:          "without",
+			trailingComma: false,
+			want: `empty = []
+grid  = [
+  [
+    "nested.example.com",
+    "other.example.com"
+  ]
+]
+hosts = [
+  "alpha.example.com",
+  "beta.example.com"
+]
+long  = [
+  "a-single-element-too-wide-for-the-line"
+]
+one   = [1]
+`,
+		},
+		{
+			name:          "with",
+			trailingComma: true,
+			want: `empty = []
+grid  = [
+  [
+    "nested.example.com",
+    "other.example.com",
+  ],
+]
+hosts = [
+  "alpha.example.com",
+  "beta.example.com",
+]
+long  = [
+  "a-single-element-too-wide-for-the-line",
+]
+one   = [1]
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.MaxLineWidth = 30
+			opts.TrailingComma = tc.trailingComma
+
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatWithOptions() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			var decoded map[string]any
+			if err := toml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+				t.Fatalf("decoding output: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, data) {
+				t.Errorf("output decodes to %v, want %v", decoded, data)
+			}
+		})
+	}
+}
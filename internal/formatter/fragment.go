@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MIT
+
+package formatter
+
+import (
+	"bytes"
+	"errors"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// ReindentFragment gives the formatted form of a TOML fragment, such as a
+// snippet embedded in a template or another file, the layout of the fragment
+// itself: every non-blank line is indented by the leading whitespace that all
+// non-blank lines of the fragment share, and the final newline is dropped when
+// the fragment did not end with one.
+//
+// Indenting the lines of a multi-line string would change its value, so the
+// result is decoded and compared with the formatted document; a fragment that
+// cannot be indented without changing its data is an error.
+//
+// Parameters:
+//   - fragment: The fragment as it was read
+//   - formatted: The fragment formatted as a document
+//
+// Returns:
+//   - []byte: The formatted fragment
+//   - error: If the indentation would change a value
+func ReindentFragment(fragment, formatted []byte) ([]byte, error) {
+	prefix := commonIndent(fragment)
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(formatted, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			out.WriteString(prefix)
+		}
+		out.Write(line)
+	}
+	result := out.Bytes()
+	if !bytes.HasSuffix(fragment, []byte("\n")) {
+		result = bytes.TrimRight(result, "\r\n")
+	}
+	if prefix == "" {
+		return result, nil
+	}
+
+	same, err := sameData(formatted, result)
+	if err != nil {
+		return nil, err
+	}
+	if !same {
+		return nil, errors.New("cannot keep the fragment's indentation: it would change the value of a multi-line string")
+	}
+	return result, nil
+}
+
+// commonIndent returns the leading spaces and tabs that every non-blank line of
+// input starts with.
+func commonIndent(input []byte) string {
+	var prefix []byte
+	found := false
+	for _, line := range bytes.Split(input, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		indent := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+		if !found {
+			prefix, found = indent, true
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(indent) && prefix[n] == indent[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// sameData reports whether two TOML documents hold the same data, comparing
+// their formatted forms so that values such as nan compare equal.
+func sameData(a, b []byte) (bool, error) {
+	canonical := func(doc []byte) ([]byte, error) {
+		var data map[string]any
+		if err := toml.Unmarshal(doc, &data); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err := FormatWithOptions(data, DefaultOptions(), &buf)
+		return buf.Bytes(), err
+	}
+	first, err := canonical(a)
+	if err != nil {
+		return false, err
+	}
+	second, err := canonical(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(first, second), nil
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"bytes"
+	"testing"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+func TestReindentFragment(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		opts    func(*Options)
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "no_indentation",
+			input: "b=2\na=1\n",
+			want:  "a = 1\nb = 2\n",
+		},
+		{
+			name:  "shared_indentation_kept",
+			input: "    name=\"x\"\n    port =80\n",
+			want:  "    name = \"x\"\n    port = 80\n",
+		},
+		{
+			name:  "shortest_indentation_wins",
+			input: "\t\tb = 1\n\ta = 2\n",
+			want:  "\ta = 2\n\tb = 1\n",
+		},
+		{
+			name:  "no_final_newline_added",
+			input: "  b = 1\n  a = 2",
+			want:  "  a = 2\n  b = 1",
+		},
+		{
+			name:  "tables_and_blank_lines",
+			input: "  x = 1\n\n  [t]\n  y=2\n",
+			want:  "  x = 1\n\n  [t]\n  y = 2\n",
+		},
+		{
+			name:  "crlf_without_final_newline",
+			input: "  b = 1\r\n  a = 2",
+			want:  "  a = 2\r\n  b = 1",
+		},
+		{
+			name:  "multiline_string_value_kept_without_indentation",
+			input: "s = \"\"\"\nfirst\nsecond\"\"\"\n",
+			opts:  func(o *Options) { o.MultilineStrings = MultilineWhenNewlines },
+			want:  "s = \"\"\"\nfirst\nsecond\"\"\"\n",
+		},
+		{
+			name:    "multiline_string_value_would_change",
+			input:   "  s = \"\"\"\n  first\n  second\"\"\"\n",
+			opts:    func(o *Options) { o.MultilineStrings = MultilineWhenNewlines },
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data map[string]any
+			if err := toml.Unmarshal([]byte(tc.input), &data); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+			opts := DefaultOptions()
+			if tc.opts != nil {
+				tc.opts(&opts)
+			}
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				t.Fatalf("FormatWithOptions() returned unexpected error: %v", err)
+			}
+			formatted := buf.Bytes()
+			if bytes.Contains([]byte(tc.input), []byte("\r\n")) {
+				formatted = bytes.ReplaceAll(formatted, []byte("\n"), []byte("\r\n"))
+			}
+
+			got, err := ReindentFragment([]byte(tc.input), formatted)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ReindentFragment() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReindentFragment() returned unexpected error: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("ReindentFragment() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCommonIndent(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"none", "a = 1\n  b = 2\n", ""},
+		{"spaces", "  a = 1\n    b = 2\n", "  "},
+		{"blank_lines_ignored", "  a = 1\n\n \n  b = 2\n", "  "},
+		{"mixed_tabs_and_spaces", "\t a = 1\n\t\tb = 2\n", "\t"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := commonIndent([]byte(tc.input)); got != tc.want {
+				t.Errorf("commonIndent(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
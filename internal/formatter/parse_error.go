@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MIT
+
+package formatter
+
+import (
+	"errors"
+	"fmt"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// ParseError reports where a document stopped being valid TOML, so callers can
+// render their own diagnostics. It wraps the decoder's error, which stays
+// reachable with errors.As as a *toml.DecodeError.
+type ParseError struct {
+	Line   int   // 1-based line of the error
+	Column int   // 1-based column of the error
+	Err    error // The underlying decode error
+}
+
+// Error implements the error interface.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+// Unwrap returns the underlying decode error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// NewParseError adds the position of a decode error to it.
+//
+// Parameters:
+//   - err: Error returned by decoding a document
+//
+// Returns:
+//   - error: A *ParseError when err holds a *toml.DecodeError, or else err unchanged
+func NewParseError(err error) error {
+	var decodeErr *toml.DecodeError
+	if !errors.As(err, &decodeErr) {
+		return err
+	}
+	line, col := decodeErr.Position()
+	return &ParseError{Line: line, Column: col, Err: err}
+}
@@ -0,0 +1,36 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"errors"
+	"testing"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+func TestNewParseError(t *testing.T) {
+	var data map[string]any
+	decodeErr := toml.Unmarshal([]byte("a = 1\n\nb = [1,\n"), &data)
+	if decodeErr == nil {
+		t.Fatal("toml.Unmarshal() succeeded, want a decode error")
+	}
+
+	err := NewParseError(decodeErr)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("NewParseError() = %v, want a *ParseError", err)
+	}
+	wantLine, wantCol := decodeErr.(*toml.DecodeError).Position()
+	if parseErr.Line != wantLine || parseErr.Column != wantCol {
+		t.Errorf("NewParseError() position = %d:%d, want %d:%d", parseErr.Line, parseErr.Column, wantLine, wantCol)
+	}
+	var unwrapped *toml.DecodeError
+	if !errors.As(err, &unwrapped) {
+		t.Errorf("NewParseError() = %v, does not wrap *toml.DecodeError", err)
+	}
+
+	other := errors.New("not a decode error")
+	if got := NewParseError(other); got != other {
+		t.Errorf("NewParseError(%v) = %v, want it unchanged", other, got)
+	}
+}
@@ -0,0 +1,224 @@
+// SPDX-License-Identifier: MIT
+
+package formatter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// ParseKeyPath splits a dotted TOML key, such as servers."eu.west".hosts, into
+// its unquoted segments.
+//
+// Parameters:
+//   - key: The dotted key, written as in a table header
+//
+// Returns:
+//   - []string: The segments of the key
+//   - error: If key is not a valid TOML key
+func ParseKeyPath(key string) ([]string, error) {
+	if strings.ContainsAny(key, "[]\r\n") {
+		return nil, fmt.Errorf("invalid key %q", key)
+	}
+	parser := unstable.Parser{}
+	parser.Reset([]byte("[" + key + "]"))
+	if !parser.NextExpression() {
+		return nil, fmt.Errorf("invalid key %q: %w", key, parser.Error())
+	}
+	path := keyParts(parser.Expression().Key())
+	if parser.NextExpression() || parser.Error() != nil || len(path) == 0 {
+		return nil, fmt.Errorf("invalid key %q", key)
+	}
+	return path, nil
+}
+
+// section is a [table] or [[array.table]] header with the lines that follow it,
+// up to the next header.
+type section struct {
+	start int      // Offset of the first line, counting the comment lines directly above the header
+	path  []string // Path of the table the header declares
+}
+
+// FormatSections formats only the tables under path, passing the rest of the
+// document through byte for byte. Every run of consecutive sections whose
+// header lies under path, such as [servers], [servers.eu], and [[servers.eu.hosts]],
+// is formatted as a document of its own by format; the blank lines after a run
+// are kept, so it stays as far from the next section as it was.
+//
+// Only tables declared with a header are selected: keys under path that are
+// written as dotted keys or inline tables in another table are left as they are.
+//
+// Parameters:
+//   - input: The whole document (without a BOM), which must be valid TOML
+//   - path: Path of the table to format
+//   - format: Formats a run of sections as a standalone document
+//
+// Returns:
+//   - []byte: The document with the selected tables formatted
+//   - error: If the document cannot be scanned, no header lies under path, format fails, or
+//     the formatted tables no longer hold the same data on their own
+func FormatSections(input []byte, path []string, format func([]byte) ([]byte, error)) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, errors.New("no table path given")
+	}
+	sections, err := scanSections(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	written := 0 // Input before this offset is already in out
+	found := false
+	for i := 0; i < len(sections); i++ {
+		if !underPath(sections[i].path, path) {
+			continue
+		}
+		found = true
+		end := len(input)
+		j := i + 1
+		for ; j < len(sections); j++ {
+			if !underPath(sections[j].path, path) {
+				end = sections[j].start
+				break
+			}
+		}
+		body, tail := splitTrailingBlankLines(input[sections[i].start:end])
+		formatted, err := format(body)
+		if err != nil {
+			return nil, err
+		}
+		formatted = stripAncestorHeaders(formatted, sections[i].path)
+		same, err := sameData(body, formatted)
+		if err != nil {
+			return nil, err
+		}
+		if !same || !startsWithHeader(formatted) {
+			// Keys above the first header would land in the table before the run, as
+			// when a chain of tables is collapsed into a dotted key
+			return nil, fmt.Errorf("cannot format '%s' apart from the tables around it", strings.Join(path, "."))
+		}
+		out.Write(input[written:sections[i].start])
+		out.Write(formatted)
+		out.Write(tail)
+		written = end
+		i = j - 1
+	}
+	if !found {
+		return nil, fmt.Errorf("no table '%s' in the document", strings.Join(path, "."))
+	}
+	out.Write(input[written:])
+	return out.Bytes(), nil
+}
+
+// scanSections finds the headers of input in order. A section starts at the
+// full-line comments directly above its header, which describe it.
+func scanSections(input []byte) ([]section, error) {
+	var sections []section
+	var comments []int // Line starts of the full-line comments since the last key or header
+	parser := unstable.Parser{KeepComments: true}
+	parser.Reset(input)
+	for parser.NextExpression() {
+		expr := parser.Expression()
+		switch expr.Kind {
+		case unstable.Comment:
+			comments = append(comments, lineStart(input, int(expr.Raw.Offset)))
+			continue
+		case unstable.Table, unstable.ArrayTable:
+			key := expr.Key()
+			key.Next()
+			start := lineStart(input, int(key.Node().Raw.Offset))
+			// Take in the comment lines directly above, stopping at a blank line
+			for k := len(comments) - 1; k >= 0 && start > 0 && comments[k] == lineStart(input, start-1); k-- {
+				start = comments[k]
+			}
+			sections = append(sections, section{start: start, path: keyParts(expr.Key())})
+		}
+		comments = nil
+	}
+	if err := parser.Error(); err != nil {
+		return nil, fmt.Errorf("scanning TOML source: %w", err)
+	}
+	return sections, nil
+}
+
+// lineStart returns the offset of the start of the line holding offset.
+func lineStart(input []byte, offset int) int {
+	return bytes.LastIndexByte(input[:offset], '\n') + 1
+}
+
+// underPath reports whether a table path is path itself or lies below it.
+func underPath(tablePath, path []string) bool {
+	return len(tablePath) >= len(path) && slices.Equal(tablePath[:len(path)], path)
+}
+
+// stripAncestorHeaders removes the headers of empty tables above path that
+// the formatter writes ahead of a run of sections starting at path, such as
+// [servers] before [servers.eu]. In the document they are declared elsewhere,
+// or not at all.
+func stripAncestorHeaders(formatted []byte, path []string) []byte {
+	for {
+		line, rest, _ := bytes.Cut(formatted, []byte("\n"))
+		if !isAncestorHeader(line, path) || !startsWithHeader(rest) {
+			return formatted // The table holds keys of its own
+		}
+		formatted = trimLeadingBlankLines(rest)
+	}
+}
+
+// startsWithHeader reports whether the first line of text that is neither blank
+// nor a comment is a table header.
+func startsWithHeader(text []byte) bool {
+	for len(text) > 0 {
+		line, rest, _ := bytes.Cut(text, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] != '#' {
+			return line[0] == '['
+		}
+		text = rest
+	}
+	return false
+}
+
+// trimLeadingBlankLines removes the blank lines text starts with.
+func trimLeadingBlankLines(text []byte) []byte {
+	for len(text) > 0 {
+		line, rest, found := bytes.Cut(text, []byte("\n"))
+		if !found || len(bytes.TrimSpace(line)) > 0 {
+			break
+		}
+		text = rest
+	}
+	return text
+}
+
+// isAncestorHeader reports whether line is a [table] header for a table above path.
+func isAncestorHeader(line []byte, path []string) bool {
+	parser := unstable.Parser{}
+	parser.Reset(line)
+	if !parser.NextExpression() || parser.Expression().Kind != unstable.Table {
+		return false
+	}
+	header := keyParts(parser.Expression().Key())
+	return len(header) < len(path) && underPath(path, header) && !parser.NextExpression()
+}
+
+// splitTrailingBlankLines splits text after its last line that is not blank.
+func splitTrailingBlankLines(text []byte) (body, tail []byte) {
+	end := 0
+	for offset := 0; offset < len(text); {
+		line := text[offset:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		offset += len(line)
+		if len(bytes.TrimSpace(line)) > 0 {
+			end = offset
+		}
+	}
+	return text[:end], text[end:]
+}
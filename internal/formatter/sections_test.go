@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+func TestParseKeyPath(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     string
+		want    []string
+		wantErr bool
+	}{
+		{"bare", "servers", []string{"servers"}, false},
+		{"dotted", "servers.eu.hosts", []string{"servers", "eu", "hosts"}, false},
+		{"spaces_around_dots", "servers . eu", []string{"servers", "eu"}, false},
+		{"quoted", `servers."eu.west"`, []string{"servers", "eu.west"}, false},
+		{"literal_quoted", "'a b'.c", []string{"a b", "c"}, false},
+		{"empty", "", nil, true},
+		{"trailing_dot", "servers.", nil, true},
+		{"brackets", "a]\n[b", nil, true},
+		{"space_in_bare_key", "a b", nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseKeyPath(tc.key)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseKeyPath(%q) error = %v, wantErr %v", tc.key, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseKeyPath(%q) = %q, want %q", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFormatSections(t *testing.T) {
+	// formatWith formats a run of sections like the command does, keeping its comments
+	formatWith := func(opts Options) func([]byte) ([]byte, error) {
+		return func(section []byte) ([]byte, error) {
+			var data map[string]any
+			if err := toml.Unmarshal(section, &data); err != nil {
+				return nil, err
+			}
+			source, err := ParseSourceInfo(section)
+			if err != nil {
+				return nil, err
+			}
+			opts.Source = source
+			var buf bytes.Buffer
+			if err := FormatWithOptions(data, opts, &buf); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		input   string
+		path    []string
+		opts    func(*Options)
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "only_named_table",
+			input: "b=2\n\n[a]\ny=1\nx  =  2\n\n[c]\nz=3\n",
+			path:  []string{"a"},
+			want:  "b=2\n\n[a]\nx = 2\ny = 1\n\n[c]\nz=3\n",
+		},
+		{
+			name:  "subtables_and_array_tables",
+			input: "[a]\nk=1\n[a.b]\nk=2\n[[a.list]]\nk=3\n[other]\nk=4\n",
+			path:  []string{"a"},
+			want:  "[a]\nk = 1\n\n[[a.list]]\nk = 3\n\n[a.b]\nk = 2\n[other]\nk=4\n",
+		},
+		{
+			name:  "nested_path",
+			input: "[a]\nk=1\n[a.b]\nk  =2\n[a.c]\nk=3\n",
+			path:  []string{"a", "b"},
+			want:  "[a]\nk=1\n[a.b]\nk = 2\n[a.c]\nk=3\n",
+		},
+		{
+			name:  "nested_path_indented_with_comment",
+			input: "[a]\nk=1\n# about b\n[a.b]\nk  =2\n[a.b.c]\nk=3\n",
+			path:  []string{"a", "b"},
+			opts:  func(o *Options) { o.IndentUnit = "  " },
+			want:  "[a]\nk=1\n  # about b\n  [a.b]\n    k = 2\n\n    [a.b.c]\n      k = 3\n",
+		},
+		{
+			name:  "parent_declared_later_in_run",
+			input: "[a.c]\nk=1\n[a]\nk  =2\n",
+			path:  []string{"a"},
+			want:  "[a]\nk = 2\n\n[a.c]\nk = 1\n",
+		},
+		{
+			name:    "rewritten_in_terms_of_parent",
+			input:   "[a]\nk=1\n[a.b.c]\nk=2\n",
+			path:    []string{"a", "b"},
+			opts:    func(o *Options) { o.CollapseTableChains = true },
+			wantErr: true,
+		},
+		{
+			name:  "prefix_is_not_a_match",
+			input: "[ab]\nk=1\n[a]\nk  =2\n",
+			path:  []string{"a"},
+			want:  "[ab]\nk=1\n[a]\nk = 2\n",
+		},
+		{
+			name:  "separate_runs",
+			input: "[a]\nk  =1\n\n[b]\nk  =2\n\n[a.c]\nk  =3\n",
+			path:  []string{"a"},
+			want:  "[a]\nk = 1\n\n[b]\nk  =2\n\n[a.c]\nk = 3\n",
+		},
+		{
+			name:  "comments_above_header_move_with_it",
+			input: "x=1\n# about a\n[a] # trailing\nk  =1\n",
+			path:  []string{"a"},
+			want:  "x=1\n# about a\n[a] # trailing\nk = 1\n",
+		},
+		{
+			name:  "comment_after_blank_line_stays",
+			input: "x=1\n# about x\n\n[a]\nk  =1\n",
+			path:  []string{"a"},
+			want:  "x=1\n# about x\n\n[a]\nk = 1\n",
+		},
+		{
+			name:  "quoted_header",
+			input: "[\"a.b\"]\nk  =1\n[a.b]\nk  =2\n",
+			path:  []string{"a.b"},
+			want:  "[\"a.b\"]\nk = 1\n[a.b]\nk  =2\n",
+		},
+		{
+			name:  "no_final_newline",
+			input: "x=1\n[a]\nk  =1",
+			path:  []string{"a"},
+			want:  "x=1\n[a]\nk = 1\n",
+		},
+		{
+			name:    "no_such_table",
+			input:   "a.b = 1\n[c]\n",
+			path:    []string{"a"},
+			wantErr: true,
+		},
+		{
+			name:    "empty_path",
+			input:   "[a]\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tc.opts != nil {
+				tc.opts(&opts)
+			}
+			got, err := FormatSections([]byte(tc.input), tc.path, formatWith(opts))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("FormatSections() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if string(got) != tc.want {
+				t.Errorf("FormatSections() output mismatch:\ngot:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
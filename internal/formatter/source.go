@@ -0,0 +1,580 @@
+// SPDX-License-Identifier: MIT
+
+package formatter
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// SourceInfo records details of the original TOML text that are lost when the
+// document is decoded into a map[string]any, such as the order in which keys
+// were declared and the comments around them. Build one with ParseSourceInfo
+// and pass it via Options.Source.
+type SourceInfo struct {
+	order    map[string]*keyOrder    // Declaration order of keys, by table path
+	comments map[string]*commentInfo // Comments attached to keys and headers, by entry path
+	intBases map[string]intFormat    // Non-decimal integer notation of values, by entry path
+	inline   map[string]bool         // Keys whose value was written as an inline table, by entry path
+	literals map[string]bool         // Whether each string value was written as a literal string, by entry path
+	keyForms map[string]string       // Keys exactly as written (bare or quoted), by entry path
+	groups   map[string]int          // Blank-line separated group of each key within its table, by entry path
+	verbatim map[string]verbatimLine // Key/value lines under a tomlfmt:ignore directive, by entry path
+	ignored  map[string]bool         // Tables whose header has a tomlfmt:ignore directive, by entry path
+	header   []string                // Comments opening the document, separated from what follows by a blank line
+	footer   []string                // Comments after the last key or header of the document
+}
+
+// verbatimLine is a key/value line kept as written by a tomlfmt:ignore directive.
+type verbatimLine struct {
+	text string   // Source text from the key to the end of the value
+	key  []string // Segments of the line's own key, more than one for a dotted key
+}
+
+// commentInfo holds the comments attached to one key or table header.
+type commentInfo struct {
+	leading  []string // Full-line comments directly above the key or header
+	trailing string   // Comment at the end of the key's or header's line, if any
+}
+
+// intFormat describes how a non-decimal integer was written in the source.
+type intFormat struct {
+	base  int  // 16, 8, or 2
+	upper bool // Hexadecimal digits were written in upper case
+}
+
+// Comments are looked up by "entry path": the path of a key or header in which
+// every array of tables segment also names the entry it belongs to, so that each
+// [[array.table]] entry keeps its own comments. See entrySegment.
+
+// keyOrder is the list of keys of one table in first-seen order.
+type keyOrder struct {
+	keys []string
+	seen map[string]bool
+}
+
+// ParseSourceInfo scans TOML source text and records the information that a
+// decoded map does not retain.
+//
+// Keys of an array of tables are recorded under the array's path, merged across
+// all of its entries in first-seen order. Full-line comments are attached to the
+// key or header that follows them and end-of-line comments to the key or header
+// on the same line. Comment blocks above the first key or header that are
+// followed by a blank line form the document header, and comments after the last
+// expression form the document footer.
+// Comments inside inline tables and arrays are not recorded.
+//
+// Integers written in hexadecimal, octal, or binary notation are recorded so they
+// can be written back in the same base; this covers values of keys, including
+// keys inside inline tables, but not integers inside arrays.
+//
+// Whether each string value was written as a basic or a literal string is
+// recorded for Options.StringStyle, with the same coverage as integers.
+//
+// Keys whose value is an inline table, including inline tables nested in one,
+// are recorded so the table can be written inline again rather than expanded
+// into a [section].
+//
+// Keys are numbered by the group they belong to within their table, a new group
+// starting at each key with a blank line above it (or above its comments), for
+// Options.PreserveBlankLines.
+//
+// A key with a "# tomlfmt:ignore" comment directly above it is recorded exactly
+// as written, from its key to the end of its value, so the line can be written
+// back verbatim. A header with the directive marks its table as ignored and
+// records every key below it up to the next header in the same way. A dotted key
+// is recorded with its segments, since its line can only be written back where
+// the key is written with the same dots.
+//
+// Every key and header segment is also recorded exactly as written, including
+// its quotes, for Options.PreserveKeyQuotes; this covers keys inside inline
+// tables but not keys of inline tables inside arrays.
+//
+// Parameters:
+//   - input: Raw TOML document (without a BOM)
+//
+// Returns:
+//   - *SourceInfo: Information about the source document
+//   - error: If the document cannot be parsed
+func ParseSourceInfo(input []byte) (*SourceInfo, error) {
+	info := &SourceInfo{
+		order:    map[string]*keyOrder{},
+		comments: map[string]*commentInfo{},
+		intBases: map[string]intFormat{},
+		inline:   map[string]bool{},
+		literals: map[string]bool{},
+		keyForms: map[string]string{},
+		groups:   map[string]int{},
+		verbatim: map[string]verbatimLine{},
+		ignored:  map[string]bool{},
+	}
+	entries := entryTracker{arrays: map[string]bool{}, counts: map[string]int{}}
+	groupCounts := map[string]int{} // Blank-line groups started so far, by table entry path
+
+	parser := unstable.Parser{KeepComments: true}
+	parser.Reset(input)
+	var tablePath []string  // Path of the most recent [table] or [[array.table]] header
+	var tableEntry []string // Entry path of the most recent header
+	var pending []string    // Full-line comments waiting for the next key or header
+	seenExpression := false // Whether a key or header has been seen yet
+	tableIgnored := false   // Whether the most recent header has a tomlfmt:ignore directive
+	for parser.NextExpression() {
+		expr := parser.Expression()
+		var entryPath []string
+		switch expr.Kind {
+		case unstable.Comment:
+			pending = append(pending, commentText(expr))
+			if !seenExpression && followedByBlankLine(input, expr.Raw) {
+				// Blocks above the first key or header that stand apart describe the document
+				info.header = append(info.header, pending...)
+				pending = nil
+			}
+			continue
+		case unstable.Table:
+			tablePath = keyParts(expr.Key())
+			info.recordPath(tablePath)
+			tableEntry = entries.entryPath(tablePath)
+			entryPath = tableEntry
+			info.recordKeyForms(input, entryPath, expr.Key())
+			tableIgnored = info.recordIgnoredTable(tableEntry, pending)
+		case unstable.ArrayTable:
+			tablePath = keyParts(expr.Key())
+			info.recordPath(tablePath)
+			tableEntry = entries.newEntry(tablePath)
+			entryPath = tableEntry
+			info.recordKeyForms(input, entryPath, expr.Key())
+			tableIgnored = info.recordIgnoredTable(tableEntry, pending)
+		case unstable.KeyValue:
+			keyPath := keyParts(expr.Key())
+			fullPath := append(append([]string{}, tablePath...), keyPath...)
+			info.recordPath(fullPath)
+			info.recordValue(fullPath, expr.Value())
+			entryPath = append(append([]string{}, tableEntry...), keyPath...)
+			info.recordIntFormats(entryPath, expr.Value())
+			info.recordStringForms(input, entryPath, expr.Value())
+			info.recordKeyForms(input, entryPath, expr.Key())
+			info.recordInlineKeyForms(input, entryPath, expr.Value())
+			info.recordInlineTables(entryPath, expr.Value())
+			if tableIgnored || slices.ContainsFunc(pending, isIgnoreDirective) {
+				info.verbatim[pathKey(entryPath)] = verbatimLine{
+					text: string(input[expr.Raw.Offset : expr.Raw.Offset+expr.Raw.Length]),
+					key:  keyPath,
+				}
+			}
+			keyIt := expr.Key()
+			if keyIt.Next() && blankLineBefore(input, keyIt.Node().Raw.Offset) {
+				groupCounts[pathKey(tableEntry)]++
+			}
+			keyEntry := pathKey(append(append([]string{}, tableEntry...), keyPath[0]))
+			if _, ok := info.groups[keyEntry]; !ok { // Later dotted keys extend the first one's table
+				info.groups[keyEntry] = groupCounts[pathKey(tableEntry)]
+			}
+		default:
+			continue
+		}
+		seenExpression = true
+		info.recordComments(entryPath, pending, expr.Next())
+		pending = nil
+	}
+	if err := parser.Error(); err != nil {
+		return nil, fmt.Errorf("scanning TOML source: %w", err)
+	}
+	info.footer = pending
+	return info, nil
+}
+
+// entryTracker assigns entry indexes to [[array.table]] headers while scanning.
+type entryTracker struct {
+	arrays map[string]bool // Table paths declared as arrays of tables
+	counts map[string]int  // Entries seen so far, by the entry path of the array (without index)
+}
+
+// newEntry registers a new entry of the array of tables at path and returns its entry path.
+func (e *entryTracker) newEntry(path []string) []string {
+	e.arrays[pathKey(path)] = true
+	parent := e.entryPath(path[:len(path)-1])
+	last := path[len(path)-1]
+	base := pathKey(append(append([]string{}, parent...), last))
+	e.counts[base]++
+	return append(parent, entrySegment(last, e.counts[base]-1))
+}
+
+// entryPath converts a table path into an entry path, using the latest entry of
+// every array of tables along the way.
+func (e *entryTracker) entryPath(path []string) []string {
+	out := make([]string, 0, len(path))
+	for i, seg := range path {
+		if !e.arrays[pathKey(path[:i+1])] {
+			out = append(out, seg)
+			continue
+		}
+		base := pathKey(append(append([]string{}, out...), seg))
+		out = append(out, entrySegment(seg, e.counts[base]-1))
+	}
+	return out
+}
+
+// entrySegment returns the entry path segment for entry index of the array of
+// tables named key. The \x01 separator keeps it apart from plain key segments.
+func entrySegment(key string, index int) string {
+	return key + "\x01" + strconv.Itoa(index)
+}
+
+// followedByBlankLine reports whether the line after the token at r is blank.
+func followedByBlankLine(input []byte, r unstable.Range) bool {
+	rest := input[r.Offset+r.Length:]
+	_, rest, ok := bytes.Cut(rest, []byte("\n")) // Skip the end of the token's own line
+	if !ok {
+		return false
+	}
+	line, _, _ := bytes.Cut(rest, []byte("\n"))
+	return len(bytes.TrimSpace(line)) == 0
+}
+
+// blankLineBefore reports whether a blank line separates the line holding the
+// token at offset from the content above it, looking past comment lines.
+func blankLineBefore(input []byte, offset uint32) bool {
+	start := bytes.LastIndexByte(input[:offset], '\n') + 1 // Start of the token's line
+	for start > 0 {
+		end := start - 1 // The newline ending the line above
+		start = bytes.LastIndexByte(input[:end], '\n') + 1
+		line := bytes.TrimSpace(input[start:end])
+		switch {
+		case len(line) == 0:
+			return true
+		case line[0] != '#':
+			return false // A key, header, or the end of a multi-line value
+		}
+	}
+	return false
+}
+
+// commentText returns the text of a comment node without any line ending.
+func commentText(n *unstable.Node) string {
+	return strings.TrimRight(string(n.Data), "\r")
+}
+
+// recordComments attaches leading comments and an optional end-of-line comment
+// node (the sibling chained after an expression) to entryPath.
+func (s *SourceInfo) recordComments(entryPath []string, leading []string, next *unstable.Node) {
+	var trailing string
+	if next != nil && next.Kind == unstable.Comment {
+		trailing = commentText(next)
+	}
+	if len(leading) == 0 && trailing == "" {
+		return
+	}
+	key := pathKey(entryPath)
+	c, ok := s.comments[key]
+	if !ok {
+		c = &commentInfo{}
+		s.comments[key] = c
+	}
+	c.leading = append(c.leading, leading...)
+	if trailing != "" {
+		c.trailing = trailing
+	}
+}
+
+// keyParts returns the unquoted parts of a (possibly dotted) key.
+func keyParts(it unstable.Iterator) []string {
+	var parts []string
+	for it.Next() {
+		parts = append(parts, string(it.Node().Data))
+	}
+	return parts
+}
+
+// recordPath notes every segment of path as a key of its parent table.
+func (s *SourceInfo) recordPath(path []string) {
+	for i := range path {
+		parent := pathKey(path[:i])
+		order, ok := s.order[parent]
+		if !ok {
+			order = &keyOrder{seen: map[string]bool{}}
+			s.order[parent] = order
+		}
+		if !order.seen[path[i]] {
+			order.seen[path[i]] = true
+			order.keys = append(order.keys, path[i])
+		}
+	}
+}
+
+// recordValue records the keys of inline tables found in a value, including
+// inline tables that are entries of an array.
+func (s *SourceInfo) recordValue(path []string, value *unstable.Node) {
+	switch value.Kind {
+	case unstable.InlineTable:
+		it := value.Children()
+		for it.Next() {
+			kv := it.Node()
+			if kv.Kind != unstable.KeyValue {
+				continue
+			}
+			fullPath := append(append([]string{}, path...), keyParts(kv.Key())...)
+			s.recordPath(fullPath)
+			s.recordValue(fullPath, kv.Value())
+		}
+	case unstable.Array:
+		it := value.Children()
+		for it.Next() {
+			if item := it.Node(); item.Kind == unstable.InlineTable {
+				s.recordValue(path, item) // Entries share the array's path, like [[array.table]]
+			}
+		}
+	}
+}
+
+// recordKeyForms records the source text of each part of a (possibly dotted)
+// key. The parts name the last segments of entryPath.
+func (s *SourceInfo) recordKeyForms(input []byte, entryPath []string, key unstable.Iterator) {
+	var parts []*unstable.Node
+	for key.Next() {
+		parts = append(parts, key.Node())
+	}
+	first := len(entryPath) - len(parts) // Segment of entryPath named by the first part
+	for i, part := range parts {
+		raw := input[part.Raw.Offset : part.Raw.Offset+part.Raw.Length]
+		s.keyForms[pathKey(entryPath[:first+i+1])] = string(raw)
+	}
+}
+
+// recordInlineKeyForms records the source text of the keys inside an inline
+// table value at entryPath, including nested inline tables.
+func (s *SourceInfo) recordInlineKeyForms(input []byte, entryPath []string, value *unstable.Node) {
+	if value.Kind != unstable.InlineTable {
+		return
+	}
+	it := value.Children()
+	for it.Next() {
+		kv := it.Node()
+		if kv.Kind != unstable.KeyValue {
+			continue
+		}
+		childPath := append(append([]string{}, entryPath...), keyParts(kv.Key())...)
+		s.recordKeyForms(input, childPath, kv.Key())
+		s.recordInlineKeyForms(input, childPath, kv.Value())
+	}
+}
+
+// recordInlineTables marks an inline table value at entryPath, and the inline
+// tables nested in it, as written inline, so that a nested one stays inline
+// when the table around it is written under its own header instead.
+func (s *SourceInfo) recordInlineTables(entryPath []string, value *unstable.Node) {
+	if value.Kind != unstable.InlineTable {
+		return
+	}
+	s.inline[pathKey(entryPath)] = true
+	it := value.Children()
+	for it.Next() {
+		kv := it.Node()
+		if kv.Kind != unstable.KeyValue {
+			continue
+		}
+		childPath := append(append([]string{}, entryPath...), keyParts(kv.Key())...)
+		s.recordInlineTables(childPath, kv.Value())
+	}
+}
+
+// recordIntFormats records the notation of a non-decimal integer value at
+// entryPath, looking into inline tables for nested keys.
+func (s *SourceInfo) recordIntFormats(entryPath []string, value *unstable.Node) {
+	switch value.Kind {
+	case unstable.Integer:
+		raw := string(value.Data)
+		if len(raw) < 2 || raw[0] != '0' {
+			return // Decimal, possibly signed
+		}
+		switch raw[1] {
+		case 'x':
+			s.intBases[pathKey(entryPath)] = intFormat{base: 16, upper: strings.ContainsAny(raw[2:], "ABCDEF")}
+		case 'o':
+			s.intBases[pathKey(entryPath)] = intFormat{base: 8}
+		case 'b':
+			s.intBases[pathKey(entryPath)] = intFormat{base: 2}
+		}
+	case unstable.InlineTable:
+		it := value.Children()
+		for it.Next() {
+			kv := it.Node()
+			if kv.Kind == unstable.KeyValue {
+				s.recordIntFormats(append(append([]string{}, entryPath...), keyParts(kv.Key())...), kv.Value())
+			}
+		}
+	}
+}
+
+// recordStringForms records whether a string value at entryPath was written as a
+// literal string, looking into inline tables for nested keys.
+func (s *SourceInfo) recordStringForms(input []byte, entryPath []string, value *unstable.Node) {
+	switch value.Kind {
+	case unstable.String:
+		if int(value.Raw.Offset) < len(input) {
+			s.literals[pathKey(entryPath)] = input[value.Raw.Offset] == '\''
+		}
+	case unstable.InlineTable:
+		it := value.Children()
+		for it.Next() {
+			kv := it.Node()
+			if kv.Kind == unstable.KeyValue {
+				s.recordStringForms(input, append(append([]string{}, entryPath...), keyParts(kv.Key())...), kv.Value())
+			}
+		}
+	}
+}
+
+// stringFormFor reports whether the string at entryPath was written as a literal
+// string, and whether a string was recorded there at all.
+func (s *SourceInfo) stringFormFor(entryPath []string) (literal, ok bool) {
+	if s == nil {
+		return false, false
+	}
+	literal, ok = s.literals[pathKey(entryPath)]
+	return literal, ok
+}
+
+// intFormatFor returns the notation recorded for the integer at entryPath and
+// whether one was recorded; decimal integers have none.
+func (s *SourceInfo) intFormatFor(entryPath []string) (intFormat, bool) {
+	if s == nil {
+		return intFormat{}, false
+	}
+	f, ok := s.intBases[pathKey(entryPath)]
+	return f, ok
+}
+
+// isInlineTable reports whether the value of the key at entryPath was written
+// as an inline table in the source.
+func (s *SourceInfo) isInlineTable(entryPath []string) bool {
+	if s == nil {
+		return false
+	}
+	return s.inline[pathKey(entryPath)]
+}
+
+// keyGroup returns the blank-line separated group, counted from the top of its
+// table, that the key at entryPath was declared in, and whether it was seen.
+func (s *SourceInfo) keyGroup(entryPath []string) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	group, ok := s.groups[pathKey(entryPath)]
+	return group, ok
+}
+
+// ignoreDirective is the comment that asks for a key, or the keys of a table,
+// to be left as written.
+const ignoreDirective = "tomlfmt:ignore"
+
+// isIgnoreDirective reports whether a comment is the ignore directive, which may
+// be followed by an explanation: "# tomlfmt:ignore keep the columns".
+func isIgnoreDirective(comment string) bool {
+	text := strings.TrimSpace(strings.TrimPrefix(comment, "#"))
+	rest, ok := strings.CutPrefix(text, ignoreDirective)
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// recordIgnoredTable marks the table at entryPath as ignored when the comments
+// above its header include the ignore directive, and reports whether it did.
+func (s *SourceInfo) recordIgnoredTable(entryPath []string, leading []string) bool {
+	if !slices.ContainsFunc(leading, isIgnoreDirective) {
+		return false
+	}
+	s.ignored[pathKey(entryPath)] = true
+	return true
+}
+
+// verbatimFor returns the key/value line at entryPath when an ignore directive
+// asked for it to be kept, and whether there is one.
+func (s *SourceInfo) verbatimFor(entryPath []string) (verbatimLine, bool) {
+	if s == nil {
+		return verbatimLine{}, false
+	}
+	line, ok := s.verbatim[pathKey(entryPath)]
+	return line, ok
+}
+
+// isIgnoredTable reports whether the header of the table at entryPath has an
+// ignore directive.
+func (s *SourceInfo) isIgnoredTable(entryPath []string) bool {
+	if s == nil {
+		return false
+	}
+	return s.ignored[pathKey(entryPath)]
+}
+
+// keyForm returns the key or header segment at entryPath exactly as it was
+// written, and whether it was seen in the source.
+func (s *SourceInfo) keyForm(entryPath []string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	form, ok := s.keyForms[pathKey(entryPath)]
+	return form, ok
+}
+
+// keysInOrder returns the declared keys of the table at path in source order.
+// It returns nil if the table was not seen in the source.
+func (s *SourceInfo) keysInOrder(path []string) []string {
+	if s == nil {
+		return nil
+	}
+	if order, ok := s.order[pathKey(path)]; ok {
+		return order.keys
+	}
+	return nil
+}
+
+// commentsFor returns the comments attached to the key or header at entryPath,
+// or nil if it has none.
+func (s *SourceInfo) commentsFor(entryPath []string) *commentInfo {
+	if s == nil {
+		return nil
+	}
+	return s.comments[pathKey(entryPath)]
+}
+
+// leadingComments returns the full-line comments above a key or header; it is nil-safe.
+func (c *commentInfo) leadingComments() []string {
+	if c == nil {
+		return nil
+	}
+	return c.leading
+}
+
+// trailingComment returns the end-of-line comment of a key or header, prefixed
+// with a separating space, or "" if there is none; it is nil-safe.
+func (c *commentInfo) trailingComment() string {
+	if c == nil || c.trailing == "" {
+		return ""
+	}
+	return " " + c.trailing
+}
+
+// headerComments returns the comment block that opens the document.
+func (s *SourceInfo) headerComments() []string {
+	if s == nil {
+		return nil
+	}
+	return s.header
+}
+
+// footerComments returns the comments that follow the last key or header.
+func (s *SourceInfo) footerComments() []string {
+	if s == nil {
+		return nil
+	}
+	return s.footer
+}
+
+// pathKey joins a table path into a single map key. A NUL separator is used
+// because, unlike ".", it cannot be confused with a dot inside a quoted key.
+func pathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
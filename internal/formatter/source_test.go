@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSourceInfo(t *testing.T) {
+	input := `zeta = 1
+alpha = 2
+dotted.inner = 3
+
+[[servers]]
+name = "a"
+host = "x"
+
+[[servers]]
+port = 1
+name = "b"
+
+[config]
+point = { y = 1, x = 2 }
+list = [{ b = 1, a = 2 }]
+`
+	info, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		path []string
+		want []string
+	}{
+		{"root", nil, []string{"zeta", "alpha", "dotted", "servers", "config"}},
+		{"dotted_key", []string{"dotted"}, []string{"inner"}},
+		{"array_table_merged", []string{"servers"}, []string{"name", "host", "port"}},
+		{"table", []string{"config"}, []string{"point", "list"}},
+		{"inline_table", []string{"config", "point"}, []string{"y", "x"}},
+		{"inline_tables_in_array", []string{"config", "list"}, []string{"b", "a"}},
+		{"unknown", []string{"missing"}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := info.keysInOrder(tc.path)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("keysInOrder(%q) = %q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+
+	if _, err := ParseSourceInfo([]byte("key = \"unterminated\n")); err == nil {
+		t.Errorf("ParseSourceInfo() on invalid TOML returned nil error")
+	}
+}
+
+func TestParseSourceInfoComments(t *testing.T) {
+	input := "# Document header\r\n\r\n# about title\r\ntitle = \"x\" # inline\r\n" + `
+# about owner
+# second line
+[owner] # owner header
+name = "a"
+
+[[items]]
+# first entry
+id = 1
+
+[[items]] # second entry
+id = 2 # two
+[[items.parts]]
+# part of the second entry
+id = 3
+
+# footer
+`
+	info, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name         string
+		entryPath    []string
+		wantLeading  []string
+		wantTrailing string
+	}{
+		{"key_with_crlf", []string{"title"}, []string{"# about title"}, " # inline"},
+		{"table_header", []string{"owner"}, []string{"# about owner", "# second line"}, " # owner header"},
+		{"key_without_comments", []string{"owner", "name"}, nil, ""},
+		{"first_array_entry_key", []string{entrySegment("items", 0), "id"}, []string{"# first entry"}, ""},
+		{"second_array_entry_header", []string{entrySegment("items", 1)}, nil, " # second entry"},
+		{"second_array_entry_key", []string{entrySegment("items", 1), "id"}, nil, " # two"},
+		{
+			"nested_array_entry_key",
+			[]string{entrySegment("items", 1), entrySegment("parts", 0), "id"},
+			[]string{"# part of the second entry"},
+			"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := info.commentsFor(tc.entryPath)
+			if got := c.leadingComments(); strings.Join(got, "|") != strings.Join(tc.wantLeading, "|") {
+				t.Errorf("leading comments = %q, want %q", got, tc.wantLeading)
+			}
+			if got := c.trailingComment(); got != tc.wantTrailing {
+				t.Errorf("trailing comment = %q, want %q", got, tc.wantTrailing)
+			}
+		})
+	}
+
+	if got := info.headerComments(); strings.Join(got, "|") != "# Document header" {
+		t.Errorf("headerComments() = %q, want [\"# Document header\"]", got)
+	}
+	if got := info.footerComments(); strings.Join(got, "|") != "# footer" {
+		t.Errorf("footerComments() = %q, want [\"# footer\"]", got)
+	}
+}
+
+func TestIsIgnoreDirective(t *testing.T) {
+	testCases := []struct {
+		comment string
+		want    bool
+	}{
+		{"# tomlfmt:ignore", true},
+		{"#tomlfmt:ignore", true},
+		{"#   tomlfmt:ignore  ", true},
+		{"# tomlfmt:ignore keep the columns", true},
+		{"# tomlfmt:ignored", false},
+		{"# see tomlfmt:ignore", false},
+		{"# TOMLFMT:IGNORE", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.comment, func(t *testing.T) {
+			if got := isIgnoreDirective(tc.comment); got != tc.want {
+				t.Errorf("isIgnoreDirective(%q) = %v, want %v", tc.comment, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSourceInfoIgnoreDirective(t *testing.T) {
+	input := `# tomlfmt:ignore
+grid   =  [ 1, 0,
+            0, 1 ]  # identity
+plain =   1
+# tomlfmt:ignore
+a.b =  2
+
+# tomlfmt:ignore
+[colors]
+red   = "#f00"
+
+[other]
+x  = 1
+`
+	info, err := ParseSourceInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		entryPath []string
+		want      string // "" when no text is kept
+	}{
+		{"multi_line_value", []string{"grid"}, "grid   =  [ 1, 0,\n            0, 1 ]"},
+		{"no_directive", []string{"plain"}, ""},
+		{"dotted_key", []string{"a", "b"}, "a.b =  2"},
+		{"ignored_table_key", []string{"colors", "red"}, `red   = "#f00"`},
+		{"next_table_key", []string{"other", "x"}, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := info.verbatimFor(tc.entryPath)
+			if ok != (tc.want != "") || got.text != tc.want {
+				t.Errorf("verbatimFor(%q) = %q, %v, want %q", tc.entryPath, got.text, ok, tc.want)
+			}
+		})
+	}
+
+	if !info.isIgnoredTable([]string{"colors"}) {
+		t.Error("isIgnoredTable(colors) = false, want true")
+	}
+	if info.isIgnoredTable([]string{"other"}) {
+		t.Error("isIgnoredTable(other) = true, want false")
+	}
+}
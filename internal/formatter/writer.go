@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// docWriter streams formatted output to the destination writer while applying
+// the two document-wide clean-ups: trailing spaces and tabs are stripped from
+// every line, and the newlines at the end of the document are replaced by
+// exactly finalNewlines. Only the current line and a count of pending newlines
+// are held back, so memory use does not grow with the size of the document.
+type docWriter struct {
+	w             *bufio.Writer
+	line          []byte // Current line, written once its end is known so it can be trimmed
+	newlines      int    // Newlines seen since the last written text, written before the next text
+	wroteText     bool   // Whether any non-blank text has been written
+	finalNewlines int    // Newlines ending a non-empty document
+	err           error  // First error from the destination
+}
+
+// newDocWriter returns a docWriter that writes to output.
+func newDocWriter(output io.Writer, finalNewlines int) *docWriter {
+	return &docWriter{w: bufio.NewWriter(output), finalNewlines: max(finalNewlines, 0)}
+}
+
+// Write implements io.Writer.
+// Errors from the destination are reported by finish.
+func (d *docWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			d.line = append(d.line, p...)
+			break
+		}
+		d.line = append(d.line, p[:i]...)
+		d.endLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// WriteString writes s like Write.
+func (d *docWriter) WriteString(s string) (int, error) {
+	n := len(s)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			d.line = append(d.line, s...)
+			break
+		}
+		d.line = append(d.line, s[:i]...)
+		d.endLine()
+		s = s[i+1:]
+	}
+	return n, nil
+}
+
+// WriteRaw writes s like WriteString, except that the lines it ends keep their
+// trailing whitespace. It is for source text that must pass through unchanged,
+// such as a multi-line string kept by a tomlfmt:ignore directive, where trailing
+// spaces are part of the value.
+func (d *docWriter) WriteRaw(s string) {
+	for {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			d.line = append(d.line, s...)
+			return
+		}
+		d.line = append(d.line, s[:i]...)
+		d.writeLine(d.line)
+		d.line = d.line[:0]
+		d.newlines++
+		s = s[i+1:]
+	}
+}
+
+// endLine writes the current line without its trailing whitespace and counts its newline.
+func (d *docWriter) endLine() {
+	d.flushLine()
+	d.newlines++
+}
+
+// flushLine writes the trimmed current line, preceded by the pending newlines,
+// unless it is blank, in which case the newlines stay pending.
+func (d *docWriter) flushLine() {
+	d.writeLine(bytes.TrimRight(d.line, " \t"))
+	d.line = d.line[:0]
+}
+
+// writeLine writes text, preceded by the pending newlines, unless it is empty,
+// in which case the newlines stay pending.
+func (d *docWriter) writeLine(text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	d.writeNewlines(d.newlines)
+	d.newlines = 0
+	d.write(text)
+	d.wroteText = true
+}
+
+// writeNewlines writes n newlines.
+func (d *docWriter) writeNewlines(n int) {
+	for range n {
+		if d.err == nil {
+			d.err = d.w.WriteByte('\n')
+		}
+	}
+}
+
+// write writes b unless an earlier write failed.
+func (d *docWriter) write(b []byte) {
+	if d.err == nil {
+		_, d.err = d.w.Write(b)
+	}
+}
+
+// finish ends the document with finalNewlines newlines (nothing for a document
+// without text) and flushes everything to the destination.
+//
+// Returns:
+//   - error: The first error returned by the destination writer
+func (d *docWriter) finish() error {
+	d.flushLine()
+	if d.wroteText {
+		d.writeNewlines(d.finalNewlines)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return d.w.Flush()
+}
@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MIT
+package formatter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDocWriter(t *testing.T) {
+	testCases := []struct {
+		name          string
+		writes        []string
+		finalNewlines int
+		want          string
+	}{
+		{"empty", nil, 1, ""},
+		{"only_newlines", []string{"\n\n"}, 1, ""},
+		{"trims_trailing_whitespace", []string{"a = 1  \n", "b = 2\t\n"}, 1, "a = 1\nb = 2\n"},
+		{"keeps_blank_lines", []string{"a = 1\n", "  \n", "\n", "[t]\n"}, 1, "a = 1\n\n\n[t]\n"},
+		{"normalizes_final_newlines", []string{"a = 1\n\n\n"}, 2, "a = 1\n\n"},
+		{"adds_missing_final_newline", []string{"a = 1"}, 1, "a = 1\n"},
+		{"no_final_newline", []string{"a = 1\n"}, 0, "a = 1"},
+		{"negative_final_newlines", []string{"a = 1\n"}, -1, "a = 1"},
+		{"keeps_leading_newlines", []string{"\n", "a = 1\n"}, 1, "\na = 1\n"},
+		{"line_split_across_writes", []string{"a =", " 1 ", " \nb", " = 2\n"}, 1, "a = 1\nb = 2\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			d := newDocWriter(&buf, tc.finalNewlines)
+			for _, w := range tc.writes {
+				if _, err := d.WriteString(w); err != nil {
+					t.Fatalf("WriteString(%q) returned unexpected error: %v", w, err)
+				}
+			}
+			if err := d.finish(); err != nil {
+				t.Fatalf("finish() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("output = %q, want %q", buf.String(), tc.want)
+			}
+		})
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestDocWriterReportsWriteErrors(t *testing.T) {
+	d := newDocWriter(failingWriter{}, 1)
+	if _, err := d.WriteString("a = 1\n"); err != nil {
+		t.Fatalf("WriteString() returned unexpected error: %v", err)
+	}
+	if err := d.finish(); err == nil || err.Error() != "disk full" {
+		t.Errorf("finish() error = %v, want disk full", err)
+	}
+}
+
+func TestDocWriterWriteRaw(t *testing.T) {
+	var buf bytes.Buffer
+	d := newDocWriter(&buf, 1)
+	_, _ = d.WriteString("a = 1  \n")
+	d.WriteRaw("s = '''  \nspaces  \n \t\n'''")
+	_, _ = d.WriteString("  \n")
+	if err := d.finish(); err != nil {
+		t.Fatalf("finish() returned unexpected error: %v", err)
+	}
+	// Only the lines WriteRaw ends keep their trailing whitespace
+	if want := "a = 1\ns = '''  \nspaces  \n \t\n'''\n"; buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
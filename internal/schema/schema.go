@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: MIT
+
+// Package schema validates decoded TOML data against a minimal schema that maps
+// dotted key paths to expected value types.
+//
+// A schema is itself a TOML document. Each string value names the expected type
+// of the key at that path, and nested tables are flattened into dotted paths, so
+// the following two schemas are equivalent:
+//
+//	"server.port" = "integer"
+//
+//	[server]
+//	port = "integer"
+//
+// Supported types are string, integer, float, boolean, datetime, date, time,
+// array, table, and any. Keys inside a path declared as table, array, or any
+// are not checked further. Keys inside an array of tables are addressed by the
+// array's path without an index (e.g. "database.host").
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// Schema maps dotted key paths to their expected type names.
+type Schema map[string]string
+
+// Diagnostic describes a single mismatch between a document and a schema.
+type Diagnostic struct {
+	Path    string // Dotted path of the offending key
+	Message string // Human readable description of the mismatch
+}
+
+// String returns the diagnostic in "path: message" form.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Path, d.Message)
+}
+
+// validTypes lists the type names accepted in a schema file.
+var validTypes = map[string]bool{
+	"string":   true,
+	"integer":  true,
+	"float":    true,
+	"boolean":  true,
+	"datetime": true,
+	"date":     true,
+	"time":     true,
+	"array":    true,
+	"table":    true,
+	"any":      true,
+}
+
+// Load parses a schema document and returns the flattened path-to-type mapping.
+//
+// Parameters:
+//   - input: Raw bytes of the schema TOML document
+//
+// Returns:
+//   - Schema: The flattened schema
+//   - error: If the document cannot be parsed or declares an unknown type
+func Load(input []byte) (Schema, error) {
+	var raw map[string]any
+	if err := toml.Unmarshal(input, &raw); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	s := Schema{}
+	if err := flatten(raw, "", s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// flatten walks a decoded schema document and records each declared type under
+// its dotted path.
+func flatten(raw map[string]any, prefix string, s Schema) error {
+	for k, v := range raw {
+		path := joinPath(prefix, k)
+		switch val := v.(type) {
+		case string:
+			if !validTypes[val] {
+				return fmt.Errorf("schema key '%s': unknown type %q", path, val)
+			}
+			s[path] = val
+		case map[string]any:
+			if err := flatten(val, path, s); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("schema key '%s': expected a type name, got %T", path, v)
+		}
+	}
+	return nil
+}
+
+// Validate walks the decoded document and reports keys whose value does not
+// match the declared type, as well as keys the schema does not declare.
+// Diagnostics are returned sorted by path.
+//
+// Parameters:
+//   - data: Map representing parsed TOML data structure
+//   - s: Schema to validate against
+//
+// Returns:
+//   - []Diagnostic: Every mismatch found, or nil if the document conforms
+func (s Schema) Validate(data map[string]any) []Diagnostic {
+	var diags []Diagnostic
+	s.validateMap(data, "", &diags)
+	sort.SliceStable(diags, func(i, j int) bool { return diags[i].Path < diags[j].Path })
+	return diags
+}
+
+// validateMap checks every key of a table against the schema, recursing into
+// nested tables and arrays of tables that the schema describes.
+func (s Schema) validateMap(dataMap map[string]any, prefix string, diags *[]Diagnostic) {
+	for k, v := range dataMap {
+		path := joinPath(prefix, k)
+		want, declared := s[path]
+		if !declared {
+			if !s.hasChildren(path) {
+				*diags = append(*diags, Diagnostic{Path: path, Message: "unknown key"})
+				continue
+			}
+			// The schema describes keys below this path, so descend into it
+			switch val := v.(type) {
+			case map[string]any:
+				s.validateMap(val, path, diags)
+			case []any:
+				for _, item := range val {
+					if subMap, ok := item.(map[string]any); ok {
+						s.validateMap(subMap, path, diags)
+					}
+				}
+			default:
+				*diags = append(*diags, Diagnostic{
+					Path:    path,
+					Message: fmt.Sprintf("expected table, got %s", typeName(v)),
+				})
+			}
+			continue
+		}
+		if got := typeName(v); want != "any" && got != want {
+			*diags = append(*diags, Diagnostic{
+				Path:    path,
+				Message: fmt.Sprintf("expected %s, got %s", want, got),
+			})
+		}
+	}
+}
+
+// hasChildren reports whether the schema declares any path below the given one.
+func (s Schema) hasChildren(path string) bool {
+	prefix := path + "."
+	for p := range s {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName returns the schema type name for a decoded TOML value.
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "integer"
+	case float32, float64:
+		return "float"
+	case bool:
+		return "boolean"
+	case time.Time, toml.LocalDateTime:
+		return "datetime"
+	case toml.LocalDate:
+		return "date"
+	case toml.LocalTime:
+		return "time"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "table"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// joinPath appends a key to a dotted path prefix.
+func joinPath(prefix, k string) string {
+	if prefix == "" {
+		return k
+	}
+	return prefix + "." + k
+}
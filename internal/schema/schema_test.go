@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	testCases := []struct {
+		name               string
+		input              string
+		want               Schema
+		wantErrMsgContains string
+	}{
+		{
+			name:  "dotted_keys",
+			input: "\"server.port\" = \"integer\"\n",
+			want:  Schema{"server.port": "integer"},
+		},
+		{
+			name:  "nested_tables",
+			input: "title = \"string\"\n[server]\nport = \"integer\"\n",
+			want:  Schema{"title": "string", "server.port": "integer"},
+		},
+		{
+			name:               "unknown_type",
+			input:              "port = \"number\"\n",
+			wantErrMsgContains: "schema key 'port': unknown type \"number\"",
+		},
+		{
+			name:               "not_a_type_name",
+			input:              "port = 1\n",
+			wantErrMsgContains: "schema key 'port': expected a type name",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Load([]byte(tc.input))
+			if tc.wantErrMsgContains != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrMsgContains) {
+					t.Fatalf("Load() error = %v, want error containing %q", err, tc.wantErrMsgContains)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() returned unexpected error: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("Load() = %v, want %v", got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("Load()[%q] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := Schema{
+		"title":         "string",
+		"server.port":   "integer",
+		"server.extra":  "any",
+		"database.host": "string",
+		"plugins":       "table",
+	}
+
+	testCases := []struct {
+		name      string
+		inputData map[string]any
+		want      []string
+	}{
+		{
+			name: "conforming",
+			inputData: map[string]any{
+				"title":    "example",
+				"server":   map[string]any{"port": int64(80), "extra": true},
+				"database": []any{map[string]any{"host": "db1"}},
+				"plugins":  map[string]any{"anything": "goes"},
+			},
+			want: nil,
+		},
+		{
+			name: "type_mismatch",
+			inputData: map[string]any{
+				"title":    int64(1),
+				"server":   map[string]any{"port": "80"},
+				"database": []any{map[string]any{"host": false}},
+			},
+			want: []string{
+				"database.host: expected string, got boolean",
+				"server.port: expected integer, got string",
+				"title: expected string, got integer",
+			},
+		},
+		{
+			name: "unknown_key",
+			inputData: map[string]any{
+				"titel":  "typo",
+				"server": map[string]any{"port": int64(80), "host": "localhost"},
+			},
+			want: []string{
+				"server.host: unknown key",
+				"titel: unknown key",
+			},
+		},
+		{
+			name:      "table_expected",
+			inputData: map[string]any{"server": "localhost"},
+			want:      []string{"server: expected table, got string"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			diags := s.Validate(tc.inputData)
+			got := make([]string, 0, len(diags))
+			for _, d := range diags {
+				got = append(got, d.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("Validate() mismatch:\ngot:\n%s\nwant:\n%s",
+					strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
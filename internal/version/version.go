@@ -15,13 +15,19 @@ var (
 	BuiltBy string
 )
 
+// GetVersion returns only the application version set by ldflags, or "dev" for
+// builds without one, for scripts that need the bare version on a single line.
+func GetVersion() string {
+	if Version == "" {
+		return "dev" // Default if version ldflag not set
+	}
+	return Version
+}
+
 // GetVersionInfo builds the application version string including build details.
 func GetVersionInfo() string {
 	// Start with the Version set by ldflags, or provide a default
-	result := Version
-	if result == "" {
-		result = "dev" // Default if version ldflag not set
-	}
+	result := GetVersion()
 
 	// Append Commit if available
 	commit := Commit
@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+package version
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetVersion(t *testing.T) {
+	testCases := []struct {
+		name    string
+		version string
+		want    string
+	}{
+		{"dev_build", "", "dev"},
+		{"release", "1.2.3", "1.2.3"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			saved := [...]string{Version, Commit, Date, BuiltBy}
+			t.Cleanup(func() { Version, Commit, Date, BuiltBy = saved[0], saved[1], saved[2], saved[3] })
+			Version, Commit, Date, BuiltBy = tc.version, "abc1234", "2024-03-15", "TestScript"
+
+			got := GetVersion()
+			if got != tc.want {
+				t.Errorf("GetVersion() = %q, want %q", got, tc.want)
+			}
+			if strings.ContainsAny(got, "\n\r") || strings.Contains(got, "abc1234") {
+				t.Errorf("GetVersion() = %q, want a single line without build metadata", got)
+			}
+			if !strings.HasPrefix(GetVersionInfo(), tc.want+"\n") {
+				t.Errorf("GetVersionInfo() does not start with the short version %q:\n%s", tc.want, GetVersionInfo())
+			}
+		})
+	}
+}
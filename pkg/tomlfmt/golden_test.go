@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+package tomlfmt_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esacteksab/go-pretty-toml/pkg/tomlfmt"
+)
+
+// update rewrites the golden files from the current output:
+//
+//	go test ./pkg/tomlfmt -run TestGoldenCorpus -update
+//
+// Review the resulting diff carefully: every changed golden file is a change in
+// the output users will see, and reformatting churn when they upgrade.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden and testdata/corpus")
+
+// corpusDirs hold the inputs under testdata that have golden files: golden has
+// small documents that each exercise a feature, and corpus has whole files
+// modeled on real-world ones (Cargo.toml, pyproject.toml, service configuration).
+var corpusDirs = []string{"golden", "corpus"}
+
+// corpusInputs returns the paths of every input in corpusDirs.
+func corpusInputs(tb testing.TB) []string {
+	tb.Helper()
+	var inputs []string
+	for _, dir := range corpusDirs {
+		matches, err := filepath.Glob(filepath.Join("testdata", dir, "*.toml"))
+		if err != nil {
+			tb.Fatalf("listing corpus: %v", err)
+		}
+		if len(matches) == 0 {
+			tb.Fatalf("no inputs found in testdata/%s", dir)
+		}
+		inputs = append(inputs, matches...)
+	}
+	return inputs
+}
+
+// TestGoldenCorpus formats every testdata/golden/*.toml and testdata/corpus/*.toml
+// input with the default options and compares the result with the committed
+// NAME.golden file, so that any change to the output is caught and has to be
+// made on purpose. The golden output must also be stable: formatting it again
+// returns it unchanged.
+func TestGoldenCorpus(t *testing.T) {
+	for _, inputPath := range corpusInputs(t) {
+		name := filepath.Base(filepath.Dir(inputPath)) + "/" + strings.TrimSuffix(filepath.Base(inputPath), ".toml")
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(inputPath) // #nosec G304 -- path comes from the test corpus
+			if err != nil {
+				t.Fatalf("reading input: %v", err)
+			}
+			got, err := tomlfmt.FormatBytes(input, tomlfmt.DefaultOptions())
+			if err != nil {
+				t.Fatalf("FormatBytes() returned unexpected error: %v", err)
+			}
+
+			goldenPath := strings.TrimSuffix(inputPath, ".toml") + ".golden"
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil { // #nosec G306 -- test fixture
+					t.Fatalf("writing golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath) // #nosec G304 -- path comes from the test corpus
+			if err != nil {
+				t.Fatalf("reading golden file (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s (run with -update if the change is intended):\ngot:\n%s\nwant:\n%s",
+					goldenPath, got, want)
+			}
+
+			again, err := tomlfmt.FormatBytes(got, tomlfmt.DefaultOptions())
+			if err != nil {
+				t.Fatalf("FormatBytes() of the formatted output returned unexpected error: %v", err)
+			}
+			if !bytes.Equal(again, got) {
+				t.Errorf("formatting the output again changed it:\nfirst:\n%s\nsecond:\n%s", got, again)
+			}
+		})
+	}
+}
+
+// BenchmarkFormatCorpus formats every input of the golden corpus in turn, so
+// that a feature making real-world documents slower to format shows up. The
+// throughput is reported in input bytes.
+func BenchmarkFormatCorpus(b *testing.B) {
+	var inputs [][]byte
+	var total int64
+	for _, inputPath := range corpusInputs(b) {
+		input, err := os.ReadFile(inputPath) // #nosec G304 -- path comes from the test corpus
+		if err != nil {
+			b.Fatalf("reading input: %v", err)
+		}
+		inputs = append(inputs, input)
+		total += int64(len(input))
+	}
+	opts := tomlfmt.DefaultOptions()
+
+	b.SetBytes(total)
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, input := range inputs {
+			if _, err := tomlfmt.FormatBytes(input, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
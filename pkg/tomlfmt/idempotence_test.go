@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MIT
+package tomlfmt_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esacteksab/go-pretty-toml/pkg/tomlfmt"
+)
+
+// TestIdempotent formats every corpus input with a range of option sets and
+// checks that formatting the result again changes nothing. TestGoldenCorpus
+// covers the default options; this covers the rest.
+func TestIdempotent(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "golden", "*.toml"))
+	if err != nil {
+		t.Fatalf("listing corpus: %v", err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no inputs found in testdata/golden")
+	}
+
+	optionSets := []struct {
+		name   string
+		modify func(*tomlfmt.Options)
+	}{
+		{"default", func(*tomlfmt.Options) {}},
+		{"indent", func(o *tomlfmt.Options) { o.IndentUnit = "  " }},
+		{"indent_tab", func(o *tomlfmt.Options) { o.IndentUnit = "\t" }},
+		{"source_order", func(o *tomlfmt.Options) { o.SortKeys = tomlfmt.SortNone }},
+		{"sort_array_tables", func(o *tomlfmt.Options) { o.SortArrayTables = true }},
+		{"no_align", func(o *tomlfmt.Options) { o.AlignValues = false }},
+		{"group_by_type", func(o *tomlfmt.Options) { o.GroupKeysByValueType = true }},
+		{"inline_tables", func(o *tomlfmt.Options) { o.InlineTableMaxKeys = 3 }},
+		{"collapse_chains", func(o *tomlfmt.Options) { o.CollapseTableChains = true }},
+		{"multiline_strings", func(o *tomlfmt.Options) { o.MultilineStrings = tomlfmt.MultilineWhenNewlines }},
+		{"narrow", func(o *tomlfmt.Options) { o.MaxLineWidth = 20; o.InlineTableMaxKeys = 2 }},
+		{"narrow_trailing_comma", func(o *tomlfmt.Options) { o.MaxLineWidth = 20; o.TrailingComma = true }},
+		{"no_separators", func(o *tomlfmt.Options) { o.Separators = tomlfmt.SeparatorPolicy{} }},
+		{"basic_strings", func(o *tomlfmt.Options) { o.StringStyle = tomlfmt.StringBasic }},
+		{"literal_strings", func(o *tomlfmt.Options) { o.StringStyle = tomlfmt.StringLiteral }},
+		{"preserve_strings", func(o *tomlfmt.Options) { o.StringStyle = tomlfmt.StringPreserve }},
+		{"preserve_key_quotes", func(o *tomlfmt.Options) { o.PreserveKeyQuotes = true }},
+		{"exponent_floats", func(o *tomlfmt.Options) { o.FloatFormat = tomlfmt.FloatExponent }},
+		{"two_final_newlines", func(o *tomlfmt.Options) { o.FinalNewlines = 2 }},
+	}
+
+	for _, inputPath := range inputs {
+		input, err := os.ReadFile(inputPath) // #nosec G304 -- path comes from the test corpus
+		if err != nil {
+			t.Fatalf("reading input: %v", err)
+		}
+		name := strings.TrimSuffix(filepath.Base(inputPath), ".toml")
+		for _, set := range optionSets {
+			t.Run(name+"/"+set.name, func(t *testing.T) {
+				opts := tomlfmt.DefaultOptions()
+				set.modify(&opts)
+
+				first, err := tomlfmt.FormatBytes(input, opts)
+				if err != nil {
+					t.Fatalf("FormatBytes() returned unexpected error: %v", err)
+				}
+				second, err := tomlfmt.FormatBytes(first, opts)
+				if err != nil {
+					t.Fatalf("FormatBytes() of the formatted output returned unexpected error: %v\n%s", err, first)
+				}
+				if !bytes.Equal(second, first) {
+					t.Errorf("formatting the output again changed it:\nfirst:\n%s\nsecond:\n%s", first, second)
+				}
+			})
+		}
+	}
+}
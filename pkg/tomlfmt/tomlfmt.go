@@ -0,0 +1,316 @@
+// SPDX-License-Identifier: MIT
+
+// Package tomlfmt pretty-prints TOML documents: it aligns the values of each
+// table, orders keys, groups simple keys ahead of tables, and can keep the
+// comments and key order of an original document. It is the library behind the
+// toml-fmt command.
+//
+// The functions, types, and constants of this package are the supported API of
+// the module. Their signatures only change in a new major version; new options
+// are added as fields of Options, and DefaultOptions sets each new field so that
+// the previous behavior is kept. The zero Options is not the default (it turns
+// off value alignment, for one), so build options with DefaultOptions and
+// adjust from there.
+package tomlfmt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	toml "github.com/pelletier/go-toml/v2"
+
+	"github.com/esacteksab/go-pretty-toml/internal/formatter"
+)
+
+// utf8BOM is the byte order mark some editors place at the start of UTF-8 files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Options controls how a document is rendered. See the field documentation for
+// each setting; DefaultOptions returns the settings the toml-fmt CLI uses.
+type Options = formatter.Options
+
+// SortMode controls the order in which keys of a table are emitted.
+type SortMode = formatter.SortMode
+
+// SectionOrder controls whether arrays of tables or tables follow a table's simple keys first.
+type SectionOrder = formatter.SectionOrder
+
+// IndentMode controls which lines Options.IndentUnit indents.
+type IndentMode = formatter.IndentMode
+
+// MultilineMode controls when string values are written as multi-line basic strings.
+type MultilineMode = formatter.MultilineMode
+
+// StringStyle controls whether single-line strings are written as basic "..." or literal '...' strings.
+type StringStyle = formatter.StringStyle
+
+// FloatFormat controls the notation used for float values.
+type FloatFormat = formatter.FloatFormat
+
+// SeparatorPolicy sets how many blank lines precede table and array table headers.
+type SeparatorPolicy = formatter.SeparatorPolicy
+
+// DuplicateKeyError reports a key or table that a document defines more than
+// once, with the lines of both definitions. FormatBytes and FormatStream return
+// it (wrapped) for such documents.
+type DuplicateKeyError = formatter.DuplicateKeyError
+
+// ParseError reports the line and column at which a document stopped being
+// valid TOML. FormatBytes and FormatStream return it (wrapped) for such
+// documents; errors.As also reaches the underlying *toml.DecodeError.
+type ParseError = formatter.ParseError
+
+// SourceInfo records details of an original TOML text, such as key order and
+// comments, that are lost when the document is decoded into a map. Build one
+// with ParseSourceInfo and pass it via Options.Source.
+type SourceInfo = formatter.SourceInfo
+
+// Key orders for Options.SortKeys.
+const (
+	SortAscending = formatter.SortAscending // Alphabetical order
+	SortNone      = formatter.SortNone      // Source order, which requires Options.Source
+	SortGroupOnly = formatter.SortGroupOnly // Source order within the simple key, array table, and table groups
+)
+
+// Section orders for Options.SectionOrder.
+const (
+	SectionArrayTablesFirst = formatter.SectionArrayTablesFirst // [[array.tables]], then [tables]
+	SectionTablesFirst      = formatter.SectionTablesFirst      // [tables], then [[array.tables]]
+)
+
+// Indentation modes for Options.IndentMode.
+const (
+	IndentNested      = formatter.IndentNested      // Nested headers and their key/value lines
+	IndentTablesOnly  = formatter.IndentTablesOnly  // Nested headers; key/value lines flush with their header
+	IndentEntriesOnly = formatter.IndentEntriesOnly // Key/value lines one level below flush-left headers
+)
+
+// String styles for Options.MultilineStrings.
+const (
+	MultilineNever        = formatter.MultilineNever        // Always single-line strings with \n escapes
+	MultilineWhenNewlines = formatter.MultilineWhenNewlines // """...""" blocks for strings with newlines
+)
+
+// Quoting styles for Options.StringStyle.
+const (
+	StringAuto     = formatter.StringAuto     // Literal strings for strings with backslashes
+	StringBasic    = formatter.StringBasic    // Always basic strings
+	StringLiteral  = formatter.StringLiteral  // Literal strings wherever possible
+	StringPreserve = formatter.StringPreserve // The style of each string in Options.Source
+)
+
+// Float notations for Options.FloatFormat.
+const (
+	FloatShortest = formatter.FloatShortest // Shortest round-trip form
+	FloatDecimal  = formatter.FloatDecimal  // Always plain decimal notation
+	FloatExponent = formatter.FloatExponent // Always exponent notation
+)
+
+// DefaultOptions returns the options used by the toml-fmt CLI when no flags are given:
+// no indentation, minimal key quoting, alphabetical keys, and a single trailing newline.
+// It sets no line width limit, while the CLI wraps lines longer than 80 characters;
+// set MaxLineWidth to match.
+func DefaultOptions() Options {
+	return formatter.DefaultOptions()
+}
+
+// DefaultMaxNestingDepth is the nesting limit used when Options.MaxNestingDepth is zero.
+const DefaultMaxNestingDepth = formatter.DefaultMaxNestingDepth
+
+// DefaultSeparatorPolicy returns the blank-line policy used by DefaultOptions.
+func DefaultSeparatorPolicy() SeparatorPolicy {
+	return formatter.DefaultSeparatorPolicy()
+}
+
+// ParseSourceInfo scans TOML source text and records the key order and comments
+// that a decoded map does not retain, for use as Options.Source.
+//
+// Parameters:
+//   - input: Raw TOML document (without a BOM)
+//
+// Returns:
+//   - *SourceInfo: Information about the source document
+//   - error: If the document cannot be parsed
+func ParseSourceInfo(input []byte) (*SourceInfo, error) {
+	return formatter.ParseSourceInfo(input)
+}
+
+// Format writes data as a formatted TOML document to w.
+//
+// Values may be strings, integers, floats, booleans, datetimes, arrays (any
+// slice type), and tables (any map with string keys). A nil value is an error
+// because TOML has no null. Datetimes use the types go-toml v2 decodes them to:
+//   - time.Time: an offset date-time, written in RFC 3339 form with its
+//     fractional seconds and offset (Z for UTC), such as 1979-05-27T07:32:00Z
+//   - toml.LocalDateTime: a date-time without an offset, such as 1979-05-27T07:32:00
+//   - toml.LocalDate: a date, such as 1979-05-27
+//   - toml.LocalTime: a time of day, such as 07:32:00
+//
+// Pointers to these types are not supported.
+//
+// Parameters:
+//   - data: The document, such as the result of decoding TOML into a map[string]any
+//   - opts: Formatting options, usually DefaultOptions with adjustments
+//   - w: Writer that receives the formatted document; nothing is written on error
+//
+// Returns:
+//   - error: If w is nil, a value cannot be represented, or writing fails
+func Format(data map[string]any, opts Options, w io.Writer) error {
+	return formatter.FormatWithOptions(data, opts, w)
+}
+
+// FormatUnbuffered is like Format but writes the document to w while it is being
+// formatted, instead of assembling it in memory first, so memory use does not
+// grow with the size of the output. Use it for very large documents written to a
+// file or network connection.
+//
+// Parameters:
+//   - data: The document to format
+//   - opts: Formatting options
+//   - w: Writer that receives the formatted document; on error part of it may already have been written
+//
+// Returns:
+//   - error: If w is nil, a value cannot be represented, or writing fails
+func FormatUnbuffered(data map[string]any, opts Options, w io.Writer) error {
+	return formatter.StreamWithOptions(data, opts, w)
+}
+
+// FormatString is like Format but returns the formatted document as a string.
+//
+// Parameters:
+//   - data: The document to format
+//   - opts: Formatting options
+//
+// Returns:
+//   - string: The formatted document
+//   - error: If a value cannot be represented
+func FormatString(data map[string]any, opts Options) (string, error) {
+	var buf bytes.Buffer
+	if err := Format(data, opts, &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// FormatMap is like Format but returns the formatted document as bytes. It
+// formats data that was already decoded, for example with toml.Unmarshal, and
+// possibly changed since, without encoding and parsing it again. To keep the
+// comments and key order of the original text, pass ParseSourceInfo of that
+// text as opts.Source; keys added to data since then are placed by opts.SortKeys.
+//
+// Parameters:
+//   - data: The document; see Format for the supported value types
+//   - opts: Formatting options
+//
+// Returns:
+//   - []byte: The formatted document
+//   - error: If a value cannot be represented
+func FormatMap(data map[string]any, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Format(data, opts, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FormatBytes parses a TOML document and returns it formatted, keeping its
+// comments and the notation of its integers. opts.Source is replaced by the
+// information read from input. A leading UTF-8 byte order mark is kept, as the
+// toml-fmt CLI does by default, and an empty document (empty input, or input
+// with only whitespace) yields empty output.
+//
+// Parameters:
+//   - input: Raw TOML document
+//   - opts: Formatting options
+//
+// Returns:
+//   - []byte: The formatted document
+//   - error: If input is not valid TOML (a *ParseError with its line and column,
+//     or a *DuplicateKeyError for a key defined twice) or cannot be formatted
+func FormatBytes(input []byte, opts Options) ([]byte, error) {
+	body, hadBOM := bytes.CutPrefix(input, utf8BOM)
+
+	var dupErr *DuplicateKeyError
+	if err := formatter.CheckDuplicateKeys(body); errors.As(err, &dupErr) {
+		return nil, fmt.Errorf("parsing TOML: %w", dupErr)
+	}
+	var data map[string]any
+	if err := toml.Unmarshal(body, &data); err != nil {
+		var parseErr *ParseError
+		if errors.As(formatter.NewParseError(err), &parseErr) {
+			return nil, fmt.Errorf("parsing TOML at %w", parseErr)
+		}
+		return nil, fmt.Errorf("parsing TOML: %w", err)
+	}
+	source, err := formatter.ParseSourceInfo(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading comments and key order: %w", err)
+	}
+	opts.Source = source
+
+	var buf bytes.Buffer
+	if hadBOM {
+		buf.Write(utf8BOM)
+	}
+	if err := Format(data, opts, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FormatFragment formats a TOML fragment, such as key/value lines embedded in
+// a template or in another file, and keeps it fitting its surroundings: the
+// leading whitespace shared by all of its lines is kept, and no final newline is
+// added when the fragment did not end with one. A byte order mark is dropped,
+// since it only belongs at the start of a file.
+//
+// Parameters:
+//   - input: The fragment
+//   - opts: Formatting options
+//
+// Returns:
+//   - []byte: The formatted fragment
+//   - error: If input is not valid TOML, cannot be formatted, or holds a
+//     multi-line string whose value the indentation would change
+func FormatFragment(input []byte, opts Options) ([]byte, error) {
+	input = bytes.TrimPrefix(input, utf8BOM)
+	formatted, err := FormatBytes(input, opts)
+	if err != nil {
+		return nil, err
+	}
+	return formatter.ReindentFragment(input, formatted)
+}
+
+// FormatStream reads a whole TOML document from r, formats it like FormatBytes,
+// and writes the result to w. Nothing is written to w unless the document was
+// read and formatted successfully, so a handler can still report the error.
+//
+// Parameters:
+//   - r: Source of the raw TOML document, read until EOF
+//   - w: Writer that receives the formatted document
+//   - opts: Formatting options
+//
+// Returns:
+//   - error: If r or w is nil, reading fails, the document is invalid (see FormatBytes), or writing fails
+func FormatStream(r io.Reader, w io.Writer, opts Options) error {
+	if r == nil {
+		return errors.New("input reader must not be nil")
+	}
+	if w == nil {
+		return errors.New("output writer must not be nil")
+	}
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading input: %w", err)
+	}
+	formatted, err := FormatBytes(input, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatted); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+// SPDX-License-Identifier: MIT
+package tomlfmt_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	toml "github.com/pelletier/go-toml/v2"
+
+	"github.com/esacteksab/go-pretty-toml/pkg/tomlfmt"
+)
+
+func TestFormat(t *testing.T) {
+	data := map[string]any{
+		"name":   "app",
+		"server": map[string]any{"port": 8080, "host": "localhost"},
+	}
+	want := `name = "app"
+
+[server]
+host = "localhost"
+port = 8080
+`
+	var buf bytes.Buffer
+	if err := tomlfmt.Format(data, tomlfmt.DefaultOptions(), &buf); err != nil {
+		t.Fatalf("Format() returned unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("Format() output mismatch:\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	got, err := tomlfmt.FormatString(data, tomlfmt.DefaultOptions())
+	if err != nil {
+		t.Fatalf("FormatString() returned unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("FormatString() = %q, want %q", got, want)
+	}
+
+	if _, err := tomlfmt.FormatString(map[string]any{"k": nil}, tomlfmt.DefaultOptions()); err == nil ||
+		!strings.Contains(err.Error(), "nil value") {
+		t.Errorf("FormatString() error = %v, want nil value error", err)
+	}
+	if err := tomlfmt.Format(data, tomlfmt.DefaultOptions(), nil); err == nil {
+		t.Errorf("Format() with a nil writer returned nil error")
+	}
+}
+
+func TestFormatWithSource(t *testing.T) {
+	input := []byte(`# service settings
+zeta = 1 # last letter
+alpha = 2
+`)
+	var data map[string]any
+	if err := toml.Unmarshal(input, &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	source, err := tomlfmt.ParseSourceInfo(input)
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+	opts := tomlfmt.DefaultOptions()
+	opts.Source = source
+	opts.SortKeys = tomlfmt.SortNone
+	opts.IndentUnit = "  "
+
+	got, err := tomlfmt.FormatString(data, opts)
+	if err != nil {
+		t.Fatalf("FormatString() returned unexpected error: %v", err)
+	}
+	want := "# service settings\nzeta  = 1 # last letter\nalpha = 2\n"
+	if got != want {
+		t.Errorf("FormatString() = %q, want %q", got, want)
+	}
+}
+
+// TestFormatMap checks that a document can be decoded once, changed, and
+// formatted without encoding it again, and that every datetime type decoded by
+// go-toml keeps its form.
+func TestFormatMap(t *testing.T) {
+	input := []byte(`# release settings
+
+version = "1.0" # bumped by CI
+released = 1979-05-27T07:32:00Z
+local = 1979-05-27T07:32:00.5
+day = 1979-05-27
+at = 07:32:00
+`)
+	var data map[string]any
+	if err := toml.Unmarshal(input, &data); err != nil {
+		t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+	}
+	source, err := tomlfmt.ParseSourceInfo(input)
+	if err != nil {
+		t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+	}
+	data["version"] = "1.1"
+	data["channel"] = "stable"
+	opts := tomlfmt.DefaultOptions()
+	opts.Source = source
+
+	got, err := tomlfmt.FormatMap(data, opts)
+	if err != nil {
+		t.Fatalf("FormatMap() returned unexpected error: %v", err)
+	}
+	want := `# release settings
+
+at       = 07:32:00
+channel  = "stable"
+day      = 1979-05-27
+local    = 1979-05-27T07:32:00.5
+released = 1979-05-27T07:32:00Z
+version  = "1.1" # bumped by CI
+`
+	if string(got) != want {
+		t.Errorf("FormatMap() = %q, want %q", got, want)
+	}
+
+	if _, err := tomlfmt.FormatMap(map[string]any{"a": nil}, opts); err == nil {
+		t.Error("FormatMap() returned no error for a nil value")
+	}
+}
+
+// TestFormatUnbuffered checks that streaming produces exactly what Format does
+// for every corpus document, and that a failure is still reported.
+func TestFormatUnbuffered(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "golden", "*.toml"))
+	if err != nil {
+		t.Fatalf("listing corpus: %v", err)
+	}
+	for _, inputPath := range inputs {
+		t.Run(strings.TrimSuffix(filepath.Base(inputPath), ".toml"), func(t *testing.T) {
+			input, err := os.ReadFile(inputPath) // #nosec G304 -- path comes from the test corpus
+			if err != nil {
+				t.Fatalf("reading input: %v", err)
+			}
+			input = bytes.TrimPrefix(input, []byte("\ufeff")) // Format takes decoded data; the BOM is FormatBytes' concern
+			var data map[string]any
+			if err := toml.Unmarshal(input, &data); err != nil {
+				t.Fatalf("toml.Unmarshal() returned unexpected error: %v", err)
+			}
+			opts := tomlfmt.DefaultOptions()
+			opts.Source, err = tomlfmt.ParseSourceInfo(input)
+			if err != nil {
+				t.Fatalf("ParseSourceInfo() returned unexpected error: %v", err)
+			}
+
+			var buffered, streamed bytes.Buffer
+			if err := tomlfmt.Format(data, opts, &buffered); err != nil {
+				t.Fatalf("Format() returned unexpected error: %v", err)
+			}
+			if err := tomlfmt.FormatUnbuffered(data, opts, &streamed); err != nil {
+				t.Fatalf("FormatUnbuffered() returned unexpected error: %v", err)
+			}
+			if !bytes.Equal(streamed.Bytes(), buffered.Bytes()) {
+				t.Errorf("FormatUnbuffered() output differs from Format():\ngot:\n%s\nwant:\n%s", streamed.Bytes(), buffered.Bytes())
+			}
+		})
+	}
+
+	if err := tomlfmt.FormatUnbuffered(map[string]any{"k": nil}, tomlfmt.DefaultOptions(), &bytes.Buffer{}); err == nil {
+		t.Errorf("FormatUnbuffered() with a nil value returned nil error")
+	}
+	if err := tomlfmt.FormatUnbuffered(map[string]any{}, tomlfmt.DefaultOptions(), nil); err == nil {
+		t.Errorf("FormatUnbuffered() with a nil writer returned nil error")
+	}
+}
+
+func ExampleFormatString() {
+	opts := tomlfmt.DefaultOptions()
+	opts.IndentUnit = "  "
+	out, err := tomlfmt.FormatString(map[string]any{
+		"title": "demo",
+		"owner": map[string]any{"name": "Tom", "id": 7},
+	}, opts)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(out)
+	// Output:
+	// title = "demo"
+	//
+	// [owner]
+	//   id   = 7
+	//   name = "Tom"
+}
+
+func TestFormatBytes(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"whitespace_only", "\n  \n", ""},
+		{"comments_only", "# just a note\n", "# just a note\n"},
+		{"keys_and_comments", "b=2 # two\na=0x1F\n", "a = 0x1F\nb = 2 # two\n"},
+		{"bom_kept", "\ufeffz=1\n", "\ufeffz = 1\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tomlfmt.FormatBytes([]byte(tc.input), tomlfmt.DefaultOptions())
+			if err != nil {
+				t.Fatalf("FormatBytes() returned unexpected error: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("FormatBytes(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+
+	_, err := tomlfmt.FormatBytes([]byte("a = 1\nb = \n"), tomlfmt.DefaultOptions())
+	if err == nil || !strings.Contains(err.Error(), "parsing TOML at line 2, column 5") {
+		t.Errorf("FormatBytes() error = %v, want a parse error with its position", err)
+	}
+	var decodeErr *toml.DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Errorf("FormatBytes() error %v does not wrap *toml.DecodeError", err)
+	}
+	var parseErr *tomlfmt.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 2 || parseErr.Column != 5 {
+		t.Errorf("FormatBytes() error = %v, want a *ParseError at line 2, column 5", err)
+	}
+
+	_, err = tomlfmt.FormatBytes([]byte("name = 1\n\n'name' = 2\n"), tomlfmt.DefaultOptions())
+	var dupErr *tomlfmt.DuplicateKeyError
+	if !errors.As(err, &dupErr) || dupErr.Key != "name" || dupErr.Line != 3 || dupErr.FirstLine != 1 {
+		t.Errorf("FormatBytes() error = %v, want a *DuplicateKeyError for name at lines 3 and 1", err)
+	}
+}
+
+func TestFormatFragment(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "b=2\na=1\n", "a = 1\nb = 2\n"},
+		{"indented", "    b=2\n    a=1\n", "    a = 1\n    b = 2\n"},
+		{"no_final_newline", "  b=2\n  a=1", "  a = 1\n  b = 2"},
+		{"bom_dropped", "\ufeffz=1", "z = 1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tomlfmt.FormatFragment([]byte(tc.input), tomlfmt.DefaultOptions())
+			if err != nil {
+				t.Fatalf("FormatFragment() returned unexpected error: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("FormatFragment(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+
+	if _, err := tomlfmt.FormatFragment([]byte("  a = \n"), tomlfmt.DefaultOptions()); err == nil {
+		t.Error("FormatFragment() returned no error for invalid TOML")
+	}
+}
+
+// errorReadWriter fails every read and write.
+type errorReadWriter struct{}
+
+func (errorReadWriter) Read([]byte) (int, error)  { return 0, errors.New("read failed") }
+func (errorReadWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestFormatStream(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{"formats", "b=2 # two\na=1\n", "a = 1\nb = 2 # two\n", ""},
+		{"empty", "", "", ""},
+		{"parse_error", "a = 1\nb = \n", "", "parsing TOML at line 2, column 5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := tomlfmt.FormatStream(strings.NewReader(tc.input), &buf, tomlfmt.DefaultOptions())
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("FormatStream() error = %v, want error containing %q", err, tc.wantErr)
+				}
+				if buf.Len() != 0 {
+					t.Errorf("FormatStream() wrote %q on error, want nothing", buf.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FormatStream() returned unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("FormatStream(%q) wrote %q, want %q", tc.input, buf.String(), tc.want)
+			}
+		})
+	}
+
+	if err := tomlfmt.FormatStream(errorReadWriter{}, &bytes.Buffer{}, tomlfmt.DefaultOptions()); err == nil ||
+		!strings.Contains(err.Error(), "reading input: read failed") {
+		t.Errorf("FormatStream() with failing reader error = %v", err)
+	}
+	if err := tomlfmt.FormatStream(nil, &bytes.Buffer{}, tomlfmt.DefaultOptions()); err == nil ||
+		err.Error() != "input reader must not be nil" {
+		t.Errorf("FormatStream() with nil reader error = %v", err)
+	}
+	if err := tomlfmt.FormatStream(strings.NewReader(""), nil, tomlfmt.DefaultOptions()); err == nil ||
+		err.Error() != "output writer must not be nil" {
+		t.Errorf("FormatStream() with nil writer error = %v", err)
+	}
+	if err := tomlfmt.FormatStream(strings.NewReader("a = 1\n"), errorReadWriter{}, tomlfmt.DefaultOptions()); err == nil ||
+		!strings.Contains(err.Error(), "writing output: write failed") {
+		t.Errorf("FormatStream() with failing writer error = %v", err)
+	}
+	if err := tomlfmt.FormatStream(nil, &bytes.Buffer{}, tomlfmt.DefaultOptions()); err == nil {
+		t.Error("FormatStream() with nil reader returned nil error")
+	}
+	if err := tomlfmt.FormatStream(strings.NewReader(""), nil, tomlfmt.DefaultOptions()); err == nil {
+		t.Error("FormatStream() with nil writer returned nil error")
+	}
+}